@@ -0,0 +1,201 @@
+package shrtie
+
+import (
+	"golang.org/x/net/context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Click is a single redirect recorded by Analytics.
+type Click struct {
+	Time      time.Time
+	Namespace string // Namespace of the link, see WithNamespaces
+	Key       string
+	Referrer  string
+	UserAgent string
+	Language  string // Accept-Language header
+	IP        string // Client IP, anonymized with WithIPAnonymization
+}
+
+// Analytics is called by RedirectHandler for every redirect. Record is
+// called on the redirect path, so it must not block.
+type Analytics interface {
+	Record(click Click)
+}
+
+// ClickWriter is implemented by backends which store clicks, e.g. for
+// BufferedAnalytics. The clicks slice must not be retained.
+type ClickWriter interface {
+	WriteClicks(ctx context.Context, clicks []Click) error
+}
+
+// WithAnalytics records every redirect with a.
+func WithAnalytics(a Analytics) Option {
+	return func(s *Shrtie) {
+		s.analytics = a
+	}
+}
+
+// WithIPAnonymization removes the host part of recorded client IPs, see
+// AnonymizeIP.
+func WithIPAnonymization() Option {
+	return func(s *Shrtie) {
+		s.anonymize = true
+	}
+}
+
+// AnonymizeIP masks ip to its /24 network for IPv4 and /48 for IPv6.
+// Invalid addresses result in an empty string.
+func AnonymizeIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// click returns the click of the redirect to key
+func (s Shrtie) click(r *http.Request, ctx context.Context, key string) Click {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if s.anonymize {
+		ip = AnonymizeIP(ip)
+	}
+
+	return Click{
+		Time:      time.Now(),
+		Namespace: NamespaceFromContext(ctx),
+		Key:       key,
+		Referrer:  r.Referer(),
+		UserAgent: r.UserAgent(),
+		Language:  r.Header.Get("Accept-Language"),
+		IP:        ip,
+	}
+}
+
+const (
+	// clickBatch is the maximum number of clicks written at once
+	clickBatch = 100
+
+	// clickTimeout limits a single write of BufferedAnalytics
+	clickTimeout = 10 * time.Second
+)
+
+// BufferedAnalytics queues clicks and writes them in batches in the
+// background, so recording adds no latency to redirects. Clicks are
+// dropped if the queue is full.
+type BufferedAnalytics struct {
+	writer   ClickWriter
+	clicks   chan Click
+	interval time.Duration
+	dropped  int64
+
+	quit, done chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewBufferedAnalytics returns an Analytics writing to w. It queues up to
+// size clicks and writes them at least every interval.
+func NewBufferedAnalytics(w ClickWriter, size int, interval time.Duration) *BufferedAnalytics {
+	if size <= 0 {
+		size = 1024
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	b := &BufferedAnalytics{
+		writer:   w,
+		clicks:   make(chan Click, size),
+		interval: interval,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go b.run()
+	return b
+}
+
+func (b *BufferedAnalytics) Record(click Click) {
+	select {
+	case b.clicks <- click:
+	default:
+		atomic.AddInt64(&b.dropped, 1)
+	}
+}
+
+// Dropped returns the number of clicks dropped because the queue was full.
+func (b *BufferedAnalytics) Dropped() int64 {
+	return atomic.LoadInt64(&b.dropped)
+}
+
+// Close writes the queued clicks and stops the background writer. Clicks
+// recorded afterwards are dropped.
+func (b *BufferedAnalytics) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.quit)
+	})
+
+	<-b.done
+	return nil
+}
+
+func (b *BufferedAnalytics) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	batch := make([]Click, 0, clickBatch)
+	for {
+		select {
+		case click := <-b.clicks:
+			if batch = append(batch, click); len(batch) == clickBatch {
+				batch = b.flush(batch)
+			}
+		case <-ticker.C:
+			batch = b.flush(batch)
+		case <-b.quit:
+			// Drain the queue
+			for {
+				select {
+				case click := <-b.clicks:
+					if batch = append(batch, click); len(batch) == clickBatch {
+						batch = b.flush(batch)
+					}
+				default:
+					b.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes the batch and returns it emptied
+func (b *BufferedAnalytics) flush(batch []Click) []Click {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clickTimeout)
+	defer cancel()
+
+	if err := b.writer.WriteClicks(ctx, batch); err != nil {
+		log.Println("Failed to write clicks:", err)
+	}
+
+	return batch[:0]
+}
@@ -0,0 +1,140 @@
+package shrtie
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testClickWriter keeps the written clicks
+type testClickWriter struct {
+	mu      sync.Mutex
+	clicks  []Click
+	batches int
+	block   chan struct{}
+}
+
+func (w *testClickWriter) WriteClicks(ctx context.Context, clicks []Click) error {
+	if w.block != nil {
+		<-w.block
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.clicks = append(w.clicks, clicks...)
+	w.batches++
+	return nil
+}
+
+func TestBufferedAnalytics(t *testing.T) {
+	w := &testClickWriter{}
+	a := NewBufferedAnalytics(w, 1000, time.Hour)
+
+	for i := 0; i < 250; i++ {
+		a.Record(Click{Key: "abc"})
+	}
+
+	// Close writes the queued clicks
+	a.Close()
+
+	if len(w.clicks) != 250 || w.batches != 3 {
+		t.Errorf("Wrong clicks written: %d in %d batches", len(w.clicks), w.batches)
+	}
+
+	if a.Dropped() != 0 {
+		t.Error("Clicks were dropped:", a.Dropped())
+	}
+}
+
+func TestBufferedAnalyticsInterval(t *testing.T) {
+	w := &testClickWriter{}
+	a := NewBufferedAnalytics(w, 10, 10*time.Millisecond)
+	defer a.Close()
+
+	a.Record(Click{Key: "abc"})
+	time.Sleep(100 * time.Millisecond)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.clicks) != 1 {
+		t.Error("Click wasn't written after interval:", len(w.clicks))
+	}
+}
+
+func TestBufferedAnalyticsDrop(t *testing.T) {
+	w := &testClickWriter{block: make(chan struct{})}
+	a := NewBufferedAnalytics(w, 1, 10*time.Millisecond)
+
+	// Get the writer stuck in a flush
+	a.Record(Click{Key: "abc"})
+	time.Sleep(50 * time.Millisecond)
+
+	// Recording must not block while the writer is stuck
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			a.Record(Click{Key: "abc"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Record blocked")
+	}
+
+	if a.Dropped() == 0 {
+		t.Error("No clicks dropped")
+	}
+
+	close(w.block)
+	a.Close()
+}
+
+func TestRedirectAnalytics(t *testing.T) {
+	w := &testClickWriter{}
+	a := NewBufferedAnalytics(w, 10, time.Hour)
+	handler := New(tb, WithAnalytics(a), WithIPAnonymization()).RedirectHandler()
+
+	req, _ := http.NewRequest("GET", "http://example.com/abc", nil)
+	req.RemoteAddr = "192.168.1.42:1234"
+	req.Header.Set("Referer", "https://there.com/")
+	req.Header.Set("User-Agent", "test")
+	req.Header.Set("Accept-Language", "de")
+	res := httptest.NewRecorder()
+	handler.f(res, req, context.WithValue(context.Background(), "id", "abc"))
+
+	// Failed redirects aren't recorded
+	res = httptest.NewRecorder()
+	handler.f(res, req, context.WithValue(context.Background(), "id", "unknown"))
+
+	a.Close()
+
+	if len(w.clicks) != 1 {
+		t.Fatal("Wrong number of clicks:", len(w.clicks))
+	}
+
+	c := w.clicks[0]
+	if c.Key != "abc" || c.Referrer != "https://there.com/" || c.UserAgent != "test" || c.Language != "de" || c.IP != "192.168.1.0" || c.Time.IsZero() {
+		t.Error("Wrong click recorded:", c)
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := map[string]string{
+		"192.168.1.42":          "192.168.1.0",
+		"2001:db8:1234:5678::1": "2001:db8:1234::",
+		"invalid":               "",
+	}
+
+	for ip, expected := range tests {
+		if got := AnonymizeIP(ip); got != expected {
+			t.Errorf("AnonymizeIP(%q) = %q, expected %q", ip, got, expected)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package shrtie
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"golang.org/x/net/context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnauthorized = errors.New("Unauthorized") // 401 Unauthorized
+	ErrForbidden    = errors.New("Forbidden")    // 403 Forbidden
+)
+
+// Scope is a permission of an API key
+type Scope string
+
+const (
+	ScopeCreate    Scope = "create"     // Save links, SaveHandler and BulkSaveHandler
+	ScopeReadStats Scope = "read-stats" // Read links and clicks, InfoHandler, StatsHandler and ListHandler
+	ScopeUpdate    Scope = "update"     // UpdateHandler
+	ScopeDelete    Scope = "delete"     // DeleteHandler
+	ScopeAdmin     Scope = "admin"      // Every scope and managing API keys
+)
+
+var validScopes = map[Scope]bool{
+	ScopeCreate:    true,
+	ScopeReadStats: true,
+	ScopeUpdate:    true,
+	ScopeDelete:    true,
+	ScopeAdmin:     true,
+}
+
+// AnyNamespace is the namespace of identities and API keys working in every
+// namespace. The empty namespace is the default one, like for contexts.
+const AnyNamespace = "*"
+
+// Identity is the authenticated client of a request
+type Identity struct {
+	ID        string
+	Scopes    []Scope
+	Namespace string // The only namespace the client may use, AnyNamespace for every one
+}
+
+// Allows reports if the identity has the scope, admins have every scope.
+func (i *Identity) Allows(scope Scope) bool {
+	for _, s := range i.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticator authenticates requests. Missing and invalid credentials
+// are reported with ErrUnauthorized.
+type Authenticator interface {
+	Authenticate(ctx context.Context, r *http.Request) (*Identity, error)
+}
+
+// identityKey is the context key of the Identity of a request
+type identityKey struct{}
+
+// IdentityFromContext returns the Identity handlers are called with if an
+// Authenticator is set.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// WithAuthenticator requires every handler but RedirectHandler and
+// QRHandler to be called with credentials accepted by a. The handlers
+// require the scope noted at the scopes, missing credentials are answered
+// with 401 Unauthorized and missing scopes with 403 Forbidden.
+func WithAuthenticator(a Authenticator) Option {
+	return func(s *Shrtie) {
+		s.auth = a
+	}
+}
+
+// authorize wraps h so it requires scope if an Authenticator is set.
+// Identities are limited to their namespace unless it's AnyNamespace.
+func (s Shrtie) authorize(scope Scope, h Handler) Handler {
+	if s.auth == nil {
+		return s.namespaced(h)
+	}
+
+	return s.namespaced(Handler{
+		f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+			identity, err := s.auth.Authenticate(ctx, r)
+			if err == ErrUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="shrtie"`)
+			}
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+
+			if !identity.Allows(scope) {
+				httpError(w, ErrForbidden)
+				return
+			}
+
+			if identity.Namespace != AnyNamespace {
+				if ns := NamespaceFromContext(ctx); ns != "" && ns != identity.Namespace {
+					httpError(w, ErrForbidden)
+					return
+				}
+				ctx = WithNamespace(ctx, identity.Namespace)
+			}
+
+			h.f(w, r, context.WithValue(ctx, identityKey{}, identity))
+		},
+	})
+}
+
+// APIKey is an API key as stored by a KeyStore. Only a hash of the secret
+// is stored, it's shown once when the key is created.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"-"` // Hex encoded SHA-256 of the token
+	Scopes    []Scope   `json:"scopes"`
+	Namespace string    `json:"namespace,omitempty"` // The only namespace the key works in, AnyNamespace for every one
+	Created   time.Time `json:"created"`
+}
+
+// KeyStore is implemented by backends which store API keys. Keys aren't
+// namespaced, they are stored with their Namespace field in one place.
+// APIKey and RevokeAPIKey return ErrNotFound for unknown IDs.
+type KeyStore interface {
+	SaveAPIKey(ctx context.Context, key *APIKey) error
+	APIKey(ctx context.Context, id string) (*APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) error
+}
+
+// CreateAPIKey creates an API key with the scopes and returns the token
+// clients send as bearer token. Use it to create the first admin key. The
+// key is limited to the namespace of ctx, pass a context of
+// WithNamespace(ctx, AnyNamespace) for a key working in every namespace.
+func CreateAPIKey(ctx context.Context, store KeyStore, scopes ...Scope) (string, *APIKey, error) {
+	if len(scopes) == 0 {
+		return "", nil, errors.New("API keys need a scope")
+	}
+
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return "", nil, errors.New("Invalid scope " + string(scope))
+		}
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	// The ID is part of the token, so keys are looked up without the secret
+	token := hex.EncodeToString(id) + "." + base64.RawURLEncoding.EncodeToString(secret)
+	key := &APIKey{
+		ID:        hex.EncodeToString(id),
+		Hash:      hashToken(token),
+		Scopes:    scopes,
+		Namespace: NamespaceFromContext(ctx),
+		Created:   time.Now().UTC().Truncate(time.Second),
+	}
+
+	if err := store.SaveAPIKey(ctx, key); err != nil {
+		return "", nil, err
+	}
+
+	return token, key, nil
+}
+
+// hashToken returns the hash of a token stored in APIKey. Tokens are
+// random, so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeys authenticates bearer tokens of API keys created with CreateAPIKey.
+type APIKeys struct {
+	Store KeyStore
+}
+
+func (a APIKeys) Authenticate(ctx context.Context, r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, ErrUnauthorized
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	id := strings.SplitN(token, ".", 2)[0]
+	if id == token {
+		return nil, ErrUnauthorized
+	}
+
+	key, err := a.Store.APIKey(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(key.Hash)) != 1 {
+		return nil, ErrUnauthorized
+	}
+
+	return &Identity{ID: key.ID, Scopes: key.Scopes, Namespace: key.Namespace}, nil
+}
+
+// confined reports if the request of ctx is limited to its namespace, that
+// is if it isn't in the default one or if it's made by an identity of a
+// single namespace
+func confined(ctx context.Context) bool {
+	if NamespaceFromContext(ctx) != "" {
+		return true
+	}
+
+	identity, ok := IdentityFromContext(ctx)
+	return ok && identity.Namespace != AnyNamespace
+}
+
+// KeyRequest is the JSON body posted to KeyHandler
+type KeyRequest struct {
+	Scopes    []Scope `json:"scopes"`
+	Namespace string  `json:"namespace,omitempty"` // Defaults to the namespace of the request, AnyNamespace for every one
+}
+
+// KeyResponse is the answer of KeyHandler, the token isn't shown again.
+type KeyResponse struct {
+	APIKey
+	Token string `json:"token"`
+}
+
+// KeyHandler creates API keys, it requires the admin scope. Admins of a
+// namespace, the default one included, only create keys of their namespace.
+func (s Shrtie) KeyHandler() Handler {
+	// Check if backend implements KeyStore interface
+	if backendKeys, ok := s.inner.(KeyStore); ok {
+		return s.authorize(ScopeAdmin, Handler{
+			f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+				var request KeyRequest
+
+				if r.Header.Get("Content-Type") != "application/json" {
+					http.Error(w, "Wrong application", http.StatusBadRequest)
+					return
+				}
+
+				defer r.Body.Close()
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					http.Error(w, "Bad Data", http.StatusBadRequest)
+					return
+				}
+
+				for _, scope := range request.Scopes {
+					if !validScopes[scope] {
+						http.Error(w, "Bad Scope", http.StatusBadRequest)
+						return
+					}
+				}
+
+				if len(request.Scopes) == 0 {
+					http.Error(w, "Bad Scope", http.StatusBadRequest)
+					return
+				}
+
+				ns := NamespaceFromContext(ctx)
+				if request.Namespace != "" {
+					if !ValidNamespace(request.Namespace) && request.Namespace != AnyNamespace {
+						http.Error(w, "Bad Namespace", http.StatusBadRequest)
+						return
+					}
+
+					if confined(ctx) && ns != request.Namespace {
+						httpError(w, ErrForbidden)
+						return
+					}
+					ns = request.Namespace
+				}
+
+				token, key, err := CreateAPIKey(WithNamespace(ctx, ns), backendKeys, request.Scopes...)
+				if err != nil {
+					httpError(w, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Cache-Control", "no-store")
+				json.NewEncoder(w).Encode(KeyResponse{APIKey: *key, Token: token})
+				return
+			},
+		})
+	}
+
+	// Exit programm if backend doesn't support KeyStore interface
+	log.Panicln("Backend doesn't support KeyStore interface")
+	return Handler{}
+}
+
+// RevokeKeyHandler revokes the API key with the id, it requires the admin
+// scope. Admins of a namespace only find keys of their namespace.
+func (s Shrtie) RevokeKeyHandler() Handler {
+	// Check if backend implements KeyStore interface
+	if backendKeys, ok := s.inner.(KeyStore); ok {
+		return s.authorize(ScopeAdmin, Handler{
+			f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+				id := ctx.Value("id").(string)
+				if confined(ctx) {
+					key, err := backendKeys.APIKey(ctx, id)
+					if err == nil && key.Namespace != NamespaceFromContext(ctx) {
+						err = ErrNotFound
+					}
+					if err != nil {
+						httpError(w, err)
+						return
+					}
+				}
+
+				if err := backendKeys.RevokeAPIKey(ctx, id); err != nil {
+					httpError(w, err)
+					return
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+				return
+			},
+		})
+	}
+
+	// Exit programm if backend doesn't support KeyStore interface
+	log.Panicln("Backend doesn't support KeyStore interface")
+	return Handler{}
+}
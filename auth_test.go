@@ -0,0 +1,176 @@
+package shrtie
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// testKeyBackend stores API keys in a map, the ID "down" is unavailable
+type testKeyBackend struct {
+	testBackend
+	mu   *sync.Mutex
+	keys map[string]*APIKey
+}
+
+func newTestKeyBackend() testKeyBackend {
+	return testKeyBackend{mu: &sync.Mutex{}, keys: make(map[string]*APIKey)}
+}
+
+func (b testKeyBackend) SaveAPIKey(ctx context.Context, key *APIKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keys[key.ID] = key
+	return nil
+}
+
+func (b testKeyBackend) APIKey(ctx context.Context, id string) (*APIKey, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if id == "down" {
+		return nil, ErrUnavailable
+	}
+	if key, ok := b.keys[id]; ok {
+		return key, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (b testKeyBackend) RevokeAPIKey(ctx context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.keys[id]; !ok {
+		return ErrNotFound
+	}
+	delete(b.keys, id)
+	return nil
+}
+
+func authRequest(handler Handler, method, token, id, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://example.com/"+id, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res := httptest.NewRecorder()
+	handler.f(res, req, context.WithValue(context.Background(), "id", id))
+	return res
+}
+
+func TestAuthorize(t *testing.T) {
+	b := newTestKeyBackend()
+	shrt := New(b, WithAuthenticator(APIKeys{Store: b}))
+	ctx := context.Background()
+
+	creator, _, _ := CreateAPIKey(ctx, b, ScopeCreate)
+	reader, _, _ := CreateAPIKey(ctx, b, ScopeReadStats)
+	admin, _, _ := CreateAPIKey(ctx, b, ScopeAdmin)
+
+	save := `{"url":"http://here.com"}`
+	tests := []struct {
+		name    string
+		handler Handler
+		method  string
+		token   string
+		id      string
+		body    string
+		code    int
+	}{
+		{name: "missing", handler: shrt.SaveHandler(), method: "POST", body: save, code: http.StatusUnauthorized},
+		{name: "malformed", handler: shrt.SaveHandler(), method: "POST", token: "abc", body: save, code: http.StatusUnauthorized},
+		{name: "unknown", handler: shrt.SaveHandler(), method: "POST", token: "abc.def", body: save, code: http.StatusUnauthorized},
+		{name: "wrong secret", handler: shrt.SaveHandler(), method: "POST", token: strings.Split(creator, ".")[0] + ".def", body: save, code: http.StatusUnauthorized},
+		{name: "down", handler: shrt.SaveHandler(), method: "POST", token: "down.def", body: save, code: http.StatusServiceUnavailable},
+		{name: "create", handler: shrt.SaveHandler(), method: "POST", token: creator, body: save, code: http.StatusOK},
+		{name: "create without scope", handler: shrt.SaveHandler(), method: "POST", token: reader, body: save, code: http.StatusForbidden},
+		{name: "info", handler: shrt.InfoHandler(), method: "GET", token: reader, id: "abc", code: http.StatusOK},
+		{name: "info without scope", handler: shrt.InfoHandler(), method: "GET", token: creator, id: "abc", code: http.StatusForbidden},
+		{name: "delete without scope", handler: shrt.DeleteHandler(), method: "DELETE", token: reader, id: "abc", code: http.StatusForbidden},
+		{name: "delete as admin", handler: shrt.DeleteHandler(), method: "DELETE", token: admin, id: "abc", code: http.StatusNoContent},
+		{name: "redirect", handler: shrt.RedirectHandler(), method: "GET", id: "abc", code: http.StatusMovedPermanently},
+	}
+
+	for _, test := range tests {
+		res := authRequest(test.handler, test.method, test.token, test.id, test.body)
+		if res.Code != test.code {
+			t.Errorf("%s: expected %d got %d", test.name, test.code, res.Code)
+		}
+
+		if (res.Code == http.StatusUnauthorized) != (res.Header().Get("WWW-Authenticate") != "") {
+			t.Errorf("%s: wrong WWW-Authenticate header %q", test.name, res.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestIdentityFromContext(t *testing.T) {
+	b := newTestKeyBackend()
+	token, key, _ := CreateAPIKey(context.Background(), b, ScopeCreate)
+
+	var identity *Identity
+	handler := New(b, WithAuthenticator(APIKeys{Store: b})).authorize(ScopeCreate, Handler{
+		f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+			identity, _ = IdentityFromContext(ctx)
+		},
+	})
+
+	authRequest(handler, "GET", token, "", "")
+	if identity == nil || identity.ID != key.ID {
+		t.Error("Wrong identity:", identity)
+	}
+}
+
+func TestKeyHandler(t *testing.T) {
+	b := newTestKeyBackend()
+	shrt := New(b, WithAuthenticator(APIKeys{Store: b}))
+	admin, _, _ := CreateAPIKey(context.Background(), b, ScopeAdmin)
+
+	for _, body := range []string{`{"scopes":[]}`, `{"scopes":["root"]}`, `{"scopes"`} {
+		if res := authRequest(shrt.KeyHandler(), "POST", admin, "", body); res.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 got %d", body, res.Code)
+		}
+	}
+
+	res := authRequest(shrt.KeyHandler(), "POST", admin, "", `{"scopes":["read-stats"]}`)
+	if res.Code != http.StatusOK {
+		t.Fatal("Expected 200 got:", res.Code)
+	}
+
+	var created KeyResponse
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only admins manage keys
+	if res := authRequest(shrt.KeyHandler(), "POST", created.Token, "", `{"scopes":["admin"]}`); res.Code != http.StatusForbidden {
+		t.Error("Key created without admin scope:", res.Code)
+	}
+
+	if res := authRequest(shrt.InfoHandler(), "GET", created.Token, "abc", ""); res.Code != http.StatusOK {
+		t.Error("Created key not accepted:", res.Code)
+	}
+
+	if res := authRequest(shrt.RevokeKeyHandler(), "DELETE", admin, created.ID, ""); res.Code != http.StatusNoContent {
+		t.Error("Expected 204 got:", res.Code)
+	}
+
+	if res := authRequest(shrt.InfoHandler(), "GET", created.Token, "abc", ""); res.Code != http.StatusUnauthorized {
+		t.Error("Revoked key accepted:", res.Code)
+	}
+
+	if res := authRequest(shrt.RevokeKeyHandler(), "DELETE", admin, created.ID, ""); res.Code != http.StatusNotFound {
+		t.Error("Expected 404 got:", res.Code)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Couldn't recover panic form wrong backend interface")
+		}
+	}()
+
+	New(tb).KeyHandler()
+}
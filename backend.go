@@ -0,0 +1,198 @@
+package shrtie
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// Errors returned by a Backend. The handlers map them to HTTP status codes,
+// every other error is answered with 500 Internal Server Error.
+var (
+	ErrTooLong     = errors.New("URL too long")        // 413 Request Entity Too Large
+	ErrUnavailable = errors.New("Backend unavailable") // 503 Service Unavailable
+	ErrConflict    = errors.New("Key already in use")  // 409 Conflict
+	ErrNotFound    = errors.New("Key not found")       // 404 Not Found
+	ErrExpired     = errors.New("TTL exceeded")        // 410 Gone
+	ErrExhausted   = errors.New("Click limit reached") // 410 Gone
+)
+
+// Link is a short link as it's handed to and returned by a Backend.
+type Link struct {
+	URL       string        // Target URL
+	TTL       time.Duration // Time to life, zero means forever
+	Redirect  int           // Redirect status code, zero means the default of the server
+	MaxClicks int64         // Number of clicks the link works for, zero means unlimited
+	Password  string        // Hash of the password protecting the link, see WithPasswords
+	Preview   bool          // Always show the preview page instead of redirecting, see WithPreview
+}
+
+// Backend stores links. It supersedes GetSaver: every method takes a context
+// and failures are reported with one of the errors above.
+type Backend interface {
+	// Get returns the link stored under key and counts the click.
+	// The TTL of the returned link is the remaining time to life. Links
+	// with MaxClicks return ErrExhausted once all clicks are used, counting
+	// has to be atomic so concurrent clicks never exceed the limit.
+	Get(ctx context.Context, key string) (*Link, error)
+
+	// Save stores the link under a generated key and returns the key.
+	Save(ctx context.Context, link *Link) (string, error)
+}
+
+// InfoerContext is the context aware version of Infoer.
+type InfoerContext interface {
+	InfoContext(ctx context.Context, key string) (*Metadata, error)
+}
+
+// Peeker is implemented by backends which can return a link without
+// counting a click. Like Get, Peek returns ErrExpired and ErrExhausted.
+type Peeker interface {
+	Peek(ctx context.Context, key string) (*Link, error)
+}
+
+// Aliaser is implemented by backends which can save a link under a key
+// chosen by the caller. SaveAlias returns ErrConflict if the key is taken.
+type Aliaser interface {
+	SaveAlias(ctx context.Context, key string, link *Link) error
+}
+
+// BulkSaver is implemented by backends which can save many links at once,
+// e.g. in a transaction. SaveAll returns the key or the error of every
+// link, in the order of links.
+type BulkSaver interface {
+	SaveAll(ctx context.Context, links []*Link) ([]string, []error)
+}
+
+// Deleter is implemented by backends which can remove links.
+type Deleter interface {
+	Delete(ctx context.Context, key string) error
+}
+
+// LinkUpdate holds the changes Updater.Update applies to a link. Zero values
+// and nil keep the current value of a field.
+type LinkUpdate struct {
+	URL       string         // New target
+	TTL       *time.Duration // New time to life from now, zero removes the expiry
+	Redirect  int            // New redirect status code
+	MaxClicks *int64         // New click limit, zero removes it
+	Password  *string        // New password hash, empty removes the protection
+	Preview   *bool          // Always show the preview page
+}
+
+// Updater is implemented by backends which can change the target, the TTL
+// and the redirect status code of an existing link, see LinkUpdate.
+// Click count and created time are preserved.
+type Updater interface {
+	Update(ctx context.Context, key string, update *LinkUpdate) error
+}
+
+// Counter is implemented by backends which can count a click without
+// returning the link, e.g. for redirects served by a Cache. Count doesn't
+// check expiry and click limit, it returns ErrNotFound for missing links.
+type Counter interface {
+	Count(ctx context.Context, key string) error
+}
+
+// ClickCount is a number of clicks of a link, see ClickCounter.
+type ClickCount struct {
+	Namespace string
+	Key       string
+	Clicks    int64
+}
+
+// ClickCounter is implemented by backends which can add click counts in
+// batches, e.g. for BufferedCounter. Like Count, AddClicks doesn't check
+// expiry and click limit. Counts of missing links are skipped.
+type ClickCounter interface {
+	AddClicks(ctx context.Context, counts []ClickCount) error
+}
+
+// Wrapper is implemented by backends wrapping another one, like Cache.
+// Shrtie looks up the optional interfaces on the innermost backend, so
+// wrappers only implement Get, Save and Peek.
+type Wrapper interface {
+	Unwrap() Backend
+}
+
+// Unwrap returns the innermost backend wrapped by backend, backend itself
+// if it isn't a Wrapper.
+func Unwrap(backend Backend) Backend {
+	for {
+		w, ok := backend.(Wrapper)
+		if !ok {
+			return backend
+		}
+		backend = w.Unwrap()
+	}
+}
+
+// Legacy wraps a GetSaver so it can be used as a Backend. An empty key
+// returned by Save is reported as ErrUnavailable, any error of Get as
+// ErrNotFound. An Infoer implemented by the GetSaver is still used.
+func Legacy(backend GetSaver) Backend {
+	return legacy{backend}
+}
+
+type legacy struct {
+	GetSaver
+}
+
+func (l legacy) Get(_ context.Context, key string) (*Link, error) {
+	value, err := l.GetSaver.Get(key)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	return &Link{URL: value}, nil
+}
+
+func (l legacy) Save(_ context.Context, link *Link) (string, error) {
+	key := l.GetSaver.Save(link.URL, link.TTL)
+	if key == "" {
+		return "", ErrUnavailable
+	}
+
+	return key, nil
+}
+
+// infoer is the adapter from Infoer to InfoerContext
+type infoer struct {
+	Infoer
+}
+
+func (i infoer) InfoContext(_ context.Context, key string) (*Metadata, error) {
+	return i.Info(key)
+}
+
+// Seconds converts a remaining time to life to the seconds reported in
+// Metadata. It rounds up, so a link which is about to expire isn't reported
+// with zero seconds which means forever.
+func Seconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// Expires returns the expiration date of an until unix timestamp as used in
+// Metadata, 0 means forever and results in nil.
+func Expires(until int64) *time.Time {
+	if until == 0 {
+		return nil
+	}
+
+	t := time.Unix(until, 0)
+	return &t
+}
+
+// RemainingClicks returns the clicks left of a link as used in Metadata,
+// links without limit result in nil.
+func RemainingClicks(max, count int64) *int64 {
+	if max == 0 {
+		return nil
+	}
+
+	left := max - count
+	if left < 0 {
+		left = 0
+	}
+	return &left
+}
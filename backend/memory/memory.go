@@ -0,0 +1,660 @@
+// Package memory implements a shrtie backend keeping all links in memory.
+// It's meant for tests and small single node deployments, the links can be
+// written to a snapshot file and restored from it on start. Links of a
+// namespace are stored as "namespace/key".
+package memory
+
+import (
+	"encoding/json"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/realfake/shrtie"
+)
+
+const maxLength = 2048
+
+// maxAttempts limits how often Save retries if a generated key is taken
+const maxAttempts = 10
+
+type entry struct {
+	URL      string `json:"url"`
+	Until    int64  `json:"until"` // Unix timestamp, 0 means forever
+	Redirect int    `json:"redirect,omitempty"`
+	Max      int64  `json:"max,omitempty"`      // Click limit, 0 means unlimited
+	Password string `json:"password,omitempty"` // Password hash
+	Preview  bool   `json:"preview,omitempty"`
+	Count    int64  `json:"count"`
+	Created  int64  `json:"created"`
+}
+
+// apiKey is a stored shrtie.APIKey
+type apiKey struct {
+	Hash      string         `json:"hash"`
+	Scopes    []shrtie.Scope `json:"scopes"`
+	Namespace string         `json:"namespace,omitempty"`
+	Created   int64          `json:"created"`
+}
+
+// snapshot is the on disk format of Memory
+type snapshot struct {
+	Counter int64              `json:"counter"`
+	Entries map[string]*entry  `json:"entries"`
+	Keys    map[string]*apiKey `json:"keys,omitempty"`
+}
+
+// Memory is safe for concurrent use.
+type Memory struct {
+	mu      sync.Mutex
+	counter int64
+	entries map[string]*entry // Qualified by namespace, see qualify
+	urls    map[string]string // Index of the latest entry of every qualified URL
+	keys    shrtie.KeyGenerator
+	apiKeys map[string]*apiKey
+}
+
+// Option configures the backend
+type Option func(*Memory)
+
+// WithKeyGenerator sets the generator of the keys handed out by Save.
+// The default is shrtie.Sequential.
+func WithKeyGenerator(g shrtie.KeyGenerator) Option {
+	return func(m *Memory) {
+		m.keys = g
+	}
+}
+
+func New(opts ...Option) *Memory {
+	m := &Memory{
+		entries: make(map[string]*entry),
+		urls:    make(map[string]string),
+		keys:    shrtie.Sequential{},
+		apiKeys: make(map[string]*apiKey),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// Open returns a Memory restored from the snapshot file at path. A missing
+// file results in an empty Memory.
+func Open(path string, opts ...Option) (*Memory, error) {
+	m := New(opts...)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := m.Restore(f); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Memory) Save(ctx context.Context, link *shrtie.Link) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.save(shrtie.NamespaceFromContext(ctx), link)
+}
+
+// save stores the link under a new key in the namespace ns, the caller has
+// to hold the lock
+func (m *Memory) save(ns string, link *shrtie.Link) (string, error) {
+	if len(link.URL) > maxLength {
+		return "", shrtie.ErrTooLong
+	}
+
+	for i := 0; i < maxAttempts; i++ {
+		m.counter++
+
+		key, err := m.keys.Key(m.counter)
+		if err != nil {
+			return "", err
+		}
+
+		// The key might already be taken, try the next one
+		if _, ok := m.entries[qualify(ns, key)]; !ok {
+			m.insert(ns, key, link)
+			return key, nil
+		}
+	}
+
+	return "", shrtie.ErrConflict
+}
+
+// SaveAll saves the links like Save while holding the lock once.
+func (m *Memory) SaveAll(ctx context.Context, links []*shrtie.Link) ([]string, []error) {
+	keys := make([]string, len(links))
+	errs := make([]error, len(links))
+	ns := shrtie.NamespaceFromContext(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, link := range links {
+		keys[i], errs[i] = m.save(ns, link)
+	}
+
+	return keys, errs
+}
+
+func (m *Memory) SaveAlias(ctx context.Context, key string, link *shrtie.Link) error {
+	if len(link.URL) > maxLength {
+		return shrtie.ErrTooLong
+	}
+
+	// Keys with a slash would end up in another namespace
+	ns := shrtie.NamespaceFromContext(ctx)
+	if strings.Contains(key, "/") {
+		return shrtie.ErrConflict
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[qualify(ns, key)]; ok {
+		return shrtie.ErrConflict
+	}
+
+	m.insert(ns, key, link)
+	return nil
+}
+
+// Find returns the latest link saved for url, as long as it's alive.
+func (m *Memory) Find(ctx context.Context, url string) (string, *shrtie.Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path, ok := m.urls[qualify(shrtie.NamespaceFromContext(ctx), url)]
+	if !ok {
+		return "", nil, shrtie.ErrNotFound
+	}
+
+	e := m.entries[path]
+	_, key := split(path)
+	ttl, err := remaining(e.Until)
+	if err != nil {
+		return "", nil, shrtie.ErrNotFound
+	}
+
+	return key, &shrtie.Link{
+		URL:       e.URL,
+		TTL:       ttl,
+		Redirect:  e.Redirect,
+		MaxClicks: e.Max,
+		Password:  e.Password,
+		Preview:   e.Preview,
+	}, nil
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (*shrtie.Link, error) {
+	return m.lookup(ctx, key, true)
+}
+
+// Count counts a click of key without returning the link.
+func (m *Memory) Count(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entry(ctx, key)
+	if !ok {
+		return shrtie.ErrNotFound
+	}
+
+	e.Count++
+	return nil
+}
+
+// AddClicks adds the click counts in one go.
+func (m *Memory) AddClicks(_ context.Context, counts []shrtie.ClickCount) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range counts {
+		if strings.Contains(c.Key, "/") {
+			continue
+		}
+
+		if e, ok := m.entries[qualify(c.Namespace, c.Key)]; ok {
+			e.Count += c.Clicks
+		}
+	}
+
+	return nil
+}
+
+// Peek returns the link like Get without counting the click.
+func (m *Memory) Peek(ctx context.Context, key string) (*shrtie.Link, error) {
+	return m.lookup(ctx, key, false)
+}
+
+// lookup returns the link of key and counts the click if count is set
+func (m *Memory) lookup(ctx context.Context, key string, count bool) (*shrtie.Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entry(ctx, key)
+	if !ok {
+		return nil, shrtie.ErrNotFound
+	}
+
+	ttl, err := remaining(e.Until)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Max != 0 && e.Count >= e.Max {
+		return nil, shrtie.ErrExhausted
+	}
+
+	if count {
+		e.Count++
+	}
+
+	return &shrtie.Link{
+		URL:       e.URL,
+		TTL:       ttl,
+		Redirect:  e.Redirect,
+		MaxClicks: e.Max,
+		Password:  e.Password,
+		Preview:   e.Preview,
+	}, nil
+}
+
+func (m *Memory) Info(key string) (*shrtie.Metadata, error) {
+	return m.InfoContext(context.Background(), key)
+}
+
+func (m *Memory) InfoContext(ctx context.Context, key string) (*shrtie.Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entry(ctx, key)
+	if !ok {
+		return nil, shrtie.ErrNotFound
+	}
+
+	ttl, err := remaining(e.Until)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.metadata(ttl), nil
+}
+
+// Sweep removes up to limit links of all namespaces which expired before
+// before, after they were archived.
+func (m *Memory) Sweep(ctx context.Context, before time.Time, limit int, archive shrtie.ArchiveFunc) (int, error) {
+	m.mu.Lock()
+	expired := make(map[string]*entry)
+	var links []shrtie.ExpiredLink
+	for path, e := range m.entries {
+		if len(links) == limit {
+			break
+		}
+
+		if e.Until == 0 || e.Until >= before.Unix() {
+			continue
+		}
+
+		ns, key := split(path)
+		expired[path] = e
+		links = append(links, shrtie.ExpiredLink{Namespace: ns, Key: key, Metadata: *e.metadata(0)})
+	}
+	m.mu.Unlock()
+
+	if len(links) == 0 {
+		return 0, nil
+	}
+
+	if archive != nil {
+		if err := archive(ctx, links); err != nil {
+			return 0, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Links updated in the meantime are kept
+	var n int
+	for path, e := range expired {
+		if m.entries[path] != e || e.Until == 0 || e.Until >= before.Unix() {
+			continue
+		}
+
+		ns, _ := split(path)
+		m.unindex(path, qualify(ns, e.URL))
+		delete(m.entries, path)
+		n++
+	}
+
+	return n, nil
+}
+
+// List returns a page of the links of the namespace, expired ones included.
+func (m *Memory) List(ctx context.Context, opts shrtie.ListOptions) (*shrtie.ListPage, error) {
+	ns := shrtie.NamespaceFromContext(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var links []shrtie.ListEntry
+	for path, e := range m.entries {
+		entryNS, key := split(path)
+		if entryNS != ns {
+			continue
+		}
+
+		ttl, _ := remaining(e.Until)
+		if meta := e.metadata(ttl); opts.Match(meta, now) {
+			links = append(links, shrtie.ListEntry{Key: key, Metadata: *meta})
+		}
+	}
+
+	return shrtie.Paginate(links, opts)
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	ns := shrtie.NamespaceFromContext(ctx)
+	path := qualify(ns, key)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entry(ctx, key)
+	if !ok {
+		return shrtie.ErrNotFound
+	}
+
+	m.unindex(path, qualify(ns, e.URL))
+	delete(m.entries, path)
+	return nil
+}
+
+func (m *Memory) Update(ctx context.Context, key string, update *shrtie.LinkUpdate) error {
+	if len(update.URL) > maxLength {
+		return shrtie.ErrTooLong
+	}
+
+	ns := shrtie.NamespaceFromContext(ctx)
+	path := qualify(ns, key)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entry(ctx, key)
+	if !ok {
+		return shrtie.ErrNotFound
+	}
+
+	// Click count and created time are left untouched
+	if update.URL != "" {
+		m.unindex(path, qualify(ns, e.URL))
+		m.urls[qualify(ns, update.URL)] = path
+		e.URL = update.URL
+	}
+	if update.Redirect != 0 {
+		e.Redirect = update.Redirect
+	}
+	if update.MaxClicks != nil {
+		e.Max = *update.MaxClicks
+	}
+	if update.Password != nil {
+		e.Password = *update.Password
+	}
+	if update.Preview != nil {
+		e.Preview = *update.Preview
+	}
+	if update.TTL != nil {
+		e.Until = until(time.Now(), *update.TTL)
+	}
+
+	return nil
+}
+
+func (m *Memory) SaveAPIKey(_ context.Context, key *shrtie.APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.apiKeys[key.ID]; ok {
+		return shrtie.ErrConflict
+	}
+
+	m.apiKeys[key.ID] = &apiKey{
+		Hash:      key.Hash,
+		Scopes:    append([]shrtie.Scope(nil), key.Scopes...),
+		Namespace: key.Namespace,
+		Created:   key.Created.Unix(),
+	}
+	return nil
+}
+
+func (m *Memory) APIKey(_ context.Context, id string) (*shrtie.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.apiKeys[id]
+	if !ok {
+		return nil, shrtie.ErrNotFound
+	}
+
+	return &shrtie.APIKey{
+		ID:        id,
+		Hash:      k.Hash,
+		Scopes:    append([]shrtie.Scope(nil), k.Scopes...),
+		Namespace: k.Namespace,
+		Created:   time.Unix(k.Created, 0).UTC(),
+	}, nil
+}
+
+func (m *Memory) RevokeAPIKey(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.apiKeys[id]; !ok {
+		return shrtie.ErrNotFound
+	}
+
+	delete(m.apiKeys, id)
+	return nil
+}
+
+// Snapshot writes all links and API keys as JSON to w.
+func (m *Memory) Snapshot(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return json.NewEncoder(w).Encode(snapshot{
+		Counter: m.counter,
+		Entries: m.entries,
+		Keys:    m.apiKeys,
+	})
+}
+
+// Restore replaces all links and API keys with the ones of a snapshot read
+// from r.
+func (m *Memory) Restore(r io.Reader) error {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+
+	if s.Entries == nil {
+		s.Entries = make(map[string]*entry)
+	}
+	if s.Keys == nil {
+		s.Keys = make(map[string]*apiKey)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counter = s.Counter
+	m.entries = s.Entries
+	m.apiKeys = s.Keys
+	m.urls = make(map[string]string)
+	for path, e := range s.Entries {
+		ns, _ := split(path)
+		m.urls[qualify(ns, e.URL)] = path
+	}
+
+	return nil
+}
+
+// WriteFile writes a snapshot to the file at path. The file is replaced
+// atomically so a crash never leaves a partial snapshot behind.
+func (m *Memory) WriteFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := m.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	// The data has to be on disk before the rename, otherwise a crash can
+	// leave an empty or partial snapshot behind
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the entries of a directory, so a rename in it survives a
+// crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// insert adds a new entry to the namespace ns, the caller has to hold the
+// lock
+func (m *Memory) insert(ns, key string, link *shrtie.Link) {
+	now := time.Now()
+	path := qualify(ns, key)
+	m.entries[path] = &entry{
+		URL:      link.URL,
+		Until:    until(now, link.TTL),
+		Redirect: link.Redirect,
+		Max:      link.MaxClicks,
+		Password: link.Password,
+		Preview:  link.Preview,
+		Created:  now.Unix(),
+	}
+	m.urls[qualify(ns, link.URL)] = path
+}
+
+// unindex removes the entry at path from the index of the qualified url, if
+// it's still the latest link to url. The caller has to hold the lock.
+func (m *Memory) unindex(path, url string) {
+	if m.urls[url] == path {
+		delete(m.urls, url)
+	}
+}
+
+// entry returns the entry of key in the namespace of ctx, the caller has to
+// hold the lock. Keys with a slash would reach into other namespaces, they
+// are never found.
+func (m *Memory) entry(ctx context.Context, key string) (*entry, bool) {
+	if strings.Contains(key, "/") {
+		return nil, false
+	}
+
+	e, ok := m.entries[qualify(shrtie.NamespaceFromContext(ctx), key)]
+	return e, ok
+}
+
+// qualify returns the map key of a key or URL in the namespace ns, the
+// default namespace is stored unqualified
+func qualify(ns, s string) string {
+	if ns == "" {
+		return s
+	}
+
+	return ns + "/" + s
+}
+
+// split returns the namespace and key of an entry, keys never contain a
+// slash
+func split(path string) (string, string) {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+
+	return "", path
+}
+
+// metadata returns the metadata of the entry with the remaining ttl
+func (e *entry) metadata(ttl time.Duration) *shrtie.Metadata {
+	return &shrtie.Metadata{
+		URL:       e.URL,
+		TTL:       shrtie.Seconds(ttl),
+		Expires:   shrtie.Expires(e.Until),
+		Redirect:  e.Redirect,
+		Clicked:   e.Count,
+		Created:   time.Unix(e.Created, 0),
+		MaxClicks: e.Max,
+		Remaining: shrtie.RemainingClicks(e.Max, e.Count),
+		Password:  e.Password,
+		Preview:   e.Preview,
+	}
+}
+
+// until returns the unix timestamp the ttl ends, 0 means forever
+func until(now time.Time, ttl time.Duration) int64 {
+	if ttl == 0 {
+		return 0
+	}
+
+	return now.Add(ttl).Unix()
+}
+
+// remaining returns the remaining time to life of the until timestamp
+func remaining(until int64) (time.Duration, error) {
+	if until == 0 {
+		return 0, nil
+	}
+
+	ttl := time.Unix(until, 0).Sub(time.Now())
+	if ttl <= 0 {
+		return 0, shrtie.ErrExpired
+	}
+
+	return ttl, nil
+}
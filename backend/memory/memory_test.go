@@ -0,0 +1,139 @@
+package memory
+
+import (
+	"bytes"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/realfake/shrtie"
+	"github.com/realfake/shrtie/shrtietest"
+)
+
+func TestConformance(t *testing.T) {
+	shrtietest.RunBackendTests(t, func(t *testing.T) shrtie.Backend {
+		return New()
+	})
+}
+
+func TestConformanceKeyGenerators(t *testing.T) {
+	generators := map[string]shrtie.KeyGenerator{
+		"Random":     shrtie.Random{Length: 4},
+		"Obfuscated": shrtie.NewObfuscated([]byte("secret")),
+	}
+
+	for name, g := range generators {
+		g := g
+		t.Run(name, func(t *testing.T) {
+			shrtietest.RunBackendTests(t, func(t *testing.T) shrtie.Backend {
+				return New(WithKeyGenerator(g))
+			})
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	m := New()
+	ctx := context.Background()
+
+	key, err := m.Save(ctx, &shrtie.Link{URL: "https://here.com", TTL: time.Hour})
+	if err != nil {
+		t.Fatal("Failed in expiry test:", err)
+	}
+
+	if _, err = m.Get(ctx, key); err != nil {
+		t.Error("Failed in expiry test:", err)
+	}
+
+	// Move the entry into the past instead of sleeping
+	m.entries[key].Until = time.Now().Add(-time.Second).Unix()
+
+	if _, err = m.Get(ctx, key); err != shrtie.ErrExpired {
+		t.Error("Expected ErrExpired got:", err)
+	}
+}
+
+func TestClickCount(t *testing.T) {
+	m := New()
+	ctx := context.Background()
+
+	key, _ := m.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+	for i := 0; i < 3; i++ {
+		m.Get(ctx, key)
+	}
+
+	meta, err := m.InfoContext(ctx, key)
+	if err != nil {
+		t.Fatal("Failed in click count test:", err)
+	}
+
+	if meta.Clicked != 3 {
+		t.Error("Wrong click count:", meta.Clicked)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m := New()
+	ctx := context.Background()
+
+	key, _ := m.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+	m.SaveAlias(ctx, "q3", &shrtie.Link{URL: "https://there.com"})
+	_, apiKey, _ := shrtie.CreateAPIKey(ctx, m, shrtie.ScopeCreate)
+
+	var buf bytes.Buffer
+	if err := m.Snapshot(&buf); err != nil {
+		t.Fatal("Failed in snapshot test:", err)
+	}
+
+	restored := New()
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatal("Failed in snapshot test:", err)
+	}
+
+	for k, url := range map[string]string{key: "https://here.com", "q3": "https://there.com"} {
+		if link, err := restored.Get(ctx, k); err != nil || link.URL != url {
+			t.Errorf("Wrong link for %s after restore: %v %v", k, link, err)
+		}
+	}
+
+	if k, err := restored.APIKey(ctx, apiKey.ID); err != nil || k.Hash != apiKey.Hash {
+		t.Errorf("Wrong API key after restore: %v %v", k, err)
+	}
+
+	// The counter must be restored so keys aren't handed out twice
+	if next, _ := restored.Save(ctx, &shrtie.Link{URL: "https://here.com"}); next == key {
+		t.Error("Key handed out twice after restore:", next)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shrtie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.json")
+
+	// Missing snapshots result in an empty backend
+	m, err := Open(path)
+	if err != nil {
+		t.Fatal("Failed in open test:", err)
+	}
+
+	key, _ := m.Save(context.Background(), &shrtie.Link{URL: "https://here.com"})
+	if err = m.WriteFile(path); err != nil {
+		t.Fatal("Failed in open test:", err)
+	}
+
+	if m, err = Open(path); err != nil {
+		t.Fatal("Failed in open test:", err)
+	}
+
+	if link, err := m.Get(context.Background(), key); err != nil || link.URL != "https://here.com" {
+		t.Errorf("Wrong link after open: %v %v", link, err)
+	}
+}
@@ -1,11 +1,12 @@
 package redis
 
 import (
-	"encoding/base64"
-	"encoding/binary"
 	"errors"
+	"golang.org/x/net/context"
+	"log"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/realfake/shrtie"
@@ -13,110 +14,988 @@ import (
 )
 
 const (
-	metaUntil   string = "until"
-	metaCount          = "count"
-	metaCreated        = "created"
-	metaURL            = "url"
+	metaUntil    string = "until"
+	metaCount           = "count"
+	metaCreated         = "created"
+	metaURL             = "url"
+	metaRedirect        = "redirect"
+	metaMax             = "max"
+	metaPassword        = "password"
+	metaPreview         = "preview"
 )
 
+// getScript counts the click of a link atomically, so the click limit is
+// never exceeded. It returns nil for missing links, {1} for expired ones,
+// {2} for exhausted ones and {0, url, until, redirect, max, password,
+// preview} otherwise. Expired links saved without key expiry by older
+// versions get one, ARGV[2] is the grace period in seconds. Clicks are
+// added to the key ARGV[3] in the index KEYS[2] as well.
+const getScript = `
+local v = redis.call('HMGET', KEYS[1], 'url', 'until', 'redirect', 'max', 'count', 'password', 'preview')
+if not v[1] then
+	return false
+end
+
+local untl = tonumber(v[2]) or 0
+if untl ~= 0 and untl <= tonumber(ARGV[1]) then
+	if redis.call('TTL', KEYS[1]) == -1 then
+		redis.call('EXPIREAT', KEYS[1], untl + tonumber(ARGV[2]))
+	end
+	return {1}
+end
+
+local max = tonumber(v[4]) or 0
+if max ~= 0 and (tonumber(v[5]) or 0) >= max then
+	return {2}
+end
+
+redis.call('HINCRBY', KEYS[1], 'count', 1)
+redis.call('ZINCRBY', KEYS[2], -1, ARGV[3])
+return {0, v[1], tostring(untl), v[3] or '0', tostring(max), v[6] or '', v[7] or ''}
+`
+
+// storeScript saves a new link at KEYS[1] and points the index KEYS[2] of
+// its URL to the key ARGV[1], so links are never written partially. ARGV[2]
+// is the time the keys expire (0 for never). Expiring links are added to
+// the set KEYS[3] as ARGV[3] with their until ARGV[4], a few members whose
+// keys expired before ARGV[5] are dropped from it. The key is added to the
+// indexes KEYS[4] by created ARGV[6] and KEYS[5] by clicks. The remaining
+// arguments are the fields and values of the link. It returns 0 if the key
+// is taken and 1 otherwise.
+const storeScript = `
+if redis.call('HEXISTS', KEYS[1], 'url') == 1 then
+	return 0
+end
+
+redis.call('HMSET', KEYS[1], unpack(ARGV, 7))
+redis.call('SET', KEYS[2], ARGV[1])
+redis.call('ZADD', KEYS[4], -tonumber(ARGV[6]), ARGV[1])
+redis.call('ZADD', KEYS[5], 0, ARGV[1])
+
+local expires = tonumber(ARGV[2])
+if expires ~= 0 then
+	redis.call('EXPIREAT', KEYS[1], expires)
+	redis.call('EXPIREAT', KEYS[2], expires)
+	redis.call('ZADD', KEYS[3], ARGV[4], ARGV[3])
+end
+
+local gone = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', '(' .. ARGV[5], 'LIMIT', 0, 100)
+if #gone ~= 0 then
+	redis.call('ZREM', KEYS[3], unpack(gone))
+end
+return 1
+`
+
+// updateScript changes the fields of the existing link KEYS[1], so links
+// removed meanwhile aren't recreated. ARGV[1] is the time the link and its
+// counters KEYS[3..n] expire, empty keeps and 0 removes the expiry. The
+// link is ARGV[2] in the set of expiring links KEYS[2], ARGV[3] is its new
+// until. The remaining arguments are the changed fields and their values.
+// It returns nil for missing links and {old url, remaining milliseconds}
+// otherwise.
+const updateScript = `
+local old = redis.call('HGET', KEYS[1], 'url')
+if not old then
+	return false
+end
+
+if #ARGV > 3 then
+	redis.call('HMSET', KEYS[1], unpack(ARGV, 4))
+end
+
+if ARGV[1] == '0' then
+	redis.call('ZREM', KEYS[2], ARGV[2])
+elseif ARGV[1] ~= '' then
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+end
+
+if ARGV[1] ~= '' then
+	for i = 1, #KEYS do
+		if i ~= 2 and ARGV[1] == '0' then
+			redis.call('PERSIST', KEYS[i])
+		elseif i ~= 2 then
+			redis.call('EXPIREAT', KEYS[i], ARGV[1])
+		end
+	end
+end
+
+return {old, redis.call('PTTL', KEYS[1])}
+`
+
+// sweepScript removes the link KEYS[1] if it expired before ARGV[2], along
+// with its member ARGV[1] in the set of expiring links KEYS[2], the index
+// of its URL KEYS[3] if it still points to the key ARGV[3] and the key in
+// the indexes KEYS[4] and KEYS[5] of List. Links updated meanwhile are
+// kept, missing ones are dropped from the sets. It returns 1 if the link
+// was removed and 0 otherwise.
+const sweepScript = `
+local v = redis.call('HGET', KEYS[1], 'until')
+local untl = tonumber(v) or 0
+if untl ~= 0 and untl >= tonumber(ARGV[2]) then
+	return 0
+end
+
+redis.call('ZREM', KEYS[2], ARGV[1])
+if v and untl == 0 then
+	return 0
+end
+
+redis.call('ZREM', KEYS[4], ARGV[3])
+redis.call('ZREM', KEYS[5], ARGV[3])
+if not v then
+	return 0
+end
+
+redis.call('DEL', KEYS[1])
+if redis.call('GET', KEYS[3]) == ARGV[3] then
+	redis.call('DEL', KEYS[3])
+end
+return 1
+`
+
+// countScript adds ARGV[1] clicks to a link and to its key ARGV[2] in the
+// index KEYS[2], missing links aren't created. It returns 1 if the link
+// exists and 0 otherwise.
+const countScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+
+redis.call('HINCRBY', KEYS[1], 'count', ARGV[1])
+redis.call('ZINCRBY', KEYS[2], -tonumber(ARGV[1]), ARGV[2])
+return 1
+`
+
+// statsScript adds a click to the counters KEYS[2..n] of the link KEYS[1],
+// ARGV[i] is the field of KEYS[i+1]. The counters expire with the link. It
+// returns 1, the client reports scripts without a reply as redis.Nil.
+const statsScript = `
+local ttl = redis.call('PTTL', KEYS[1])
+for i = 2, #KEYS do
+	redis.call('HINCRBY', KEYS[i], ARGV[i - 1], 1)
+	if ttl > 0 then
+		redis.call('PEXPIRE', KEYS[i], ttl)
+	end
+end
+return 1
+`
+
+// limitScript takes a token of a rate limit bucket, see Take. The key holds
+// the time in milliseconds the bucket is full again and expires then. It
+// returns {1, wait} if a token was taken and {0, wait} otherwise, wait are
+// the milliseconds until the bucket is full.
+const limitScript = `
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local full = math.max(tonumber(redis.call('GET', KEYS[1])) or now, now)
+
+if full - now > (tonumber(ARGV[3]) - 1) * interval then
+	return {0, full - now}
+end
+
+full = full + interval
+redis.call('SET', KEYS[1], full, 'PX', full - now)
+return {1, full - now}
+`
+
+// metaLimits prefixes the rate limit buckets, see Take
+const metaLimits = "meta:limits:"
+
+// metaURLs prefixes the keys mapping target URLs to keys, see Find. They
+// expire with the link.
+const metaURLs = "meta:urls:"
+
+// legacyURLs is the hash older versions mapped target URLs to keys with
+const legacyURLs = "meta:urls"
+
+// metaVersion holds the version of the data layout, see migrate
+const metaVersion = "meta:version"
+
+// layoutVersion is the version of the data layout written by the backend
+const layoutVersion = 3
+
+// metaClicks is the stream of clicks, see WriteClicks
+const metaClicks = "meta:clicks"
+
+// metaStats prefixes the click counters of a key, see Stats
+const metaStats = "meta:stats:"
+
+// metaKeys prefixes the hashes of API keys, see SaveAPIKey
+const metaKeys = "meta:keys:"
+
+// metaExpiring is the sorted set of the links with a TTL in all namespaces
+// by their until, see Sweep. Members are named like member.
+const metaExpiring = "meta:expiring"
+
+// metaByCreated and metaByClicks are the sorted sets of the keys in a
+// namespace List pages through. Their scores are the negated created time
+// and clicks, so ZRANGE returns the newest and most clicked links first and
+// ties ordered by key.
+const (
+	metaByCreated = "meta:by-created"
+	metaByClicks  = "meta:by-clicks"
+)
+
+// ErrNoSweepMargin is returned by Sweep if links should be archived, but
+// expire without a margin, see WithSweepMargin
+var ErrNoSweepMargin = errors.New("Expired links can't be archived without a sweep margin")
+
+// statsIntervals are the intervals counted by WriteClicks
+var statsIntervals = []shrtie.Interval{shrtie.Hourly, shrtie.Daily, shrtie.Weekly}
+
+// defaultStreamLength is the approximate number of clicks kept in the stream
+const defaultStreamLength = 1000000
+
 const maxLength = 2048
 
+// maxAttempts limits how often Save retries if a generated key is taken
+const maxAttempts = 10
+
+// Kept for compatibility, the backend returns the shrtie errors
 var (
-	ErrWrongKey error = errors.New("Wrong key")
-	ErrTTL            = errors.New("TTL exceeded")
+	ErrWrongKey = shrtie.ErrNotFound
+	ErrTTL      = shrtie.ErrExpired
+	ErrTooLong  = shrtie.ErrTooLong
 )
 
 type Redis struct {
 	conn   *redis.Client
-	prefix string
+	root   string // Prefix of all keys, see WithPrefix
+	prefix string // Prefix of the keys in the namespace, see in
+	keys   shrtie.KeyGenerator
+	grace  time.Duration // Expired links are kept for it, see WithGracePeriod
+	margin time.Duration // Keys are kept longer for sweeps, see WithSweepMargin
+
+	streamLength int64
+}
+
+// Option configures the backend
+type Option func(*Redis)
+
+// WithKeyGenerator sets the generator of the keys handed out by Save.
+// The default is shrtie.Sequential.
+func WithKeyGenerator(g shrtie.KeyGenerator) Option {
+	return func(r *Redis) {
+		r.keys = g
+	}
+}
+
+// WithStreamLength sets the approximate number of clicks kept in the stream
+// written by WriteClicks, older ones are trimmed. Defaults to a million.
+func WithStreamLength(n int64) Option {
+	return func(r *Redis) {
+		r.streamLength = n
+	}
+}
+
+// WithPrefix sets the prefix of all keys of the backend, so several
+// instances can share a database. Defaults to "shrtie/".
+func WithPrefix(prefix string) Option {
+	return func(r *Redis) {
+		r.root = prefix
+	}
+}
+
+// WithGracePeriod keeps expired links for d, so they are answered with 410
+// Gone instead of 404 Not Found for a while. Links expire natively with
+// EXPIREAT at the end of it.
+func WithGracePeriod(d time.Duration) Option {
+	return func(r *Redis) {
+		r.grace = d
+	}
+}
+
+// WithSweepMargin keeps the keys of expired links d past the grace period,
+// so a shrtie.ExpirySweeper can archive them before redis removes them.
+// Sweeps have to remove them in time, the grace period of the sweeper plus
+// its interval has to stay below the grace period plus d.
+func WithSweepMargin(d time.Duration) Option {
+	return func(r *Redis) {
+		r.margin = d
+	}
 }
 
 var escape = regexp.MustCompile(`[^0-9A-Za-z_-]`)
 
-func New(options *redis.Options) (shrtie.GetSaver, error) {
+func New(options *redis.Options, opts ...Option) (shrtie.Backend, error) {
 	client := redis.NewClient(options)
 
 	// Test connection
 	if _, err := client.Ping().Result(); err != nil {
 		return nil, err
 	}
-	return Redis{
-		conn:   client,
-		prefix: "shrtie/",
-	}, nil
+
+	r := Redis{
+		conn: client,
+		root: "shrtie/",
+		keys: shrtie.Sequential{},
+
+		streamLength: defaultStreamLength,
+	}
+
+	for _, opt := range opts {
+		opt(&r)
+	}
+	r.prefix = r.root
+
+	if err := r.migrate(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
 }
 
-func (r Redis) Save(value string, ttl time.Duration) string {
-	if len(value) > maxLength {
-		return ""
+// migrate upgrades the data of older versions once, the version of the
+// layout is kept in "meta:version". Links saved without key expiry get one
+// or are removed if they expired before the grace period, the hash
+// "meta:urls" is split into keys expiring with their link and click
+// counters get the expiry of their link. Links are added to the sets of
+// expiring links and to the indexes of List. Links are upgraded in a first
+// SCAN of all keys, the meta keys depending on them in a second one.
+func (r Redis) migrate() error {
+	version, err := r.conn.Get(r.root + metaVersion).Int64()
+	if err != nil && err != redis.Nil {
+		return unavailable(err)
+	}
+
+	if version >= layoutVersion {
+		return nil
+	}
+
+	for _, upgrade := range []func(prefix, name string) error{r.migrateLink, r.migrateMeta} {
+		for cursor := uint64(0); ; {
+			paths, next, err := r.conn.Scan(cursor, r.root+"*", scanCount).Result()
+			if err != nil {
+				return unavailable(err)
+			}
+
+			for _, path := range paths {
+				// Keys of namespaces are prefixed with "<namespace>/"
+				prefix, name := r.root, strings.TrimPrefix(path, r.root)
+				if i := strings.Index(name, "/"); i >= 0 {
+					prefix, name = prefix+name[:i+1], name[i+1:]
+				}
+
+				if err = upgrade(prefix, name); err != nil {
+					return err
+				}
+			}
+
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
 	}
-	// Get atomic identifier from the counter
-	index, err := r.conn.Incr(r.prefix + "meta:count").Result()
+
+	return unavailable(r.conn.Set(r.root+metaVersion, layoutVersion, 0).Err())
+}
+
+// migrateLink sets the key expiry of a link saved by older versions, adds
+// it to the set of expiring links and to the indexes of List
+func (r Redis) migrateLink(prefix, name string) error {
+	// Meta keys contain colons
+	if name == "" || escape.MatchString(name) {
+		return nil
+	}
+
+	path := prefix + name
+	fields, err := r.conn.HMGet(path, metaUntil, metaCreated, metaCount).Result()
 	if err != nil {
-		return ""
+		return unavailable(err)
+	}
+	if len(fields) != 3 || fields[0] == nil {
+		return nil
+	}
+
+	untl, _ := strconv.ParseInt(str(fields[0]), 10, 64)
+	if untl != 0 {
+		if removed, err := r.migrateExpiry(path, untl); err != nil || removed {
+			return err
+		}
+	}
+
+	created, _ := strconv.ParseInt(str(fields[1]), 10, 64)
+	count, _ := strconv.ParseInt(str(fields[2]), 10, 64)
+	_, err = r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.ZAdd(prefix+metaByCreated, redis.Z{Score: float64(-created), Member: name})
+		pipe.ZAdd(prefix+metaByClicks, redis.Z{Score: float64(-count), Member: name})
+		return nil
+	})
+
+	return unavailable(err)
+}
+
+// migrateExpiry gives the expiring link at path a key expiry if it has none
+// and adds it to the set of expiring links. Links which expired before the
+// grace period are removed, it reports whether the link was removed.
+func (r Redis) migrateExpiry(path string, untl int64) (bool, error) {
+	ttl, err := r.conn.PTTL(path).Result()
+	if err != nil {
+		return false, unavailable(err)
+	}
+
+	// Links without key expiry get one
+	if ttl == -time.Millisecond {
+		expires := time.Unix(untl, 0).Add(r.grace + r.margin)
+		if !expires.After(time.Now()) {
+			return true, unavailable(r.conn.Del(path).Err())
+		}
+
+		if err = r.conn.ExpireAt(path, expires).Err(); err != nil {
+			return false, unavailable(err)
+		}
+	}
+
+	return false, unavailable(r.conn.ZAdd(r.root+metaExpiring, redis.Z{Score: float64(untl), Member: strings.TrimPrefix(path, r.root)}).Err())
+}
+
+// migrateMeta moves the legacy URL index to keys and sets the expiry of
+// click counters, both follow the link they belong to
+func (r Redis) migrateMeta(prefix, name string) error {
+	switch {
+	case name == legacyURLs:
+		for cursor := uint64(0); ; {
+			fields, next, err := r.conn.HScan(prefix+name, cursor, "", scanCount).Result()
+			if err != nil {
+				return unavailable(err)
+			}
+
+			// Fields and values alternate
+			for i := 0; i+1 < len(fields); i += 2 {
+				if err = r.migrateIndex(prefix, fields[i], fields[i+1]); err != nil {
+					return err
+				}
+			}
+
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+
+		return unavailable(r.conn.Del(prefix + name).Err())
+	case strings.HasPrefix(name, metaStats):
+		key := strings.TrimPrefix(name, metaStats)
+		if i := strings.Index(key, ":"); i >= 0 {
+			key = key[:i]
+		}
+
+		ttl, err := r.conn.PTTL(prefix + key).Result()
+		switch {
+		case err != nil:
+			return unavailable(err)
+		case ttl == -2*time.Millisecond:
+			// The link is gone
+			return unavailable(r.conn.Del(prefix + name).Err())
+		case ttl > 0:
+			return unavailable(r.conn.PExpire(prefix+name, ttl).Err())
+		}
+	}
+
+	return nil
+}
+
+// migrateIndex moves an entry of the legacy URL index to its key, unless
+// the link is gone or points elsewhere since
+func (r Redis) migrateIndex(prefix, url, key string) error {
+	target, err := r.conn.HGet(prefix+key, metaURL).Result()
+	if err == redis.Nil || err == nil && target != url {
+		return nil
+	}
+	if err != nil {
+		return unavailable(err)
+	}
+
+	ttl, err := r.conn.PTTL(prefix + key).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	// Links saved meanwhile have set the index already
+	return unavailable(r.conn.SetNX(prefix+metaURLs+url, key, ttl).Err())
+}
+
+func (r Redis) Save(ctx context.Context, link *shrtie.Link) (string, error) {
+	r = r.in(ctx)
+
+	if len(link.URL) > maxLength {
+		return "", ErrTooLong
+	}
+
+	for i := 0; i < maxAttempts; i++ {
+		// Get atomic identifier from the counter
+		index, err := r.conn.Incr(r.prefix + "meta:count").Result()
+		if err != nil {
+			return "", unavailable(err)
+		}
+
+		key, err := r.keys.Key(index)
+		if err != nil {
+			return "", err
+		}
+
+		// The key might already be taken, try the next one
+		switch err := r.store(key, link); err {
+		case nil:
+			return key, nil
+		case shrtie.ErrConflict:
+			continue
+		default:
+			return "", err
+		}
 	}
 
-	// Make int64 to byte array and cut it to min lenght
-	buf := make([]byte, 8)
-	size := binary.PutVarint(buf, index)
+	return "", shrtie.ErrConflict
+}
+
+// SaveAll saves the links like Save with a single counter increment and one
+// pipeline running storeScript for every link.
+func (r Redis) SaveAll(ctx context.Context, links []*shrtie.Link) ([]string, []error) {
+	r = r.in(ctx)
+
+	keys := make([]string, len(links))
+	errs := make([]error, len(links))
 
-	// Convert to base64, wich is URL save and without padding ('='*)
-	key := base64.RawStdEncoding.EncodeToString(buf[:size])
+	// Reserve a range of the counter for all links
+	last, err := r.conn.IncrBy(r.prefix+"meta:count", int64(len(links))).Result()
+	if err != nil {
+		for i := range links {
+			errs[i] = unavailable(err)
+		}
+		return keys, errs
+	}
+	first := last - int64(len(links)) + 1
 
-	// Take timestamp
+	// Errors are checked per command
 	now := time.Now()
+	stores := make([]*redis.Cmd, len(links))
+	r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, link := range links {
+			if len(link.URL) > maxLength {
+				errs[i] = ErrTooLong
+				continue
+			}
 
-	var until string
-	if ttl == 0 {
-		until = "0"
-	} else {
-		until = strconv.FormatInt(now.Add(ttl).Unix(), 10)
+			if keys[i], errs[i] = r.keys.Key(first + int64(i)); errs[i] != nil {
+				continue
+			}
+
+			stores[i] = r.storeCmd(pipe, keys[i], link, now)
+		}
+		return nil
+	})
+
+	for i, store := range stores {
+		if store != nil {
+			switch n, _ := store.Val().(int64); {
+			case store.Err() != nil:
+				errs[i] = unavailable(store.Err())
+			case n == 0:
+				// The key is taken, retry like Save
+				keys[i], errs[i] = r.Save(ctx, links[i])
+				continue
+			}
+		}
+
+		if errs[i] != nil {
+			keys[i] = ""
+		}
+	}
+
+	return keys, errs
+}
+
+func (r Redis) SaveAlias(ctx context.Context, key string, link *shrtie.Link) error {
+	r = r.in(ctx)
+
+	if len(link.URL) > maxLength {
+		return ErrTooLong
+	}
+
+	// Keys with a slash would end up in another namespace
+	if escape.MatchString(key) {
+		return shrtie.ErrConflict
+	}
+
+	return r.store(key, link)
+}
+
+// store saves the link at key, unless the key was used before. The link
+// and the index of its URL are written at once by storeScript.
+func (r Redis) store(key string, link *shrtie.Link) error {
+	res, err := r.storeCmd(r.conn, key, link, time.Now()).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+
+	if n, _ := res.(int64); n == 0 {
+		return shrtie.ErrConflict
+	}
+
+	return nil
+}
+
+// storeCmd runs storeScript for the link with c, a client or pipeline
+func (r Redis) storeCmd(c scripter, key string, link *shrtie.Link, now time.Time) *redis.Cmd {
+	var expires int64
+	if link.TTL != 0 {
+		expires = r.expireAt(now, link.TTL).Unix()
 	}
 
-	err = r.conn.HMSet(r.prefix+key, map[string]string{
-		metaURL:     value,
-		metaCreated: strconv.FormatInt(now.Unix(), 10),
-		metaUntil:   until,
-	}).Err()
+	// Members whose keys expired by now are left over by links nobody swept
+	gone := now.Add(-r.grace - r.margin).Unix()
+	keys := []string{r.prefix + key, r.prefix + metaURLs + link.URL, r.root + metaExpiring, r.prefix + metaByCreated, r.prefix + metaByClicks}
+	return c.Eval(storeScript, keys, key, expires, r.member(key), until(now, link.TTL), gone, now.Unix(),
+		metaURL, link.URL,
+		metaCreated, now.Unix(),
+		metaUntil, until(now, link.TTL),
+		metaRedirect, link.Redirect,
+		metaMax, link.MaxClicks,
+		metaPassword, link.Password,
+		metaPreview, strconv.FormatBool(link.Preview),
+	)
+}
+
+// scripter runs scripts, it's implemented by clients and pipelines
+type scripter interface {
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+}
+
+// in returns the backend working in the namespace of ctx, links of a
+// namespace are stored under "<prefix><namespace>/<key>"
+func (r Redis) in(ctx context.Context) Redis {
+	r.prefix = r.namespace(shrtie.NamespaceFromContext(ctx))
+	return r
+}
+
+// namespace returns the prefix of the keys in the namespace ns
+func (r Redis) namespace(ns string) string {
+	if ns == "" {
+		return r.root
+	}
+
+	return r.root + ns + "/"
+}
+
+// expireAt returns the time the key of a link with ttl is removed, at the
+// end of the grace period and the sweep margin
+func (r Redis) expireAt(now time.Time, ttl time.Duration) time.Time {
+	return time.Unix(now.Add(ttl).Unix(), 0).Add(r.grace + r.margin)
+}
+
+// member returns the name of the link of key in the sets of all namespaces,
+// "<namespace>/<key>" or the key in the default namespace
+func (r Redis) member(key string) string {
+	return strings.TrimPrefix(r.prefix+key, r.root)
+}
+
+// Find returns the latest link saved for url, as long as it's alive.
+func (r Redis) Find(ctx context.Context, url string) (string, *shrtie.Link, error) {
+	r = r.in(ctx)
 
+	key, err := r.conn.Get(r.prefix + metaURLs + url).Result()
 	if err != nil {
-		return ""
+		return "", nil, unavailable(err)
 	}
 
-	return key
+	fields, err := r.conn.HMGet(r.prefix+key, metaURL, metaUntil, metaRedirect, metaMax, metaPassword, metaPreview).Result()
+	if err != nil {
+		return "", nil, unavailable(err)
+	}
+
+	// The link might have been changed since
+	if target, _ := fields[0].(string); target != url {
+		return "", nil, ErrWrongKey
+	}
+
+	ttlTo, _ := strconv.ParseInt(str(fields[1]), 10, 64)
+	ttl, err := remaining(ttlTo)
+	if err != nil {
+		return "", nil, ErrWrongKey
+	}
+
+	redirect, _ := strconv.Atoi(str(fields[2]))
+	max, _ := strconv.ParseInt(str(fields[3]), 10, 64)
+	preview, _ := strconv.ParseBool(str(fields[5]))
+
+	return key, &shrtie.Link{
+		URL:       url,
+		TTL:       ttl,
+		Redirect:  redirect,
+		MaxClicks: max,
+		Password:  str(fields[4]),
+		Preview:   preview,
+	}, nil
 }
 
-func (r Redis) Get(key string) (string, error) {
+// WriteClicks appends clicks of all namespaces to the stream "meta:clicks",
+// it requires redis 5 or later.
+func (r Redis) WriteClicks(_ context.Context, clicks []shrtie.Click) error {
+	_, err := r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, c := range clicks {
+			// The client has no stream commands, so XADD is sent as is
+			pipe.Process(redis.NewStringCmd(
+				"XADD", r.root+metaClicks, "MAXLEN", "~", r.streamLength, "*",
+				"namespace", c.Namespace,
+				"key", c.Key,
+				"time", c.Time.Unix(),
+				"referrer", c.Referrer,
+				"user_agent", c.UserAgent,
+				"language", c.Language,
+				"ip", c.IP,
+			))
+
+			// Counters for Stats, breakdowns are counted per day
+			prefix := r.namespace(c.Namespace)
+			stats := prefix + metaStats + c.Key
+			keys := []string{prefix + c.Key}
+			var fields []interface{}
+			for _, interval := range statsIntervals {
+				keys = append(keys, stats+":"+string(interval))
+				fields = append(fields, bucket(interval, c.Time))
+			}
+
+			day := ":" + bucket(shrtie.Daily, c.Time)
+			keys = append(keys, stats+":referrer"+day, stats+":browser"+day, stats+":country"+day)
+			fields = append(fields, shrtie.ReferrerHost(c.Referrer), shrtie.BrowserFamily(c.UserAgent), shrtie.Country(c.Language))
+			pipe.Eval(statsScript, keys, fields...)
+		}
+		return nil
+	})
+
+	return unavailable(err)
+}
+
+// Stats returns the counters written by WriteClicks. Breakdowns are
+// counted per day, so they cover the whole days of the range.
+func (r Redis) Stats(ctx context.Context, key string, interval shrtie.Interval, from, to time.Time) (*shrtie.Stats, error) {
+	r = r.in(ctx)
+
+	stats, err := shrtie.NewStats(key, interval, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	path := r.prefix + metaStats + key
+	fields := make([]string, len(stats.Buckets))
+	for i, b := range stats.Buckets {
+		fields[i] = bucket(interval, b.Time)
+	}
+
+	counts, err := r.conn.HMGet(path+":"+string(interval), fields...).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	for i, count := range counts {
+		stats.Buckets[i].Clicks, _ = strconv.ParseInt(str(count), 10, 64)
+	}
+
+	breakdowns := map[string]map[string]int64{
+		"referrer": stats.Referrers,
+		"browser":  stats.Browsers,
+		"country":  stats.Countries,
+	}
+
+	// Fetch the breakdowns of all days at once
+	cmds := make(map[*redis.StringStringMapCmd]map[string]int64)
+	_, err = r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+		for day := shrtie.Daily.Truncate(stats.From); day.Before(stats.To); day = day.Add(24 * time.Hour) {
+			for name, breakdown := range breakdowns {
+				cmds[pipe.HGetAll(path+":"+name+":"+bucket(shrtie.Daily, day))] = breakdown
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	for cmd, breakdown := range cmds {
+		for value, count := range cmd.Val() {
+			n, _ := strconv.ParseInt(count, 10, 64)
+			breakdown[value] += n
+		}
+	}
+
+	return stats, nil
+}
+
+// unindex removes the key from the index of url, if it's still the latest
+// link to url.
+func (r Redis) unindex(key, url string) error {
+	latest, err := r.conn.Get(r.prefix + metaURLs + url).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return unavailable(err)
+	}
+
+	if latest != key {
+		return nil
+	}
+
+	return unavailable(r.conn.Del(r.prefix + metaURLs + url).Err())
+}
+
+// statsKeys returns the click counters of key, see WriteClicks
+func (r Redis) statsKeys(key string) ([]string, error) {
+	var keys []string
+	for cursor := uint64(0); ; {
+		paths, next, err := r.conn.Scan(cursor, r.prefix+metaStats+key+":*", scanCount).Result()
+		if err != nil {
+			return nil, unavailable(err)
+		}
+
+		keys = append(keys, paths...)
+		if cursor = next; cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+func (r Redis) Get(ctx context.Context, key string) (*shrtie.Link, error) {
+	r = r.in(ctx)
+
 	// Check if string is not base64, so user cant access meta data
 	// Redis is string-escape save
 	if escape.MatchString(key) {
-		return "", ErrWrongKey
+		return nil, ErrWrongKey
 	}
 
-	// Prepare redis pipeline results
-	path := r.prefix + key
-	var url *redis.StringCmd
-	var until *redis.StringCmd
+	// Expiry, click limit and count are handled by the script
+	res, err := r.conn.Eval(getScript, []string{r.prefix + key, r.prefix + metaByClicks}, time.Now().Unix(), int64((r.grace+r.margin)/time.Second), key).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	fields, _ := res.([]interface{})
+	if len(fields) == 0 {
+		return nil, shrtie.ErrUnavailable
+	}
+
+	switch status, _ := fields[0].(int64); {
+	case status == 1:
+		return nil, ErrTTL
+	case status == 2:
+		return nil, shrtie.ErrExhausted
+	case len(fields) != 7:
+		return nil, shrtie.ErrUnavailable
+	}
+
+	ttlTo, _ := strconv.ParseInt(str(fields[2]), 10, 64)
+	ttl, err := remaining(ttlTo)
+	if err != nil {
+		return nil, err
+	}
+
+	redirect, _ := strconv.Atoi(str(fields[3]))
+	max, _ := strconv.ParseInt(str(fields[4]), 10, 64)
+	preview, _ := strconv.ParseBool(str(fields[6]))
+
+	return &shrtie.Link{
+		URL:       str(fields[1]),
+		TTL:       ttl,
+		Redirect:  redirect,
+		MaxClicks: max,
+		Password:  str(fields[5]),
+		Preview:   preview,
+	}, nil
+}
+
+// Count counts a click of key without returning the link.
+func (r Redis) Count(ctx context.Context, key string) error {
+	r = r.in(ctx)
+
+	if escape.MatchString(key) {
+		return ErrWrongKey
+	}
+
+	res, err := r.conn.Eval(countScript, []string{r.prefix + key, r.prefix + metaByClicks}, 1, key).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+
+	if n, _ := res.(int64); n == 0 {
+		return ErrWrongKey
+	}
+
+	return nil
+}
+
+// AddClicks adds the click counts of all namespaces in one pipeline.
+func (r Redis) AddClicks(_ context.Context, counts []shrtie.ClickCount) error {
 	_, err := r.conn.Pipelined(func(pipe *redis.Pipeline) error {
-		url = pipe.HGet(path, metaURL)
-		until = pipe.HGet(path, metaUntil)
-		pipe.HIncrBy(path, metaCount, 1)
+		for _, c := range counts {
+			if escape.MatchString(c.Key) {
+				continue
+			}
+			prefix := r.namespace(c.Namespace)
+			pipe.Eval(countScript, []string{prefix + c.Key, prefix + metaByClicks}, c.Clicks, c.Key)
+		}
 		return nil
 	})
 
+	return unavailable(err)
+}
+
+// Peek returns the link like Get without counting the click.
+func (r Redis) Peek(ctx context.Context, key string) (*shrtie.Link, error) {
+	r = r.in(ctx)
+
+	if escape.MatchString(key) {
+		return nil, ErrWrongKey
+	}
+
+	// Missing fields are returned as nil
+	fields, err := r.conn.HMGet(r.prefix+key, metaURL, metaUntil, metaRedirect, metaMax, metaCount, metaPassword, metaPreview).Result()
 	if err != nil {
-		return "", err
+		return nil, unavailable(err)
 	}
 
-	// Check if the key is expired
-	if ttlTo, _ := until.Int64(); ttlTo != 0 && time.Now().Unix() > ttlTo {
-		return "", ErrTTL
+	url, ok := fields[0].(string)
+	if !ok {
+		return nil, ErrWrongKey
 	}
 
-	return url.Val(), nil
+	ttlTo, _ := strconv.ParseInt(str(fields[1]), 10, 64)
+	ttl, err := remaining(ttlTo)
+	if err != nil {
+		return nil, err
+	}
+
+	redirect, _ := strconv.Atoi(str(fields[2]))
+	max, _ := strconv.ParseInt(str(fields[3]), 10, 64)
+	count, _ := strconv.ParseInt(str(fields[4]), 10, 64)
+	if max != 0 && count >= max {
+		return nil, shrtie.ErrExhausted
+	}
+	preview, _ := strconv.ParseBool(str(fields[6]))
+
+	return &shrtie.Link{
+		URL:       url,
+		TTL:       ttl,
+		Redirect:  redirect,
+		MaxClicks: max,
+		Password:  str(fields[5]),
+		Preview:   preview,
+	}, nil
 }
 
 func (r Redis) Info(key string) (*shrtie.Metadata, error) {
+	return r.InfoContext(context.Background(), key)
+}
+
+func (r Redis) InfoContext(ctx context.Context, key string) (*shrtie.Metadata, error) {
+	r = r.in(ctx)
+
+	if escape.MatchString(key) {
+		return nil, ErrWrongKey
+	}
+
 	// path var was used for clearity, can also be omitted
 	path := r.prefix + key
 
@@ -124,7 +1003,7 @@ func (r Redis) Info(key string) (*shrtie.Metadata, error) {
 	objMap, err := r.conn.HGetAll(path).Result()
 
 	if err != nil {
-		return nil, err
+		return nil, unavailable(err)
 	}
 
 	if len(objMap) == 0 {
@@ -135,27 +1014,600 @@ func (r Redis) Info(key string) (*shrtie.Metadata, error) {
 	// Internally redis.v4 also uses strconv
 	// Errors are ignored because the values should be safe
 	// Check if entry TTL is exceeded
-	var ttl int64
-	var now = time.Now().Unix()
-	if until, _ := strconv.ParseInt(objMap[metaUntil], 10, 64); until-now > 0 {
-		ttl = until - now
-	} else if until == 0 {
-		ttl = 0
-	} else {
-		return nil, ErrTTL
+	until, _ := strconv.ParseInt(objMap[metaUntil], 10, 64)
+	ttl, err := remaining(until)
+	if err != nil {
+		return nil, err
 	}
 
 	//Convert these values afterwards to save process time if ttl is exceeded
+	return metadata(objMap, until, ttl), nil
+}
+
+// metadata converts the fields of a link, ttl is the remaining time to life
+func metadata(objMap map[string]string, until int64, ttl time.Duration) *shrtie.Metadata {
 	created, _ := strconv.ParseInt(objMap[metaCreated], 10, 64)
 
 	// This can return an error if it wasnt clicked before but
 	// doesn't matter because it still returns 0
 	clicked, _ := strconv.ParseInt(objMap[metaCount], 10, 64)
+	redirect, _ := strconv.Atoi(objMap[metaRedirect])
+	max, _ := strconv.ParseInt(objMap[metaMax], 10, 64)
+	preview, _ := strconv.ParseBool(objMap[metaPreview])
 
 	return &shrtie.Metadata{
-		URL:     objMap[metaURL],
-		TTL:     ttl,
-		Clicked: clicked,
-		Created: time.Unix(created, 0),
+		URL:       objMap[metaURL],
+		TTL:       shrtie.Seconds(ttl),
+		Expires:   shrtie.Expires(until),
+		Redirect:  redirect,
+		Clicked:   clicked,
+		Created:   time.Unix(created, 0),
+		MaxClicks: max,
+		Remaining: shrtie.RemainingClicks(max, clicked),
+		Password:  objMap[metaPassword],
+		Preview:   preview,
+	}
+}
+
+// scanCount is the number of keys SCAN looks at per call, small batches
+// keep the server responsive
+const scanCount = 1000
+
+// List returns a page of the links, expired ones included. Unsorted pages
+// iterate the keys with SCAN in small batches, so the server isn't blocked.
+// They follow the SCAN cursor and may hold a few more links than the limit.
+// Sorted pages are read from the indexes "meta:by-created" and
+// "meta:by-clicks" of the namespace, starting at the rank of the cursor.
+func (r Redis) List(ctx context.Context, opts shrtie.ListOptions) (*shrtie.ListPage, error) {
+	r = r.in(ctx)
+
+	cursor, err := shrtie.ParseCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if opts.Sort == shrtie.Unsorted {
+		page := &shrtie.ListPage{}
+		for next := uint64(cursor.Value); ; {
+			var links []shrtie.ListEntry
+			if links, next, err = r.scan(next, opts, now); err != nil {
+				return nil, err
+			}
+
+			page.Links = append(page.Links, links...)
+			if next == 0 {
+				return page, nil
+			}
+
+			if len(page.Links) >= opts.PageLimit() {
+				page.Cursor = shrtie.Cursor{Value: int64(next)}.String()
+				return page, nil
+			}
+		}
+	}
+
+	index := r.prefix + metaByCreated
+	if opts.Sort == shrtie.SortClicks {
+		index = r.prefix + metaByClicks
+	}
+
+	var start int64
+	if opts.Cursor != "" {
+		if start, err = r.start(index, cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	// One link more than the limit tells if there's a next page
+	page := &shrtie.ListPage{}
+	limit := opts.PageLimit()
+	var values []int64
+	for {
+		members, err := r.conn.ZRangeWithScores(index, start, start+scanCount-1).Result()
+		if err != nil {
+			return nil, unavailable(err)
+		}
+
+		cmds := make([]*redis.StringStringMapCmd, len(members))
+		_, err = r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+			for i, member := range members {
+				cmds[i] = pipe.HGetAll(r.prefix + str(member.Member))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, unavailable(err)
+		}
+
+		var gone []interface{}
+		for i, member := range members {
+			key, value := str(member.Member), -int64(member.Score)
+
+			// Members at the cursor whose rank changed since
+			if opts.Cursor != "" && (value > cursor.Value || value == cursor.Value && key <= cursor.Key) {
+				continue
+			}
+
+			// Links removed by redis at the end of their grace period
+			objMap := cmds[i].Val()
+			if objMap[metaURL] == "" {
+				gone = append(gone, key)
+				continue
+			}
+
+			until, _ := strconv.ParseInt(objMap[metaUntil], 10, 64)
+			ttl, _ := remaining(until)
+			if meta := metadata(objMap, until, ttl); opts.Match(meta, now) {
+				page.Links = append(page.Links, shrtie.ListEntry{Key: key, Metadata: *meta})
+				values = append(values, value)
+			}
+
+			if len(page.Links) > limit {
+				page.Links = page.Links[:limit]
+				page.Cursor = shrtie.Cursor{Value: values[limit-1], Key: page.Links[limit-1].Key}.String()
+				return page, r.unlist(gone)
+			}
+		}
+
+		if err = r.unlist(gone); err != nil {
+			return nil, err
+		}
+
+		if len(members) < scanCount {
+			return page, nil
+		}
+		start += int64(len(members) - len(gone))
+	}
+}
+
+// start returns the rank of the first member after the cursor in index.
+// The member at the cursor is found by its rank as long as its score didn't
+// change, otherwise the page starts at its old score.
+func (r Redis) start(index string, cursor shrtie.Cursor) (int64, error) {
+	var rank *redis.IntCmd
+	var score *redis.FloatCmd
+	_, err := r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+		rank = pipe.ZRank(index, cursor.Key)
+		score = pipe.ZScore(index, cursor.Key)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return 0, unavailable(err)
+	}
+
+	if score.Err() == nil && int64(score.Val()) == -cursor.Value {
+		return rank.Val() + 1, nil
+	}
+
+	n, err := r.conn.ZCount(index, "-inf", "("+strconv.FormatInt(-cursor.Value, 10)).Result()
+	return n, unavailable(err)
+}
+
+// unlist drops the keys of removed links from the indexes of List
+func (r Redis) unlist(keys []interface{}) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	_, err := r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.ZRem(r.prefix+metaByCreated, keys...)
+		pipe.ZRem(r.prefix+metaByClicks, keys...)
+		return nil
+	})
+	return unavailable(err)
+}
+
+// scan returns the matching links of a SCAN call and the next cursor
+func (r Redis) scan(cursor uint64, opts shrtie.ListOptions, now time.Time) ([]shrtie.ListEntry, uint64, error) {
+	paths, next, err := r.conn.Scan(cursor, r.prefix+"*", scanCount).Result()
+	if err != nil {
+		return nil, 0, unavailable(err)
+	}
+
+	// Meta keys contain colons and keys of namespaces a slash, links only
+	// have valid keys
+	var keys []string
+	for _, path := range paths {
+		if key := strings.TrimPrefix(path, r.prefix); key != "" && !escape.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	_, err = r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HGetAll(r.prefix + key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, unavailable(err)
+	}
+
+	var links []shrtie.ListEntry
+	for i, cmd := range cmds {
+		objMap := cmd.Val()
+
+		// The link might have been deleted since
+		if objMap[metaURL] == "" {
+			continue
+		}
+
+		until, _ := strconv.ParseInt(objMap[metaUntil], 10, 64)
+		ttl, _ := remaining(until)
+		if meta := metadata(objMap, until, ttl); opts.Match(meta, now) {
+			links = append(links, shrtie.ListEntry{Key: keys[i], Metadata: *meta})
+		}
+	}
+
+	return links, next, nil
+}
+
+// Take takes a token of a rate limit bucket, so limits are shared by all
+// instances using the database. Buckets live in "meta:limits:" outside of
+// namespaces and are accurate to milliseconds.
+func (r Redis) Take(_ context.Context, key string, limit shrtie.Limit) (shrtie.LimitState, error) {
+	interval := int64(limit.Interval() / time.Millisecond)
+	if interval < 1 {
+		interval = 1
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	res, err := r.conn.Eval(limitScript, []string{r.root + metaLimits + key}, now, interval, limit.Capacity()).Result()
+	if err != nil {
+		return shrtie.LimitState{}, unavailable(err)
+	}
+
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return shrtie.LimitState{}, shrtie.ErrUnavailable
+	}
+
+	allowed, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return limit.State(allowed == 1, time.Duration(wait)*time.Millisecond), nil
+}
+
+func (r Redis) SaveAPIKey(_ context.Context, key *shrtie.APIKey) error {
+	path := r.root + metaKeys + key.ID
+
+	// Claim the ID first, so existing keys are never overwritten
+	claimed, err := r.conn.HSetNX(path, "hash", key.Hash).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+	if !claimed {
+		return shrtie.ErrConflict
+	}
+
+	scopes := make([]string, len(key.Scopes))
+	for i, scope := range key.Scopes {
+		scopes[i] = string(scope)
+	}
+
+	return unavailable(r.conn.HMSet(path, map[string]string{
+		"scopes":    strings.Join(scopes, ","),
+		"namespace": key.Namespace,
+		metaCreated: strconv.FormatInt(key.Created.Unix(), 10),
+	}).Err())
+}
+
+func (r Redis) APIKey(_ context.Context, id string) (*shrtie.APIKey, error) {
+	objMap, err := r.conn.HGetAll(r.root + metaKeys + id).Result()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	if objMap["hash"] == "" {
+		return nil, shrtie.ErrNotFound
+	}
+
+	var scopes []shrtie.Scope
+	for _, scope := range strings.Split(objMap["scopes"], ",") {
+		if scope != "" {
+			scopes = append(scopes, shrtie.Scope(scope))
+		}
+	}
+
+	created, _ := strconv.ParseInt(objMap[metaCreated], 10, 64)
+	return &shrtie.APIKey{
+		ID:        id,
+		Hash:      objMap["hash"],
+		Scopes:    scopes,
+		Namespace: objMap["namespace"],
+		Created:   time.Unix(created, 0).UTC(),
 	}, nil
 }
+
+func (r Redis) RevokeAPIKey(_ context.Context, id string) error {
+	deleted, err := r.conn.Del(r.root + metaKeys + id).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+
+	if deleted == 0 {
+		return shrtie.ErrNotFound
+	}
+
+	return nil
+}
+
+func (r Redis) Delete(ctx context.Context, key string) error {
+	r = r.in(ctx)
+
+	if escape.MatchString(key) {
+		return ErrWrongKey
+	}
+
+	path := r.prefix + key
+	url, err := r.conn.HGet(path, metaURL).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+
+	deleted, err := r.conn.Del(path).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+
+	if deleted == 0 {
+		return ErrWrongKey
+	}
+
+	_, err = r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.ZRem(r.root+metaExpiring, r.member(key))
+		pipe.ZRem(r.prefix+metaByCreated, key)
+		pipe.ZRem(r.prefix+metaByClicks, key)
+		return nil
+	})
+	if err != nil {
+		return unavailable(err)
+	}
+
+	// A link saved with the same key later starts without clicks
+	stats, err := r.statsKeys(key)
+	if err != nil {
+		return err
+	}
+	if len(stats) != 0 {
+		if err = r.conn.Del(stats...).Err(); err != nil {
+			return unavailable(err)
+		}
+	}
+
+	return r.unindex(key, url)
+}
+
+func (r Redis) Update(ctx context.Context, key string, update *shrtie.LinkUpdate) error {
+	r = r.in(ctx)
+
+	if escape.MatchString(key) {
+		return ErrWrongKey
+	}
+
+	if len(update.URL) > maxLength {
+		return ErrTooLong
+	}
+
+	// Counters expire with the link
+	stats, err := r.statsKeys(key)
+	if err != nil {
+		return err
+	}
+
+	// Click count and created time are left untouched
+	now := time.Now()
+	args := []interface{}{"", r.member(key), ""}
+	if update.TTL != nil {
+		args[0] = "0"
+		if *update.TTL != 0 {
+			args[0] = r.expireAt(now, *update.TTL).Unix()
+		}
+		args[2] = until(now, *update.TTL)
+		args = append(args, metaUntil, args[2])
+	}
+	if update.URL != "" {
+		args = append(args, metaURL, update.URL)
+	}
+	if update.Redirect != 0 {
+		args = append(args, metaRedirect, update.Redirect)
+	}
+	if update.MaxClicks != nil {
+		args = append(args, metaMax, *update.MaxClicks)
+	}
+	if update.Password != nil {
+		args = append(args, metaPassword, *update.Password)
+	}
+	if update.Preview != nil {
+		args = append(args, metaPreview, strconv.FormatBool(*update.Preview))
+	}
+
+	res, err := r.conn.Eval(updateScript, append([]string{r.prefix + key, r.root + metaExpiring}, stats...), args...).Result()
+	if err != nil {
+		return unavailable(err)
+	}
+
+	values, _ := res.([]interface{})
+	if len(values) != 2 {
+		return shrtie.ErrUnavailable
+	}
+
+	// The index expires with the link as well
+	old := str(values[0])
+	var ttl time.Duration
+	if ms, _ := values[1].(int64); ms > 0 {
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+
+	if update.URL != "" && update.URL != old {
+		if err = r.unindex(key, old); err != nil {
+			return err
+		}
+
+		return unavailable(r.conn.Set(r.prefix+metaURLs+update.URL, key, ttl).Err())
+	}
+
+	if update.TTL == nil {
+		return nil
+	}
+
+	index := r.prefix + metaURLs + old
+	latest, err := r.conn.Get(index).Result()
+	if err == redis.Nil || err == nil && latest != key {
+		return nil
+	}
+	if err != nil {
+		return unavailable(err)
+	}
+
+	if ttl == 0 {
+		return unavailable(r.conn.Persist(index).Err())
+	}
+
+	return unavailable(r.conn.PExpire(index, ttl).Err())
+}
+
+// Sweep removes up to limit links of all namespaces which expired before
+// before, see shrtie.Sweeper. They are found in the set "meta:expiring".
+// Redis removes expired links by itself at the end of the grace period, so
+// archiving them needs WithSweepMargin, otherwise ErrNoSweepMargin is
+// returned. Counters of the stats expire with the key of the link.
+func (r Redis) Sweep(ctx context.Context, before time.Time, limit int, archive shrtie.ArchiveFunc) (int, error) {
+	if archive != nil && r.margin == 0 {
+		return 0, ErrNoSweepMargin
+	}
+
+	members, err := r.conn.ZRangeByScore(r.root+metaExpiring, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   "(" + strconv.FormatInt(before.Unix(), 10),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return 0, unavailable(err)
+	}
+
+	if len(members) == 0 {
+		return 0, nil
+	}
+
+	cmds := make([]*redis.StringStringMapCmd, len(members))
+	_, err = r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, member := range members {
+			cmds[i] = pipe.HGetAll(r.root + member)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, unavailable(err)
+	}
+
+	// Links removed by redis are only dropped from the set
+	var links []shrtie.ExpiredLink
+	var gone int
+	for i, member := range members {
+		objMap := cmds[i].Val()
+		if len(objMap) == 0 {
+			gone++
+			continue
+		}
+
+		var link shrtie.ExpiredLink
+		link.Namespace, link.Key = split(member)
+		untl, _ := strconv.ParseInt(objMap[metaUntil], 10, 64)
+		link.Metadata = *metadata(objMap, untl, 0)
+		links = append(links, link)
+	}
+
+	if archive != nil && gone != 0 {
+		log.Println("Expired links removed by redis before they were archived:", gone)
+	}
+
+	if archive != nil && len(links) != 0 {
+		if err = archive(ctx, links); err != nil {
+			return 0, err
+		}
+	}
+
+	// Errors are checked per command
+	sweeps := make([]*redis.Cmd, len(members))
+	r.conn.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, member := range members {
+			ns, key := split(member)
+			prefix := r.namespace(ns)
+			index := prefix + metaURLs + cmds[i].Val()[metaURL]
+			keys := []string{prefix + key, r.root + metaExpiring, index, prefix + metaByCreated, prefix + metaByClicks}
+			sweeps[i] = pipe.Eval(sweepScript, keys, member, before.Unix(), key)
+		}
+		return nil
+	})
+
+	var n int
+	for _, sweep := range sweeps {
+		if sweep.Err() != nil {
+			return n, unavailable(sweep.Err())
+		}
+		if removed, _ := sweep.Val().(int64); removed == 1 {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// split returns the namespace and key of a member of the sets of all
+// namespaces, see member
+func split(member string) (string, string) {
+	if i := strings.Index(member, "/"); i >= 0 {
+		return member[:i], member[i+1:]
+	}
+
+	return "", member
+}
+
+// bucket returns the hash field of the bucket containing t
+func bucket(interval shrtie.Interval, t time.Time) string {
+	return strconv.FormatInt(interval.Truncate(t).Unix(), 10)
+}
+
+// until returns the unix timestamp the ttl ends as string, "0" means forever
+func until(now time.Time, ttl time.Duration) string {
+	if ttl == 0 {
+		return "0"
+	}
+
+	return strconv.FormatInt(now.Add(ttl).Unix(), 10)
+}
+
+// str returns the string of a HMGet result, missing fields are empty
+func str(field interface{}) string {
+	s, _ := field.(string)
+	return s
+}
+
+// remaining returns the remaining time to life of the until timestamp
+func remaining(until int64) (time.Duration, error) {
+	if until == 0 {
+		return 0, nil
+	}
+
+	ttl := time.Unix(until, 0).Sub(time.Now())
+	if ttl <= 0 {
+		return 0, ErrTTL
+	}
+
+	return ttl, nil
+}
+
+// unavailable maps errors of the redis client to shrtie errors
+func unavailable(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case redis.Nil:
+		// Returned if a field of a missing hash was requested
+		return ErrWrongKey
+	}
+
+	return shrtie.ErrUnavailable
+}
@@ -0,0 +1,305 @@
+package redis
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/realfake/shrtie"
+	"github.com/realfake/shrtie/shrtietest"
+	redis "gopkg.in/redis.v4"
+)
+
+// The tests need a running redis, its address is read from SHRTIE_REDIS
+// and defaults to localhost:6379.
+func options() *redis.Options {
+	addr := os.Getenv("SHRTIE_REDIS")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+
+	return &redis.Options{
+		Addr: addr,
+	}
+}
+
+func TestConformance(t *testing.T) {
+	if _, err := New(options()); err != nil {
+		t.Skip("No redis available:", err)
+	}
+
+	// Every test starts with an empty backend under its own prefix, all of
+	// them are removed afterwards
+	root := fmt.Sprintf("shrtietest/%d/", time.Now().UnixNano())
+	defer clean(t, root)
+
+	var n int
+	shrtietest.RunBackendTests(t, func(t *testing.T) shrtie.Backend {
+		n++
+		b, err := New(options(), WithPrefix(fmt.Sprintf("%s%d/", root, n)), WithSweepMargin(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return b
+	})
+}
+
+// testBackend returns a backend with a fresh prefix and a client, call
+// clean with the prefix afterwards
+func testBackend(t *testing.T) (Redis, *redis.Client, string) {
+	root := fmt.Sprintf("shrtietest/%d/", time.Now().UnixNano())
+	b, err := New(options(), WithPrefix(root))
+	if err != nil {
+		t.Skip("No redis available:", err)
+	}
+
+	return b.(Redis), redis.NewClient(options()), root
+}
+
+func TestMigrate(t *testing.T) {
+	// Data of older versions, written before the backend is created
+	root := fmt.Sprintf("shrtietest/%d/", time.Now().UnixNano())
+	client := redis.NewClient(options())
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("No redis available:", err)
+	}
+	defer client.Close()
+	defer clean(t, root)
+
+	now := time.Now()
+	link := func(path, url string, until time.Time) {
+		client.HMSet(root+path, map[string]string{
+			metaURL:     url,
+			metaUntil:   strconv.FormatInt(until.Unix(), 10),
+			metaCreated: strconv.FormatInt(now.Unix(), 10),
+			metaCount:   "3",
+		})
+	}
+	link("live", "https://live.com", now.Add(time.Hour))
+	link("gone", "https://gone.com", now.Add(-time.Hour))
+	link("team/live", "https://team.com", now.Add(time.Hour))
+	client.HMSet(root+legacyURLs, map[string]string{
+		"https://live.com":    "live",
+		"https://gone.com":    "gone",
+		"https://deleted.com": "deleted",
+	})
+	client.HSet(root+"team/"+legacyURLs, "https://team.com", "live")
+	client.HSet(root+metaStats+"live:day", "0", "1")
+	client.HSet(root+metaStats+"gone:day", "0", "1")
+
+	if _, err := New(options(), WithPrefix(root)); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]time.Duration{
+		"live":                                  time.Hour,
+		"team/live":                             time.Hour,
+		metaURLs + "https://live.com":           time.Hour,
+		"team/" + metaURLs + "https://team.com": time.Hour,
+		metaStats + "live:day":                  time.Hour,
+	} {
+		if ttl := client.PTTL(root + path).Val(); ttl <= 0 || ttl > expected {
+			t.Errorf("Wrong expiry of %s: %v", path, ttl)
+		}
+	}
+
+	// Expiring links are found by Sweep
+	if members := client.ZRange(root+metaExpiring, 0, -1).Val(); len(members) != 2 || members[0] != "live" || members[1] != "team/live" {
+		t.Error("Wrong expiring links:", members)
+	}
+
+	// Links are indexed for List in their namespace
+	for path, expected := range map[string]float64{
+		metaByCreated:           float64(-now.Unix()),
+		metaByClicks:            -3,
+		"team/" + metaByCreated: float64(-now.Unix()),
+	} {
+		if members := client.ZRangeWithScores(root+path, 0, -1).Val(); len(members) != 1 || members[0].Member != "live" || members[0].Score != expected {
+			t.Errorf("Wrong index %s: %v", path, members)
+		}
+	}
+
+	for _, path := range []string{"gone", metaStats + "gone:day", legacyURLs, "team/" + legacyURLs, metaURLs + "https://deleted.com"} {
+		if client.Exists(root + path).Val() {
+			t.Errorf("%s wasn't removed", path)
+		}
+	}
+
+	if version, _ := client.Get(root + metaVersion).Int64(); version != layoutVersion {
+		t.Error("Wrong layout version:", version)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	r, client, root := testBackend(t)
+	defer client.Close()
+	defer clean(t, root)
+
+	ctx := context.Background()
+	key, err := r.Save(ctx, &shrtie.Link{URL: "https://here.com", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.WriteClicks(ctx, []shrtie.Click{{Time: time.Now(), Key: key}}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := r.statsKeys(key)
+	if err != nil || len(stats) == 0 {
+		t.Fatal("Missing counters:", stats, err)
+	}
+
+	// Counters and index expire with the link
+	for _, path := range append(stats, root+metaURLs+"https://here.com") {
+		if ttl := client.PTTL(path).Val(); ttl <= 0 || ttl > time.Hour {
+			t.Errorf("Wrong expiry of %s: %v", path, ttl)
+		}
+	}
+
+	if err = r.Update(ctx, key, &shrtie.LinkUpdate{TTL: new(time.Duration)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range append(stats, root+key, root+metaURLs+"https://here.com") {
+		if ttl := client.PTTL(path).Val(); ttl != -time.Millisecond {
+			t.Errorf("Expiry of %s wasn't removed: %v", path, ttl)
+		}
+	}
+
+	if err = r.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range append(stats, root+metaURLs+"https://here.com") {
+		if client.Exists(path).Val() {
+			t.Errorf("%s wasn't removed with the link", path)
+		}
+	}
+}
+
+// clean removes all keys starting with prefix
+func clean(t *testing.T, prefix string) {
+	client := redis.NewClient(options())
+	defer client.Close()
+
+	for cursor := uint64(0); ; {
+		keys, next, err := client.Scan(cursor, prefix+"*", scanCount).Result()
+		if err != nil {
+			t.Error("Failed to scan test keys:", err)
+			return
+		}
+
+		if len(keys) != 0 {
+			if err = client.Del(keys...).Err(); err != nil {
+				t.Error("Failed to remove test keys:", err)
+				return
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return
+		}
+	}
+}
+
+func TestSweepMargin(t *testing.T) {
+	r, client, root := testBackend(t)
+	defer client.Close()
+	defer clean(t, root)
+
+	// Links would be gone before they are archived
+	archive := func(context.Context, []shrtie.ExpiredLink) error { return nil }
+	if _, err := r.Sweep(context.Background(), time.Now(), 10, archive); err != ErrNoSweepMargin {
+		t.Error("Expected ErrNoSweepMargin got:", err)
+	}
+
+	r.margin = time.Hour
+	ctx := shrtie.WithNamespace(context.Background(), "team")
+	key, err := r.Save(ctx, &shrtie.Link{URL: "https://here.com", TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := client.PTTL(root + "team/" + key).Val(); ttl <= time.Hour {
+		t.Error("Key expires without margin:", ttl)
+	}
+
+	if n, err := r.Sweep(context.Background(), time.Now().Add(time.Hour), 10, archive); err != nil || n != 1 {
+		t.Fatal("Expected 1 removed link got:", n, err)
+	}
+
+	for _, path := range []string{"team/" + key, "team/" + metaURLs + "https://here.com"} {
+		if client.Exists(root + path).Val() {
+			t.Errorf("%s wasn't removed", path)
+		}
+	}
+
+	if n := client.ZCard(root + metaExpiring).Val(); n != 0 {
+		t.Error("Swept link still in the set:", n)
+	}
+}
+
+func TestListIndex(t *testing.T) {
+	r, client, root := testBackend(t)
+	defer client.Close()
+	defer clean(t, root)
+
+	ctx := context.Background()
+	var keys []string
+	for i := 0; i < 4; i++ {
+		key, err := r.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := r.AddClicks(ctx, []shrtie.ClickCount{{Key: keys[1], Clicks: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Get(ctx, keys[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Links removed by redis are dropped from the indexes by List
+	client.Del(root + keys[3])
+	opts := shrtie.ListOptions{Sort: shrtie.SortClicks, Limit: 1}
+	page, err := r.List(ctx, opts)
+	if err != nil || len(page.Links) != 1 || page.Links[0].Key != keys[1] || page.Cursor == "" {
+		t.Fatal("Wrong first page:", page, err)
+	}
+
+	// Pages continue after a deleted cursor
+	if err = r.Delete(ctx, keys[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	var listed []string
+	for opts.Cursor = page.Cursor; ; opts.Cursor = page.Cursor {
+		if page, err = r.List(ctx, opts); err != nil {
+			t.Fatal(err)
+		}
+		for _, link := range page.Links {
+			listed = append(listed, link.Key)
+		}
+		if page.Cursor == "" {
+			break
+		}
+	}
+
+	if len(listed) != 2 || listed[0] != keys[2] || listed[1] != keys[0] {
+		t.Error("Wrong links listed:", listed)
+	}
+
+	for _, index := range []string{metaByCreated, metaByClicks} {
+		if members := client.ZRange(root+index, 0, -1).Val(); len(members) != 2 {
+			t.Errorf("Wrong members of %s: %v", index, members)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package slqlite3
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/realfake/shrtie"
+)
+
+// migrations bring shrtie_url from the schema of the first release up to
+// date, the n-th one upgrades a database from version n to n+1. The version
+// is stored in PRAGMA user_version. Columns are only added if they are
+// missing, so tables created by unversioned releases are upgraded as well.
+var migrations = []func(tx *sql.Tx) error{
+	// Custom aliases, links of the first release keep their keys
+	func(tx *sql.Tx) error {
+		added, err := addColumn(tx, "key", "TEXT")
+		if err != nil || !added {
+			return err
+		}
+
+		if err = fillKeys(tx); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS shrtie_url_key ON shrtie_url(key);`)
+		return err
+	},
+	column("redirect", "INTEGER DEFAULT 0 NOT NULL"),
+	column("max_clicks", "INTEGER DEFAULT 0 NOT NULL"),
+	column("password", "TEXT DEFAULT '' NOT NULL"),
+	column("preview", "INTEGER DEFAULT 0 NOT NULL"),
+	// Namespaces, keys are unique per namespace
+	func(tx *sql.Tx) error {
+		if _, err := addColumn(tx, "namespace", "TEXT DEFAULT '' NOT NULL"); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`
+			DROP INDEX IF EXISTS shrtie_url_key;
+			CREATE UNIQUE INDEX IF NOT EXISTS shrtie_url_namespace_key ON shrtie_url(namespace, key);
+		`)
+		return err
+	},
+}
+
+// migrate creates shrtie_url with the schema of the first release if it's
+// missing and applies the migrations it lacks, each in a transaction.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS shrtie_url (
+			id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			url TEXT NOT NULL,
+			until INTEGER NOT NULL,
+			count INTEGER DEFAULT 0 NOT NULL,
+			created INTEGER NOT NULL);
+	`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if err = db.QueryRow(`PRAGMA user_version;`).Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		// PRAGMA takes no parameters, the version is part of the transaction
+		if err = migrations[version](tx); err == nil {
+			_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d;`, version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Failed to migrate schema to version %d: %v", version+1, err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// column returns a migration adding a column to shrtie_url
+func column(name, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := addColumn(tx, name, definition)
+		return err
+	}
+}
+
+// addColumn adds a column to shrtie_url unless it exists and reports
+// whether it was added
+func addColumn(tx *sql.Tx, name, definition string) (bool, error) {
+	rows, err := tx.Query(`PRAGMA table_info(shrtie_url);`)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var column, typ string
+		var value sql.NullString
+		if err = rows.Scan(&cid, &column, &typ, &notNull, &value, &pk); err != nil {
+			return false, err
+		}
+
+		if column == name {
+			return false, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE shrtie_url ADD COLUMN %s %s;`, name, definition))
+	return err == nil, err
+}
+
+// fillKeys sets the keys of links saved by the first release, which derived
+// them from the row id like shrtie.Sequential
+func fillKeys(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id FROM shrtie_url WHERE key IS NULL;`)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		key, _ := shrtie.Sequential{}.Key(id)
+		if _, err = tx.Exec(`UPDATE shrtie_url SET key = ? WHERE id = ?;`, key, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
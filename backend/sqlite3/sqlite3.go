@@ -2,28 +2,57 @@ package slqlite3
 
 import (
 	"database/sql"
-	"encoding/base64"
-	"encoding/binary"
-	"errors"
-	"log"
+	"golang.org/x/net/context"
+	"strings"
 	"time"
 
+	"github.com/mattn/go-sqlite3"
 	"github.com/realfake/shrtie"
 )
 
 const maxLength = 2048
 
+// maxAttempts limits how often Save retries if a generated key is taken
+const maxAttempts = 10
+
+// Kept for compatibility, the backend returns the shrtie errors
 var (
-	ErrWrongKey error = errors.New("Wrong key")
-	ErrTTL            = errors.New("TTL exceeded")
+	ErrWrongKey = shrtie.ErrNotFound
+	ErrTTL      = shrtie.ErrExpired
+	ErrTooLong  = shrtie.ErrTooLong
 )
 
 type Sqlite3 struct {
-	insertStmt, incrStmt, getStmt, infoStmt *sql.Stmt
+	insertStmt, keyStmt, removeStmt, incrStmt, getStmt, infoStmt *sql.Stmt
+	updateStmt, deleteStmt, findStmt, clickStmt                  *sql.Stmt
+	bucketStmt, breakdownStmt, addClicksStmt                     *sql.Stmt
+	saveKeyStmt, apiKeyStmt, revokeKeyStmt                       *sql.Stmt
+	expiredStmt, sweepStmt, clearStmt                            *sql.Stmt
+
+	db   *sql.DB
+	keys shrtie.KeyGenerator
 }
 
-func New(db *sql.DB) (shrtie.GetSaver, error) {
-	b := Sqlite3{}
+// Option configures the backend
+type Option func(*Sqlite3)
+
+// WithKeyGenerator sets the generator of the keys handed out by Save.
+// The default is shrtie.Sequential.
+func WithKeyGenerator(g shrtie.KeyGenerator) Option {
+	return func(s *Sqlite3) {
+		s.keys = g
+	}
+}
+
+func New(db *sql.DB, opts ...Option) (shrtie.Backend, error) {
+	b := Sqlite3{
+		db:   db,
+		keys: shrtie.Sequential{},
+	}
+
+	for _, opt := range opts {
+		opt(&b)
+	}
 
 	if err := (&b).prepare(db); err != nil {
 		return nil, err
@@ -32,96 +61,651 @@ func New(db *sql.DB) (shrtie.GetSaver, error) {
 	return b, nil
 }
 
-func (s Sqlite3) Get(key string) (string, error) {
-	id, err := toInt64(key)
+func (s Sqlite3) Get(ctx context.Context, key string) (*shrtie.Link, error) {
+	link, err := s.Peek(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The update only counts clicks within the limit, so concurrent clicks
+	// can't exceed it
+	res, err := s.incrStmt.ExecContext(ctx, shrtie.NamespaceFromContext(ctx), key)
 	if err != nil {
-		return "", err
+		return nil, unavailable(err)
 	}
 
-	var url string
-	var until int64
-	if err = s.getStmt.QueryRow(id).Scan(&url, &until); err != nil {
-		return "", nil
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, s.missed(ctx, key)
 	}
 
-	if until < time.Now().Unix() {
-		return "", ErrTTL
+	return link, nil
+}
+
+// missed returns why the click of key wasn't counted. The link was either
+// exhausted by concurrent clicks or removed since it was peeked, which is
+// told apart by peeking again.
+func (s Sqlite3) missed(ctx context.Context, key string) error {
+	if _, err := s.Peek(ctx, key); err != nil {
+		return err
 	}
 
-	return url, nil
+	// The limit was changed again meanwhile
+	return shrtie.ErrExhausted
 }
 
-func (s Sqlite3) Save(value string, ttl time.Duration) string {
-	if len(value) > maxLength {
-		return ""
+// Count counts a click of key without returning the link.
+func (s Sqlite3) Count(ctx context.Context, key string) error {
+	res, err := s.incrStmt.ExecContext(ctx, shrtie.NamespaceFromContext(ctx), key)
+	if err != nil {
+		return unavailable(err)
+	}
+
+	// Exhausted links aren't counted either
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWrongKey
+	}
+
+	return nil
+}
+
+// AddClicks adds the click counts in a single transaction.
+func (s Sqlite3) AddClicks(ctx context.Context, counts []shrtie.ClickCount) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return unavailable(err)
+	}
+
+	stmt := tx.StmtContext(ctx, s.addClicksStmt)
+	for _, c := range counts {
+		if _, err = stmt.ExecContext(ctx, c.Clicks, c.Namespace, c.Key); err != nil {
+			tx.Rollback()
+			return unavailable(err)
+		}
+	}
+
+	return unavailable(tx.Commit())
+}
+
+// Peek returns the link like Get without counting the click.
+func (s Sqlite3) Peek(ctx context.Context, key string) (*shrtie.Link, error) {
+	var link = &shrtie.Link{}
+	var until, count int64
+	err := s.getStmt.QueryRowContext(ctx, shrtie.NamespaceFromContext(ctx), key).Scan(&link.URL, &until, &link.Redirect, &link.MaxClicks, &count, &link.Password, &link.Preview)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	if link.TTL, err = remaining(until); err != nil {
+		return nil, err
+	}
+
+	if link.MaxClicks != 0 && count >= link.MaxClicks {
+		return nil, shrtie.ErrExhausted
+	}
+
+	return link, nil
+}
+
+func (s Sqlite3) Save(ctx context.Context, link *shrtie.Link) (string, error) {
+	return s.save(ctx, s.insertStmt, s.keyStmt, s.removeStmt, link)
+}
+
+// SaveAll saves the links like Save in a single transaction. If it can't be
+// committed, no link is saved.
+func (s Sqlite3) SaveAll(ctx context.Context, links []*shrtie.Link) ([]string, []error) {
+	keys := make([]string, len(links))
+	errs := make([]error, len(links))
+
+	fail := func(err error) ([]string, []error) {
+		for i := range links {
+			keys[i], errs[i] = "", err
+		}
+		return keys, errs
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fail(unavailable(err))
+	}
+
+	insert := tx.StmtContext(ctx, s.insertStmt)
+	key := tx.StmtContext(ctx, s.keyStmt)
+	remove := tx.StmtContext(ctx, s.removeStmt)
+	for i, link := range links {
+		keys[i], errs[i] = s.save(ctx, insert, key, remove, link)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(unavailable(err))
+	}
+
+	return keys, errs
+}
+
+// save inserts the link with the given statements, so it works within
+// transactions as well
+func (s Sqlite3) save(ctx context.Context, insertStmt, keyStmt, removeStmt *sql.Stmt, link *shrtie.Link) (string, error) {
+	if len(link.URL) > maxLength {
+		return "", ErrTooLong
 	}
 
-	var until int64
 	now := time.Now()
-	if ttl != 0 {
-		until = now.Add(ttl).Unix()
+	for i := 0; i < maxAttempts; i++ {
+		// Insert without key, it's derived from the row id afterwards
+		res, err := insertStmt.ExecContext(ctx, shrtie.NamespaceFromContext(ctx), nil, link.URL, until(now, link.TTL), link.Redirect, link.MaxClicks, link.Password, link.Preview, now.Unix())
+		if err != nil {
+			return "", unavailable(err)
+		}
+
+		index, _ := res.LastInsertId()
+		key, err := s.keys.Key(index)
+		if err != nil {
+			removeStmt.ExecContext(ctx, index)
+			return "", err
+		}
+
+		// The key might already be taken, drop the row and try the next id
+		if _, err = keyStmt.ExecContext(ctx, key, index); err != nil {
+			removeStmt.ExecContext(ctx, index)
+			if err = conflict(err, sqlite3.ErrConstraintUnique); err == shrtie.ErrConflict {
+				continue
+			}
+			return "", err
+		}
+
+		return key, nil
+	}
+
+	return "", shrtie.ErrConflict
+}
+
+func (s Sqlite3) SaveAlias(ctx context.Context, key string, link *shrtie.Link) error {
+	if len(link.URL) > maxLength {
+		return ErrTooLong
 	}
 
-	res, err := s.insertStmt.Exec(value, until, now.Unix())
+	now := time.Now()
+	_, err := s.insertStmt.ExecContext(ctx, shrtie.NamespaceFromContext(ctx), key, link.URL, until(now, link.TTL), link.Redirect, link.MaxClicks, link.Password, link.Preview, now.Unix())
+	return conflict(err, sqlite3.ErrConstraintUnique)
+}
+
+// Delete removes the link and its clicks, a link saved with the same key
+// later starts without clicks.
+func (s Sqlite3) Delete(ctx context.Context, key string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return ""
+		return unavailable(err)
 	}
 
-	// Make int64 to byte array and cut it to min lenght
-	buf := make([]byte, 8)
-	index, _ := res.LastInsertId()
-	size := binary.PutVarint(buf, index)
+	ns := shrtie.NamespaceFromContext(ctx)
+	res, err := tx.StmtContext(ctx, s.deleteStmt).ExecContext(ctx, ns, key)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			tx.Rollback()
+			return ErrWrongKey
+		}
+		_, err = tx.StmtContext(ctx, s.clearStmt).ExecContext(ctx, ns, key)
+	}
+	if err != nil {
+		tx.Rollback()
+		return unavailable(err)
+	}
 
-	// Convert to base64, wich is URL save and without padding ('='*)
-	return base64.RawURLEncoding.EncodeToString(buf[:size])
+	return unavailable(tx.Commit())
 }
 
-func (s Sqlite3) Info(key string) (*shrtie.Metadata, error) {
-	id, err := toInt64(key)
+func (s Sqlite3) Update(ctx context.Context, key string, update *shrtie.LinkUpdate) error {
+	if len(update.URL) > maxLength {
+		return ErrTooLong
+	}
+
+	// NULL keeps the current value
+	var url, untl, max, password, preview interface{}
+	if update.URL != "" {
+		url = update.URL
+	}
+	if update.TTL != nil {
+		untl = until(time.Now(), *update.TTL)
+	}
+	if update.MaxClicks != nil {
+		max = *update.MaxClicks
+	}
+	if update.Password != nil {
+		password = *update.Password
+	}
+	if update.Preview != nil {
+		preview = *update.Preview
+	}
+
+	res, err := s.updateStmt.ExecContext(ctx, url, untl, update.Redirect, max, password, preview, shrtie.NamespaceFromContext(ctx), key)
+	if err != nil {
+		return unavailable(err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWrongKey
+	}
+
+	return nil
+}
+
+func (s Sqlite3) SaveAPIKey(ctx context.Context, key *shrtie.APIKey) error {
+	scopes := make([]string, len(key.Scopes))
+	for i, scope := range key.Scopes {
+		scopes[i] = string(scope)
+	}
+
+	_, err := s.saveKeyStmt.ExecContext(ctx, key.ID, key.Hash, strings.Join(scopes, ","), key.Namespace, key.Created.Unix())
+	return conflict(err, sqlite3.ErrConstraintPrimaryKey)
+}
+
+func (s Sqlite3) APIKey(ctx context.Context, id string) (*shrtie.APIKey, error) {
+	key := &shrtie.APIKey{ID: id}
+	var scopes string
+	var created int64
+
+	if err := s.apiKeyStmt.QueryRowContext(ctx, id).Scan(&key.Hash, &scopes, &key.Namespace, &created); err != nil {
+		return nil, unavailable(err)
+	}
+
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope != "" {
+			key.Scopes = append(key.Scopes, shrtie.Scope(scope))
+		}
+	}
+	key.Created = time.Unix(created, 0).UTC()
+
+	return key, nil
+}
+
+func (s Sqlite3) RevokeAPIKey(ctx context.Context, id string) error {
+	res, err := s.revokeKeyStmt.ExecContext(ctx, id)
+	if err != nil {
+		return unavailable(err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWrongKey
+	}
+
+	return nil
+}
+
+// Find returns the longest living link to url.
+func (s Sqlite3) Find(ctx context.Context, url string) (string, *shrtie.Link, error) {
+	var key string
+	var until int64
+	var redirect int
+	var max int64
+	var password string
+	var preview bool
+	err := s.findStmt.QueryRowContext(ctx, shrtie.NamespaceFromContext(ctx), url, time.Now().Unix()).Scan(&key, &until, &redirect, &max, &password, &preview)
+	if err != nil {
+		return "", nil, unavailable(err)
+	}
+
+	ttl, err := remaining(until)
+	if err != nil {
+		return "", nil, ErrWrongKey
+	}
+
+	return key, &shrtie.Link{
+		URL:       url,
+		TTL:       ttl,
+		Redirect:  redirect,
+		MaxClicks: max,
+		Password:  password,
+		Preview:   preview,
+	}, nil
+}
+
+// WriteClicks stores clicks in the shrtie_click table.
+func (s Sqlite3) WriteClicks(ctx context.Context, clicks []shrtie.Click) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return unavailable(err)
+	}
+
+	stmt := tx.StmtContext(ctx, s.clickStmt)
+	for _, c := range clicks {
+		_, err = stmt.ExecContext(ctx, c.Namespace, c.Key, c.Time.Unix(), c.Referrer, c.UserAgent, c.Language, c.IP)
+		if err != nil {
+			tx.Rollback()
+			return unavailable(err)
+		}
+	}
+
+	return unavailable(tx.Commit())
+}
+
+// Stats aggregates the clicks written by WriteClicks.
+func (s Sqlite3) Stats(ctx context.Context, key string, interval shrtie.Interval, from, to time.Time) (*shrtie.Stats, error) {
+	stats, err := shrtie.NewStats(key, interval, from, to)
 	if err != nil {
 		return nil, err
 	}
-	log.Println(id)
 
+	start, end := stats.From.Unix(), stats.To.Unix()
+	ns := shrtie.NamespaceFromContext(ctx)
+
+	// Clicks are counted by hour, which adds up to every interval
+	rows, err := s.bucketStmt.QueryContext(ctx, ns, key, start, end)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hour, count int64
+		if err = rows.Scan(&hour, &count); err != nil {
+			return nil, unavailable(err)
+		}
+		stats.Count(time.Unix(hour, 0), count)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+
+	rows, err = s.breakdownStmt.QueryContext(ctx, ns, key, start, end)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var referrer, userAgent, language string
+		var count int64
+		if err = rows.Scan(&referrer, &userAgent, &language, &count); err != nil {
+			return nil, unavailable(err)
+		}
+		stats.Breakdown(referrer, userAgent, language, count)
+	}
+
+	return stats, unavailable(rows.Err())
+}
+
+func (s Sqlite3) Info(key string) (*shrtie.Metadata, error) {
+	return s.InfoContext(context.Background(), key)
+}
+
+func (s Sqlite3) InfoContext(ctx context.Context, key string) (*shrtie.Metadata, error) {
 	var meta = &shrtie.Metadata{}
 	var until, created int64
-	err = s.infoStmt.QueryRow(id).Scan(&meta.URL, &until, &meta.Clicked, &created)
-
-	log.Println(err)
-	log.Println(meta, until, created)
+	err := s.infoStmt.QueryRowContext(ctx, shrtie.NamespaceFromContext(ctx), key).Scan(&meta.URL, &until, &meta.Redirect, &meta.MaxClicks, &meta.Clicked, &meta.Password, &meta.Preview, &created)
+	if err != nil {
+		return nil, unavailable(err)
+	}
 
-	now := time.Now().Unix()
-	if until > 0 {
-		meta.TTL = until - now
-	} else if until == 0 {
-		meta.TTL = 0
-	} else {
-		return nil, ErrTTL
+	ttl, err := remaining(until)
+	if err != nil {
+		return nil, err
 	}
 
+	meta.TTL = shrtie.Seconds(ttl)
+	meta.Expires = shrtie.Expires(until)
 	meta.Created = time.Unix(created, 0)
+	meta.Remaining = shrtie.RemainingClicks(meta.MaxClicks, meta.Clicked)
 
 	return meta, nil
 }
 
-func toInt64(s string) (int64, error) {
-	buf, err := base64.RawURLEncoding.DecodeString(s)
+// Sweep removes up to limit links of all namespaces which expired before
+// before, after they were archived. Their clicks are kept for the stats.
+func (s Sqlite3) Sweep(ctx context.Context, before time.Time, limit int, archive shrtie.ArchiveFunc) (int, error) {
+	rows, err := s.expiredStmt.QueryContext(ctx, before.Unix(), limit)
+	if err != nil {
+		return 0, unavailable(err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var links []shrtie.ExpiredLink
+	for rows.Next() {
+		var id, until, created int64
+		var key sql.NullString
+		var link shrtie.ExpiredLink
+		err = rows.Scan(&id, &link.Namespace, &key, &link.URL, &until, &link.Redirect, &link.MaxClicks, &link.Clicked, &link.Password, &link.Preview, &created)
+		if err != nil {
+			return 0, unavailable(err)
+		}
+
+		link.Key = key.String
+		link.Expires = shrtie.Expires(until)
+		link.Created = time.Unix(created, 0)
+		link.Remaining = shrtie.RemainingClicks(link.MaxClicks, link.Clicked)
+
+		ids = append(ids, id)
+		links = append(links, link)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, unavailable(err)
+	}
+	rows.Close()
+
+	if len(links) == 0 {
+		return 0, nil
+	}
+
+	if archive != nil {
+		if err = archive(ctx, links); err != nil {
+			return 0, err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, unavailable(err)
+	}
+
+	// Links updated in the meantime are kept, the clicks of swept ones go
+	var n int64
+	stmt, clicks := tx.StmtContext(ctx, s.sweepStmt), tx.StmtContext(ctx, s.clearStmt)
+	for i, id := range ids {
+		res, err := stmt.ExecContext(ctx, id, before.Unix())
+		if err != nil {
+			tx.Rollback()
+			return 0, unavailable(err)
+		}
+
+		if deleted, _ := res.RowsAffected(); deleted != 0 {
+			if _, err = clicks.ExecContext(ctx, links[i].Namespace, links[i].Key); err != nil {
+				tx.Rollback()
+				return 0, unavailable(err)
+			}
+			n += deleted
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, unavailable(err)
+	}
+
+	return int(n), nil
+}
+
+// hostExpr extracts the host of the normalized target URLs
+const hostExpr = `substr(url, instr(url, '://') + 3, instr(substr(url, instr(url, '://') + 3) || '/', '/') - 1)`
+
+// sortColumns are the columns of the sorts of List
+var sortColumns = map[shrtie.Sort]string{
+	shrtie.SortCreated: "created",
+	shrtie.SortClicks:  "count",
+}
+
+// List returns a page of the links of the namespace, expired ones included. Pages are read
+// with keyset pagination on the indexed sort column, unsorted lists are
+// ordered by key.
+func (s Sqlite3) List(ctx context.Context, opts shrtie.ListOptions) (*shrtie.ListPage, error) {
+	cursor, err := shrtie.ParseCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	// The filters are optional, so the query is built per request
+	where := []string{"namespace = ?", "key IS NOT NULL"}
+	args := []interface{}{shrtie.NamespaceFromContext(ctx)}
+
+	if !opts.From.IsZero() {
+		where = append(where, "created >= ?")
+		args = append(args, opts.From.Unix())
+	}
+	if !opts.To.IsZero() {
+		where = append(where, "created < ?")
+		args = append(args, opts.To.Unix())
+	}
+
+	const active = "(until = 0 OR until > ?) AND (max_clicks = 0 OR count < max_clicks)"
+	switch opts.State {
+	case shrtie.Active:
+		where = append(where, active)
+		args = append(args, time.Now().Unix())
+	case shrtie.Expired:
+		where = append(where, "NOT ("+active+")")
+		args = append(args, time.Now().Unix())
+	}
+
+	if opts.Host != "" {
+		where = append(where, "instr(lower("+hostExpr+"), lower(?)) > 0")
+		args = append(args, opts.Host)
+	}
+
+	// Descending by the sort column, ascending by key like shrtie.Paginate
+	order := "key"
+	if column, ok := sortColumns[opts.Sort]; ok {
+		order = column + " DESC, key"
+		if opts.Cursor != "" {
+			where = append(where, "("+column+" < ? OR "+column+" = ? AND key > ?)")
+			args = append(args, cursor.Value, cursor.Value, cursor.Key)
+		}
+	} else if opts.Cursor != "" {
+		where = append(where, "key > ?")
+		args = append(args, cursor.Key)
+	}
+
+	// One more link tells if there is a next page
+	limit := opts.PageLimit()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT key, url, until, redirect, max_clicks, count, password, preview, created FROM shrtie_url
+			WHERE `+strings.Join(where, " AND ")+` ORDER BY `+order+` LIMIT ?;
+	`, append(args, limit+1)...)
 	if err != nil {
-		return 0, ErrWrongKey
+		return nil, unavailable(err)
+	}
+	defer rows.Close()
+
+	page := &shrtie.ListPage{}
+	for rows.Next() {
+		var link shrtie.ListEntry
+		var until, created int64
+		err = rows.Scan(&link.Key, &link.URL, &until, &link.Redirect, &link.MaxClicks, &link.Clicked, &link.Password, &link.Preview, &created)
+		if err != nil {
+			return nil, unavailable(err)
+		}
+
+		ttl, _ := remaining(until)
+		link.TTL = shrtie.Seconds(ttl)
+		link.Expires = shrtie.Expires(until)
+		link.Created = time.Unix(created, 0)
+		link.Remaining = shrtie.RemainingClicks(link.MaxClicks, link.Clicked)
+		page.Links = append(page.Links, link)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, unavailable(err)
 	}
 
-	id, _ := binary.Varint(buf)
+	if len(page.Links) > limit {
+		page.Links = page.Links[:limit]
+		last := page.Links[limit-1]
+		page.Cursor = shrtie.Cursor{Value: opts.Sort.SortValue(&last.Metadata), Key: last.Key}.String()
+	}
 
-	return id, nil
+	return page, nil
+}
+
+// until returns the unix timestamp the ttl ends, 0 means forever
+func until(now time.Time, ttl time.Duration) int64 {
+	if ttl == 0 {
+		return 0
+	}
+
+	return now.Add(ttl).Unix()
+}
+
+// remaining returns the remaining time to life of the until timestamp
+func remaining(until int64) (time.Duration, error) {
+	if until == 0 {
+		return 0, nil
+	}
+
+	ttl := time.Unix(until, 0).Sub(time.Now())
+	if ttl <= 0 {
+		return 0, ErrTTL
+	}
+
+	return ttl, nil
+}
+
+// unavailable maps errors of database/sql to shrtie errors
+func unavailable(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case sql.ErrNoRows:
+		return ErrWrongKey
+	}
+
+	return shrtie.ErrUnavailable
+}
+
+// conflict returns shrtie.ErrConflict if err violates the constraint of
+// code, like unavailable otherwise
+func conflict(err error, code sqlite3.ErrNoExtended) error {
+	if e, ok := err.(sqlite3.Error); ok && e.ExtendedCode == code {
+		return shrtie.ErrConflict
+	}
+
+	return unavailable(err)
 }
 
 func (s *Sqlite3) prepare(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS shrtie_url (
+	// Databases of older versions are upgraded first
+	err := migrate(db)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS shrtie_url_url ON shrtie_url(namespace, url);
+		CREATE INDEX IF NOT EXISTS shrtie_url_created ON shrtie_url(namespace, created, key);
+		CREATE INDEX IF NOT EXISTS shrtie_url_count ON shrtie_url(namespace, count, key);
+		CREATE INDEX IF NOT EXISTS shrtie_url_until ON shrtie_url(until);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS shrtie_click (
 			id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
-			url TEXT NOT NULL,
-			until INTEGER NOT NULL,
-			count INTEGER DEFAULT 0 NOT NULL,
+			namespace TEXT DEFAULT '' NOT NULL,
+			key TEXT NOT NULL,
+			clicked INTEGER NOT NULL,
+			referrer TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			language TEXT NOT NULL,
+			ip TEXT NOT NULL);
+		CREATE INDEX IF NOT EXISTS shrtie_click_key ON shrtie_click(namespace, key, clicked);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS shrtie_key (
+			id TEXT PRIMARY KEY NOT NULL,
+			hash TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			namespace TEXT DEFAULT '' NOT NULL,
 			created INTEGER NOT NULL);
 	`)
 	if err != nil {
@@ -129,27 +713,145 @@ func (s *Sqlite3) prepare(db *sql.DB) error {
 	}
 
 	s.insertStmt, err = db.Prepare(`
-		INSERT INTO shrtie_url(url, until, created) VALUES (?,?,?);
+		INSERT INTO shrtie_url(namespace, key, url, until, redirect, max_clicks, password, preview, created) VALUES (?,?,?,?,?,?,?,?,?);
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.keyStmt, err = db.Prepare(`
+		UPDATE shrtie_url SET key = ? WHERE id = ?;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.removeStmt, err = db.Prepare(`
+		DELETE FROM shrtie_url WHERE id = ?;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.updateStmt, err = db.Prepare(`
+		UPDATE shrtie_url SET url = COALESCE(?, url), until = COALESCE(?, until),
+			redirect = COALESCE(NULLIF(?, 0), redirect),
+			max_clicks = COALESCE(?, max_clicks),
+			password = COALESCE(?, password),
+			preview = COALESCE(?, preview)
+			WHERE namespace = ? AND key = ?;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.deleteStmt, err = db.Prepare(`
+		DELETE FROM shrtie_url WHERE namespace = ? AND key = ?;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.findStmt, err = db.Prepare(`
+		SELECT key, until, redirect, max_clicks, password, preview FROM shrtie_url
+			WHERE namespace = ? AND url = ? AND key IS NOT NULL AND (until = 0 OR until > ?)
+			ORDER BY until = 0 DESC, until DESC LIMIT 1;
 	`)
 	if err != nil {
 		return err
 	}
 
 	s.incrStmt, err = db.Prepare(`
-		UPDATE shrtie_url SET count = count + 1 WHERE id = ?;
+		UPDATE shrtie_url SET count = count + 1
+			WHERE namespace = ? AND key = ? AND (max_clicks = 0 OR count < max_clicks);
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.addClicksStmt, err = db.Prepare(`
+		UPDATE shrtie_url SET count = count + ? WHERE namespace = ? AND key = ?;
 	`)
 	if err != nil {
 		return err
 	}
 
 	s.getStmt, err = db.Prepare(`
-		SELECT url, until FROM shrtie_url
-			WHERE id = ?;
+		SELECT url, until, redirect, max_clicks, count, password, preview FROM shrtie_url
+			WHERE namespace = ? AND key = ?;
 	`)
 
 	s.infoStmt, err = db.Prepare(`
-		SELECT url, until, count, created FROM shrtie_url
-			WHERE id = ?;
+		SELECT url, until, redirect, max_clicks, count, password, preview, created FROM shrtie_url
+			WHERE namespace = ? AND key = ?;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.clickStmt, err = db.Prepare(`
+		INSERT INTO shrtie_click(namespace, key, clicked, referrer, user_agent, language, ip) VALUES (?,?,?,?,?,?,?);
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.bucketStmt, err = db.Prepare(`
+		SELECT clicked - clicked % 3600, count(*) FROM shrtie_click
+			WHERE namespace = ? AND key = ? AND clicked >= ? AND clicked < ?
+			GROUP BY 1;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.breakdownStmt, err = db.Prepare(`
+		SELECT referrer, user_agent, language, count(*) FROM shrtie_click
+			WHERE namespace = ? AND key = ? AND clicked >= ? AND clicked < ?
+			GROUP BY 1, 2, 3;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.saveKeyStmt, err = db.Prepare(`
+		INSERT INTO shrtie_key(id, hash, scopes, namespace, created) VALUES (?,?,?,?,?);
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.apiKeyStmt, err = db.Prepare(`
+		SELECT hash, scopes, namespace, created FROM shrtie_key WHERE id = ?;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.revokeKeyStmt, err = db.Prepare(`
+		DELETE FROM shrtie_key WHERE id = ?;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.expiredStmt, err = db.Prepare(`
+		SELECT id, namespace, key, url, until, redirect, max_clicks, count, password, preview, created FROM shrtie_url
+			WHERE until != 0 AND until < ? ORDER BY until LIMIT ?;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.sweepStmt, err = db.Prepare(`
+		DELETE FROM shrtie_url WHERE id = ? AND until != 0 AND until < ?;
+	`)
+	if err != nil {
+		return err
+	}
+
+	s.clearStmt, err = db.Prepare(`
+		DELETE FROM shrtie_click WHERE namespace = ? AND key = ?;
 	`)
 	if err != nil {
 		return err
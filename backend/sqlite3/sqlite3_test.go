@@ -0,0 +1,224 @@
+package slqlite3
+
+import (
+	"database/sql"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/realfake/shrtie"
+	"github.com/realfake/shrtie/shrtietest"
+)
+
+func factory(opts ...Option) shrtietest.Factory {
+	return func(t *testing.T) shrtie.Backend {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every connection would open its own in-memory database
+		db.SetMaxOpenConns(1)
+
+		b, err := New(db, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return b
+	}
+}
+
+func TestConformance(t *testing.T) {
+	shrtietest.RunBackendTests(t, factory())
+}
+
+func TestConformanceRandomKeys(t *testing.T) {
+	shrtietest.RunBackendTests(t, factory(WithKeyGenerator(shrtie.Random{Length: 4})))
+}
+
+func TestWriteClicks(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	b, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	clicks := []shrtie.Click{
+		{Time: now, Key: "abc", Referrer: "https://there.com/", UserAgent: "test", Language: "en", IP: "127.0.0.0"},
+		{Time: now, Key: "def"},
+	}
+
+	if err = b.(Sqlite3).WriteClicks(context.Background(), clicks); err != nil {
+		t.Fatal("WriteClicks failed:", err)
+	}
+
+	var key, referrer, ip string
+	var clicked int64
+	err = db.QueryRow(`SELECT key, clicked, referrer, ip FROM shrtie_click ORDER BY id LIMIT 1`).Scan(&key, &clicked, &referrer, &ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != "abc" || clicked != now.Unix() || referrer != "https://there.com/" || ip != "127.0.0.0" {
+		t.Error("Wrong click stored:", key, clicked, referrer, ip)
+	}
+}
+
+func TestSaveAliasUnavailable(t *testing.T) {
+	b := factory()(t).(Sqlite3)
+	ctx := context.Background()
+
+	if err := b.SaveAlias(ctx, "taken", &shrtie.Link{URL: "https://example.com"}); err != nil {
+		t.Fatal("SaveAlias failed:", err)
+	}
+	if err := b.SaveAlias(ctx, "taken", &shrtie.Link{URL: "https://example.com"}); err != shrtie.ErrConflict {
+		t.Error("Expected ErrConflict got:", err)
+	}
+
+	// Only taken keys are conflicts
+	b.db.Close()
+	if err := b.SaveAlias(ctx, "free", &shrtie.Link{URL: "https://example.com"}); err != shrtie.ErrUnavailable {
+		t.Error("Expected ErrUnavailable got:", err)
+	}
+	if _, err := b.Save(ctx, &shrtie.Link{URL: "https://example.com"}); err != shrtie.ErrUnavailable {
+		t.Error("Expected ErrUnavailable got:", err)
+	}
+}
+
+func TestSaveAPIKeyUnavailable(t *testing.T) {
+	b := factory()(t).(Sqlite3)
+	ctx := context.Background()
+	key := &shrtie.APIKey{ID: "id", Hash: "hash", Created: time.Now()}
+
+	if err := b.SaveAPIKey(ctx, key); err != nil {
+		t.Fatal("SaveAPIKey failed:", err)
+	}
+	if err := b.SaveAPIKey(ctx, key); err != shrtie.ErrConflict {
+		t.Error("Expected ErrConflict got:", err)
+	}
+
+	b.db.Close()
+	key.ID = "other"
+	if err := b.SaveAPIKey(ctx, key); err != shrtie.ErrUnavailable {
+		t.Error("Expected ErrUnavailable got:", err)
+	}
+}
+
+func TestSweepClicks(t *testing.T) {
+	b := factory()(t).(Sqlite3)
+	ctx := context.Background()
+
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://example.com", TTL: time.Minute})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	if err = b.WriteClicks(ctx, []shrtie.Click{{Time: time.Now(), Key: key}}); err != nil {
+		t.Fatal("WriteClicks failed:", err)
+	}
+
+	if n, err := b.Sweep(ctx, time.Now().Add(time.Hour), 10, nil); err != nil || n != 1 {
+		t.Fatal("Expected 1 removed link got:", n, err)
+	}
+
+	var clicks int
+	if err = b.db.QueryRow(`SELECT count(*) FROM shrtie_click`).Scan(&clicks); err != nil || clicks != 0 {
+		t.Error("Clicks of the swept link kept:", clicks, err)
+	}
+}
+
+func TestMissedClick(t *testing.T) {
+	b := factory()(t).(Sqlite3)
+	ctx := context.Background()
+
+	// Clicks on links exhausted since they were peeked
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://example.com", MaxClicks: 1})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+	if _, err = b.Get(ctx, key); err != nil {
+		t.Fatal("Get failed:", err)
+	}
+	if err = b.missed(ctx, key); err != shrtie.ErrExhausted {
+		t.Error("Expected ErrExhausted got:", err)
+	}
+
+	// Clicks on links deleted since they were peeked
+	if err = b.Delete(ctx, key); err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+	if err = b.missed(ctx, key); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound got:", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	// Schema and links of the first release
+	now := time.Now().Unix()
+	_, err = db.Exec(`
+		CREATE TABLE shrtie_url (
+			id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			url TEXT NOT NULL,
+			until INTEGER NOT NULL,
+			count INTEGER DEFAULT 0 NOT NULL,
+			created INTEGER NOT NULL);
+		INSERT INTO shrtie_url(url, until, count, created) VALUES ('https://here.com', 0, 3, ?);
+		INSERT INTO shrtie_url(url, until, count, created) VALUES ('https://there.com', ?, 0, ?);
+	`, now, now+3600, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := New(db)
+	if err != nil {
+		t.Fatal("Failed to open old database:", err)
+	}
+
+	ctx := context.Background()
+	for id, url := range map[int64]string{1: "https://here.com", 2: "https://there.com"} {
+		key, _ := shrtie.Sequential{}.Key(id)
+		link, err := b.Get(ctx, key)
+		if err != nil || link.URL != url {
+			t.Errorf("Wrong link for old key %s: %v %v", key, link, err)
+		}
+	}
+
+	key, _ := shrtie.Sequential{}.Key(1)
+	if meta, err := b.(Sqlite3).InfoContext(ctx, key); err != nil || meta.Clicked != 4 {
+		t.Error("Wrong info of old link:", meta, err)
+	}
+
+	// New links continue after the old ones
+	key, err = b.Save(ctx, &shrtie.Link{URL: "https://new.com"})
+	if expected, _ := (shrtie.Sequential{}).Key(3); err != nil || key != expected {
+		t.Error("Wrong key of new link:", key, err)
+	}
+
+	if err = b.(Sqlite3).SaveAlias(ctx, key, &shrtie.Link{URL: "https://taken.com"}); err != shrtie.ErrConflict {
+		t.Error("Expected ErrConflict for taken key got:", err)
+	}
+
+	// Migrated databases are opened as they are
+	if _, err = New(db); err != nil {
+		t.Fatal("Failed to reopen database:", err)
+	}
+
+	var version int
+	if err = db.QueryRow(`PRAGMA user_version;`).Scan(&version); err != nil || version != len(migrations) {
+		t.Error("Wrong schema version:", version, err)
+	}
+}
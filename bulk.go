@@ -0,0 +1,306 @@
+package shrtie
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	// maxBulkEntries limits the entries of a BulkSaveHandler request
+	maxBulkEntries = 10000
+
+	// maxBulkLine limits the size of a NDJSON line
+	maxBulkLine = 64 * 1024
+
+	// maxBulkBody limits the size of a BulkSaveHandler request, it leaves
+	// about 3KB per entry
+	maxBulkBody = 32 << 20
+
+	defaultBulkConcurrency = 8
+)
+
+// BulkResult is the result of an Entry posted to BulkSaveHandler, either URL
+// or Error is set.
+type BulkResult struct {
+	URL    string `json:"url,omitempty"`    // The shortened URL
+	Reused bool   `json:"reused,omitempty"` // An existing link to the same URL was returned, see WithDeduplication
+	Status int    `json:"status"`           // Status code SaveHandler would have answered the entry with
+	Error  string `json:"error,omitempty"`  // Reason the entry was rejected
+
+	key string
+}
+
+// bulkItem is a posted entry or the error it was read with
+type bulkItem struct {
+	entry Entry
+	err   error
+}
+
+// WithBulkConcurrency limits how many entries of a BulkSaveHandler request
+// are processed at once. Defaults to 8.
+func WithBulkConcurrency(n int) Option {
+	if n < 1 {
+		log.Panicln("Invalid bulk concurrency", n)
+	}
+
+	return func(s *Shrtie) {
+		s.concurrency = n
+	}
+}
+
+// BulkSaveHandler saves many entries at once. It accepts a JSON array of
+// Entry or one Entry per line with the content type application/x-ndjson
+// and answers a BulkResult for every entry, in the same format and order.
+// Entries are validated like by SaveHandler, a rejected entry doesn't stop
+// the others. The short URLs are built like by QRHandler with base as path
+// RedirectHandler is routed at. Links are saved at once if the backend
+// implements BulkSaver.
+func (s Shrtie) BulkSaveHandler(base string) Handler {
+	return s.authorize(ScopeCreate, Handler{
+		f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+			defer r.Body.Close()
+
+			// Larger bodies are cut off before they fill the memory
+			body := &limitedReader{r: r.Body, n: maxBulkBody}
+
+			var items []bulkItem
+			var err error
+			ndjson := r.Header.Get("Content-Type") == "application/x-ndjson"
+			switch {
+			case ndjson:
+				items, err = readBulkNDJSON(body)
+			case r.Header.Get("Content-Type") == "application/json":
+				items, err = readBulkJSON(body)
+			default:
+				err = &requestError{http.StatusBadRequest, "Wrong application"}
+			}
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+
+			// The results are written once the body is read, HTTP/1 doesn't
+			// allow reading the body after the response started
+			results := s.saveAll(ctx, items)
+			for i := range results {
+				if results[i].key != "" {
+					results[i].URL = shortURL(r, ctx, base, results[i].key)
+				}
+			}
+
+			if !ndjson {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(results)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			encoder := json.NewEncoder(w)
+			for _, result := range results {
+				encoder.Encode(result)
+			}
+			return
+		},
+	})
+}
+
+// errTooManyEntries is returned for requests exceeding maxBulkEntries
+var errTooManyEntries = &requestError{http.StatusRequestEntityTooLarge, "Too many entries"}
+
+// readBulkNDJSON reads one entry per line, so a bad line only fails its
+// entry
+func readBulkNDJSON(body io.Reader) ([]bulkItem, error) {
+	var items []bulkItem
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 4096), maxBulkLine)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		if len(items) == maxBulkEntries {
+			return nil, errTooManyEntries
+		}
+
+		var item bulkItem
+		if err := json.Unmarshal(line, &item.entry); err != nil {
+			item.err = &requestError{http.StatusBadRequest, "Bad Data"}
+		}
+		items = append(items, item)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, bulkReadError(err)
+	}
+
+	return items, nil
+}
+
+// readBulkJSON reads a JSON array of entries. They are decoded one by one,
+// so the request is rejected as soon as there are too many.
+func readBulkJSON(body io.Reader) ([]bulkItem, error) {
+	decoder := json.NewDecoder(body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, bulkReadError(err)
+	}
+
+	var items []bulkItem
+	for decoder.More() {
+		if len(items) == maxBulkEntries {
+			return nil, errTooManyEntries
+		}
+
+		var item bulkItem
+		if err := decoder.Decode(&item.entry); err != nil {
+			return nil, bulkReadError(err)
+		}
+		items = append(items, item)
+	}
+
+	// The closing bracket
+	if _, err := decoder.Token(); err != nil {
+		return nil, bulkReadError(err)
+	}
+
+	return items, nil
+}
+
+// bulkReadError returns the error a body which couldn't be read is
+// answered with
+func bulkReadError(err error) error {
+	if err == errBodyTooLarge {
+		return err
+	}
+
+	return &requestError{http.StatusBadRequest, "Bad Data"}
+}
+
+// errBodyTooLarge is returned for requests exceeding maxBulkBody
+var errBodyTooLarge = &requestError{http.StatusRequestEntityTooLarge, "Request too large"}
+
+// limitedReader reads n bytes of r at most and fails with errBodyTooLarge
+// if more follow, unlike io.LimitReader which ends silently
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n == 0 {
+		// Only the end of the body may follow
+		n, err := l.r.Read(make([]byte, 1))
+		if n != 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// saveAll saves the entries of items and returns their results, the URL is
+// left to the caller. Validation hashes passwords, aliases and deduplication
+// ask the backend, so entries are processed concurrently. The remaining
+// links are left to the BulkSaver of the backend if there is one.
+func (s Shrtie) saveAll(ctx context.Context, items []bulkItem) []BulkResult {
+	results := make([]BulkResult, len(items))
+	links := make([]*Link, len(items))
+	bulk, ok := s.inner.(BulkSaver)
+
+	s.parallel(len(items), func(i int) {
+		if items[i].err != nil {
+			results[i] = bulkResult("", false, items[i].err)
+			return
+		}
+
+		link, err := s.newLink(items[i].entry)
+		if err != nil {
+			results[i] = bulkResult("", false, err)
+			return
+		}
+
+		if !ok || items[i].entry.Alias != "" {
+			results[i] = bulkResult(s.store(ctx, items[i].entry, link))
+			return
+		}
+
+		if s.deduplicate {
+			if key, reused := s.reuse(ctx, link); reused {
+				results[i] = bulkResult(key, true, nil)
+				return
+			}
+		}
+
+		links[i] = link
+	})
+
+	if !ok {
+		return results
+	}
+
+	var pending []int
+	var batch []*Link
+	for i, link := range links {
+		if link != nil {
+			pending = append(pending, i)
+			batch = append(batch, link)
+		}
+	}
+
+	if len(batch) == 0 {
+		return results
+	}
+
+	keys, errs := bulk.SaveAll(ctx, batch)
+	for j, i := range pending {
+		results[i] = bulkResult(keys[j], false, errs[j])
+		if errs[j] == nil {
+			s.forget(ctx, keys[j])
+		}
+	}
+
+	return results
+}
+
+// parallel calls f with 0 to n-1, at most s.concurrency calls run at once
+func (s Shrtie) parallel(n int, f func(int)) {
+	sem := make(chan struct{}, s.concurrency)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// bulkResult returns the result of an entry
+func bulkResult(key string, reused bool, err error) BulkResult {
+	if err != nil {
+		code, message := errorStatus(err)
+		return BulkResult{Status: code, Error: message}
+	}
+
+	return BulkResult{Reused: reused, Status: http.StatusOK, key: key}
+}
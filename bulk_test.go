@@ -0,0 +1,199 @@
+package shrtie
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// testBulkBackend records the links saved with SaveAll
+type testBulkBackend struct {
+	testBackend
+	mu    *sync.Mutex
+	saved *[][]*Link
+}
+
+func (b testBulkBackend) SaveAll(ctx context.Context, links []*Link) ([]string, []error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	*b.saved = append(*b.saved, links)
+
+	keys := make([]string, len(links))
+	errs := make([]error, len(links))
+	for i, link := range links {
+		keys[i], errs[i] = b.Save(ctx, link)
+	}
+	return keys, errs
+}
+
+func bulkRequest(handler Handler, contentType, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "http://example.com/s/bulk", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	res := httptest.NewRecorder()
+	handler.f(res, req, context.Background())
+	return res
+}
+
+var bulkEntries = []struct {
+	entry  string
+	status int
+}{
+	{entry: `{"url":"http://here.com"}`, status: http.StatusOK},
+	{entry: `{"url":"javascript:alert(1)"}`, status: http.StatusBadRequest},
+	{entry: `{"url":"http://too.long"}`, status: http.StatusRequestEntityTooLarge},
+	{entry: `{"url":"http://here.com","alias":"abc"}`, status: http.StatusConflict},
+	{entry: `{"url":"http://here.com","alias":"new"}`, status: http.StatusOK},
+	{entry: `{"url":"http://down.com"}`, status: http.StatusServiceUnavailable},
+}
+
+func TestBulkSaveHandler(t *testing.T) {
+	var entries []string
+	for _, e := range bulkEntries {
+		entries = append(entries, e.entry)
+	}
+
+	res := bulkRequest(New(tb).BulkSaveHandler("/s/"), "application/json", "["+strings.Join(entries, ",")+"]")
+	if res.Code != http.StatusOK {
+		t.Fatal("Expected 200 got:", res.Code)
+	}
+
+	var results []BulkResult
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(bulkEntries) {
+		t.Fatal("Wrong number of results:", len(results))
+	}
+
+	for i, result := range results {
+		if result.Status != bulkEntries[i].status {
+			t.Errorf("%s: expected %d got %d", bulkEntries[i].entry, bulkEntries[i].status, result.Status)
+		}
+		if (result.Status == http.StatusOK) == (result.Error != "") {
+			t.Errorf("%s: wrong result %v", bulkEntries[i].entry, result)
+		}
+	}
+
+	if results[0].URL != "http://example.com/s/abc" || results[4].URL != "http://example.com/s/new" {
+		t.Error("Wrong URLs:", results[0].URL, results[4].URL)
+	}
+}
+
+func TestBulkSaveHandlerNDJSON(t *testing.T) {
+	body := `{"url":"http://here.com"}
+
+{"url":
+{"url":"http://down.com"}
+`
+
+	res := bulkRequest(New(tb).BulkSaveHandler("/s/"), "application/x-ndjson", body)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatal("Expected NDJSON got:", res.Code, res.Header().Get("Content-Type"))
+	}
+
+	// Empty lines are skipped, bad ones only fail their entry
+	expected := []int{http.StatusOK, http.StatusBadRequest, http.StatusServiceUnavailable}
+	scanner := bufio.NewScanner(res.Body)
+	var i int
+	for ; scanner.Scan(); i++ {
+		var result BulkResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+
+		if i < len(expected) && result.Status != expected[i] {
+			t.Errorf("Line %d: expected %d got %d", i, expected[i], result.Status)
+		}
+	}
+
+	if i != len(expected) {
+		t.Error("Wrong number of results:", i)
+	}
+}
+
+func TestBulkSaveHandlerBulkSaver(t *testing.T) {
+	var saved [][]*Link
+	b := testBulkBackend{mu: &sync.Mutex{}, saved: &saved}
+	handler := New(b, WithBulkConcurrency(2)).BulkSaveHandler("/s/")
+
+	body := `[{"url":"http://here.com"},{"url":"http://here.com","alias":"new"},{"url":"http://there.com"},{"url":"ftp://there.com"}]`
+	res := bulkRequest(handler, "application/json", body)
+
+	var results []BulkResult
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+
+	// Aliases and rejected entries don't reach SaveAll
+	if len(saved) != 1 || len(saved[0]) != 2 || saved[0][0].URL != "http://here.com/" || saved[0][1].URL != "http://there.com/" {
+		t.Fatal("Wrong links saved at once:", saved)
+	}
+
+	for i, status := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusBadRequest} {
+		if results[i].Status != status {
+			t.Errorf("Entry %d: expected %d got %d", i, status, results[i].Status)
+		}
+	}
+}
+
+func TestBulkSaveHandlerBadRequest(t *testing.T) {
+	handler := New(tb).BulkSaveHandler("/s/")
+
+	if res := bulkRequest(handler, "text/plain", `[]`); res.Code != http.StatusBadRequest {
+		t.Error("Wrong content type accepted:", res.Code)
+	}
+
+	if res := bulkRequest(handler, "application/json", `{"url":"http://here.com"}`); res.Code != http.StatusBadRequest {
+		t.Error("Object accepted:", res.Code)
+	}
+
+	body := "[" + strings.Repeat(`{"url":"http://here.com"},`, maxBulkEntries) + `{"url":"http://here.com"}]`
+	if res := bulkRequest(handler, "application/json", body); res.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Too many entries accepted:", res.Code)
+	}
+
+	// Reading stops at the first entry too many
+	body = "[" + strings.Repeat(`{"url":"http://here.com"},`, maxBulkEntries+1) + `broken`
+	if res := bulkRequest(handler, "application/json", body); res.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Too many entries weren't rejected early:", res.Code)
+	}
+
+	padding := strings.Repeat(" ", maxBulkBody)
+	if res := bulkRequest(handler, "application/json", "["+padding+"]"); res.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Too large JSON body accepted:", res.Code)
+	}
+
+	lines := strings.Repeat("\n", maxBulkBody)
+	if res := bulkRequest(handler, "application/x-ndjson", lines+`{"url":"http://here.com"}`); res.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Too large NDJSON body accepted:", res.Code)
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	// Bodies of exactly the limit are fine
+	if body, err := ioutil.ReadAll(&limitedReader{r: strings.NewReader("abc"), n: 3}); err != nil || string(body) != "abc" {
+		t.Error("Body of the limit not read:", string(body), err)
+	}
+
+	if _, err := ioutil.ReadAll(&limitedReader{r: strings.NewReader("abcd"), n: 3}); err != errBodyTooLarge {
+		t.Error("Expected errBodyTooLarge got:", err)
+	}
+}
+
+func TestWithBulkConcurrency(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic for invalid concurrency")
+		}
+	}()
+
+	WithBulkConcurrency(0)
+}
@@ -0,0 +1,370 @@
+package shrtie
+
+import (
+	"container/list"
+	"golang.org/x/net/context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Defaults of NewCache
+const (
+	defaultCacheSize        = 10000
+	defaultCacheTTL         = time.Minute
+	defaultCacheNegativeTTL = 5 * time.Second
+)
+
+// Cache keeps recently used links of a backend in memory, so redirects to
+// hot links don't reach the backend. Clicks of cached links are queued with
+// the BufferedCounter wrapped by the cache, or with one of its own if it
+// wraps none, links with a click limit are never cached. Peek serves cached links without counting them, it needs a
+// backend implementing Peeker. Changes through the handlers of Shrtie drop the link from
+// the cache, changes by other processes show up after the TTL of the cache.
+type Cache struct {
+	backend  Backend
+	counter  *BufferedCounter
+	own      bool   // The counter was started by NewCache
+	peeker   Peeker // Nil if the backend doesn't implement Peeker
+	size     int
+	ttl      time.Duration
+	negative time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List               // Most recently used first
+	entries map[string]*list.Element // By namespace qualified key
+	flights map[string]*flight       // Misses waiting for the backend
+}
+
+// cacheEntry is a cached link or a cached error for missing ones
+type cacheEntry struct {
+	key     string
+	link    *Link     // TTL relative to cached
+	err     error     // Set instead of link for negative lookups
+	cached  time.Time // Time of the lookup
+	expires time.Time // Never after the link expires
+}
+
+// flight is a miss in progress, concurrent misses of the key wait for it
+type flight struct {
+	done chan struct{}
+	link *Link
+	err  error
+}
+
+// CacheOption configures a Cache
+type CacheOption func(*Cache)
+
+// CacheSize sets the number of links kept, the least recently used ones
+// are dropped first. Defaults to 10000.
+func CacheSize(n int) CacheOption {
+	if n < 1 {
+		log.Panicln("Invalid cache size", n)
+	}
+
+	return func(c *Cache) {
+		c.size = n
+	}
+}
+
+// CacheTTL sets how long links are cached at most, links expiring earlier
+// are dropped when they expire. Defaults to a minute.
+func CacheTTL(ttl time.Duration) CacheOption {
+	if ttl <= 0 {
+		log.Panicln("Invalid cache TTL", ttl)
+	}
+
+	return func(c *Cache) {
+		c.ttl = ttl
+	}
+}
+
+// CacheNegativeTTL sets how long missing, expired and exhausted links are
+// cached, zero disables it. Defaults to 5 seconds.
+func CacheNegativeTTL(ttl time.Duration) CacheOption {
+	if ttl < 0 {
+		log.Panicln("Invalid negative cache TTL", ttl)
+	}
+
+	return func(c *Cache) {
+		c.negative = ttl
+	}
+}
+
+// NewCache returns a Cache wrapping backend, pass it to New instead of the
+// backend. Unless backend is or wraps a BufferedCounter, the cache starts
+// one of its own with the default size and interval, so the backend has to
+// implement Peeker and ClickCounter, all bundled ones do. Close it on
+// shutdown then.
+func NewCache(backend Backend, opts ...CacheOption) *Cache {
+	counter, ok := findCounter(backend)
+	if !ok {
+		counter = NewBufferedCounter(backend, 0, 0)
+	}
+	peeker, _ := findPeeker(backend)
+
+	c := &Cache{
+		backend:  backend,
+		counter:  counter,
+		own:      !ok,
+		peeker:   peeker,
+		size:     defaultCacheSize,
+		ttl:      defaultCacheTTL,
+		negative: defaultCacheNegativeTTL,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		flights:  make(map[string]*flight),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Unwrap returns the cached backend
+func (c *Cache) Unwrap() Backend {
+	return c.backend
+}
+
+// Get returns the link from the cache and counts the click, or gets it from
+// the backend. Concurrent misses of a key share one call of the backend.
+func (c *Cache) Get(ctx context.Context, key string) (*Link, error) {
+	entry, f, own := c.lookup(ctx, key, c.backend.Get)
+	switch {
+	case entry != nil:
+		return c.hit(ctx, key, entry)
+	case !own:
+		return c.shared(ctx, key, f)
+	case f.err != nil:
+		return nil, f.err
+	}
+
+	return copyLink(f.link), nil
+}
+
+// Peek returns the link from the cache without counting a click, or peeks
+// it with the backend and caches it for the following Get.
+func (c *Cache) Peek(ctx context.Context, key string) (*Link, error) {
+	if c.peeker == nil {
+		log.Panicln("Backend doesn't support Peeker interface")
+	}
+
+	entry, f, _ := c.lookup(ctx, key, c.peeker.Peek)
+	if entry != nil {
+		return entry.get(time.Now())
+	}
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return copyLink(f.link), nil
+}
+
+// lookup returns the cached entry of key, or the flight of the miss after
+// it landed. Misses are looked up with fetch unless another one is in
+// progress, own reports whether the flight was started by the caller.
+func (c *Cache) lookup(ctx context.Context, key string, fetch func(context.Context, string) (*Link, error)) (entry *cacheEntry, f *flight, own bool) {
+	k := qualify(ctx, key)
+	now := time.Now()
+
+	c.mu.Lock()
+	if e, ok := c.entries[k]; ok {
+		entry := e.Value.(*cacheEntry)
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			c.mu.Unlock()
+			return entry, nil, false
+		}
+		c.remove(e)
+	}
+
+	if f, ok := c.flights[k]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return nil, f, false
+	}
+
+	f = &flight{done: make(chan struct{})}
+	c.flights[k] = f
+	c.mu.Unlock()
+
+	f.link, f.err = fetch(ctx, key)
+
+	c.mu.Lock()
+	// Links forgotten in the meantime may have changed
+	if c.flights[k] == f {
+		delete(c.flights, k)
+		c.add(k, f.link, f.err, now)
+	}
+	c.mu.Unlock()
+	close(f.done)
+
+	return nil, f, true
+}
+
+// hit returns the link of a cached entry and queues the click
+func (c *Cache) hit(ctx context.Context, key string, entry *cacheEntry) (*Link, error) {
+	if entry.err != nil {
+		return nil, entry.err
+	}
+
+	c.counter.Count(ctx, key)
+	return entry.get(time.Now())
+}
+
+// get returns a copy of the cached link with the TTL left at now, or the
+// cached error
+func (e *cacheEntry) get(now time.Time) (*Link, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	link := copyLink(e.link)
+	if link.TTL != 0 {
+		link.TTL -= now.Sub(e.cached)
+	}
+
+	return link, nil
+}
+
+// shared returns the result of the flight of another miss, the click still
+// has to be counted
+func (c *Cache) shared(ctx context.Context, key string, f *flight) (*Link, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	// The click limit is checked by the backend only
+	if f.link.MaxClicks != 0 {
+		return c.backend.Get(ctx, key)
+	}
+
+	c.counter.Count(ctx, key)
+	return copyLink(f.link), nil
+}
+
+// add caches the result of a lookup at now. The caller has to hold the lock.
+func (c *Cache) add(k string, link *Link, err error, now time.Time) {
+	entry := &cacheEntry{key: k, cached: now}
+
+	switch {
+	case err == nil && link.MaxClicks == 0:
+		entry.link = copyLink(link)
+		entry.expires = now.Add(c.ttl)
+		if link.TTL != 0 && link.TTL < c.ttl {
+			entry.expires = now.Add(link.TTL)
+		}
+	case (err == ErrNotFound || err == ErrExpired || err == ErrExhausted) && c.negative > 0:
+		entry.err = err
+		entry.expires = now.Add(c.negative)
+	default:
+		return
+	}
+
+	if e, ok := c.entries[k]; ok {
+		c.remove(e)
+	}
+	c.entries[k] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an element of the cache. The caller has to hold the lock.
+func (c *Cache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+// Forget drops the link of key in the namespace of ctx from the cache, e.g.
+// after it was changed by another process. Shrtie calls it for changes of
+// its handlers.
+func (c *Cache) Forget(ctx context.Context, key string) {
+	k := qualify(ctx, key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[k]; ok {
+		c.remove(e)
+	}
+	delete(c.flights, k)
+}
+
+// Close writes the clicks queued by the counter the cache started, a
+// BufferedCounter passed to NewCache is closed by the caller.
+func (c *Cache) Close() error {
+	if c.own {
+		return c.counter.Close()
+	}
+
+	return nil
+}
+
+// Save saves the link with the backend. A cached lookup of the new key is
+// dropped.
+func (c *Cache) Save(ctx context.Context, link *Link) (string, error) {
+	key, err := c.backend.Save(ctx, link)
+	if err != nil {
+		return "", err
+	}
+
+	c.Forget(ctx, key)
+	return key, nil
+}
+
+// findCounter returns the first BufferedCounter of backend and the backends
+// it wraps
+func findCounter(backend Backend) (*BufferedCounter, bool) {
+	for {
+		if c, ok := backend.(*BufferedCounter); ok {
+			return c, true
+		}
+
+		w, ok := backend.(Wrapper)
+		if !ok {
+			return nil, false
+		}
+		backend = w.Unwrap()
+	}
+}
+
+// findPeeker returns the first Peeker of backend and the backends it wraps
+func findPeeker(backend Backend) (Peeker, bool) {
+	for {
+		if p, ok := backend.(Peeker); ok {
+			return p, true
+		}
+
+		w, ok := backend.(Wrapper)
+		if !ok {
+			return nil, false
+		}
+		backend = w.Unwrap()
+	}
+}
+
+// copyLink returns a copy of link, cached links are shared between requests
+func copyLink(link *Link) *Link {
+	l := *link
+	return &l
+}
+
+// forget drops key from the caches wrapping the backend after a change
+func (s Shrtie) forget(ctx context.Context, key string) {
+	for backend := s.backend; ; {
+		if c, ok := backend.(*Cache); ok {
+			c.Forget(ctx, key)
+		}
+
+		w, ok := backend.(Wrapper)
+		if !ok {
+			return
+		}
+		backend = w.Unwrap()
+	}
+}
@@ -0,0 +1,282 @@
+package shrtie
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testCacheBackend counts the calls reaching it, Get blocks while block is
+// set. Clicks added with AddClicks are counted like clicks of Count.
+type testCacheBackend struct {
+	mu     sync.Mutex
+	links  map[string]*Link
+	gets   int
+	peeks  int
+	counts int
+	block  chan struct{}
+}
+
+func newTestCacheBackend() *testCacheBackend {
+	return &testCacheBackend{links: map[string]*Link{
+		"abc":     {URL: "https://example.com"},
+		"short":   {URL: "https://example.com/short", TTL: 50 * time.Millisecond},
+		"limited": {URL: "https://example.com/limited", MaxClicks: 10},
+	}}
+}
+
+func (b *testCacheBackend) Get(ctx context.Context, key string) (*Link, error) {
+	if b.block != nil {
+		<-b.block
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gets++
+	link, ok := b.links[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	l := *link
+	return &l, nil
+}
+
+func (b *testCacheBackend) Peek(ctx context.Context, key string) (*Link, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.peeks++
+	link, ok := b.links[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	l := *link
+	return &l, nil
+}
+
+func (b *testCacheBackend) Save(ctx context.Context, link *Link) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.links["new"] = link
+	return "new", nil
+}
+
+func (b *testCacheBackend) Count(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.links[key]; !ok {
+		return ErrNotFound
+	}
+	b.counts++
+	return nil
+}
+
+func (b *testCacheBackend) AddClicks(ctx context.Context, counts []ClickCount) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range counts {
+		if _, ok := b.links[c.Key]; ok {
+			b.counts += int(c.Clicks)
+		}
+	}
+	return nil
+}
+
+func (b *testCacheBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.links, key)
+	return nil
+}
+
+func (b *testCacheBackend) calls() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.gets, b.counts
+}
+
+func TestCacheHit(t *testing.T) {
+	b := newTestCacheBackend()
+	c := NewCache(b)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if link, err := c.Get(ctx, "abc"); err != nil || link.URL != "https://example.com" {
+			t.Fatal("Wrong link:", link, err)
+		}
+	}
+
+	// Hits make no calls of the backend, their clicks are queued
+	if gets, counts := b.calls(); gets != 1 || counts != 0 {
+		t.Errorf("Expected 1 get and no counts got %d and %d", gets, counts)
+	}
+
+	// The first click is counted by Get
+	c.Close()
+	if _, counts := b.calls(); counts != 2 {
+		t.Error("Expected 2 counts got:", counts)
+	}
+
+	// Namespaces are cached separately
+	c.Get(WithNamespace(ctx, "team"), "abc")
+	if gets, _ := b.calls(); gets != 2 {
+		t.Error("Link of another namespace served:", gets)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	b := newTestCacheBackend()
+	c := NewCache(b)
+	ctx := context.Background()
+
+	c.Get(ctx, "short")
+	link, err := c.Get(ctx, "short")
+	if err != nil || link.TTL <= 0 || link.TTL > 50*time.Millisecond {
+		t.Fatal("Wrong link:", link, err)
+	}
+
+	// The backend decides once the link expired
+	time.Sleep(60 * time.Millisecond)
+	c.Get(ctx, "short")
+	if gets, _ := b.calls(); gets != 2 {
+		t.Error("Expired link served from cache:", gets)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	b := newTestCacheBackend()
+	c := NewCache(b, CacheNegativeTTL(50*time.Millisecond))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(ctx, "missing"); err != ErrNotFound {
+			t.Fatal("Expected ErrNotFound got:", err)
+		}
+	}
+
+	if gets, _ := b.calls(); gets != 1 {
+		t.Error("Missing link not cached:", gets)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	c.Get(ctx, "missing")
+	if gets, _ := b.calls(); gets != 2 {
+		t.Error("Missing link cached too long:", gets)
+	}
+}
+
+func TestCacheLimited(t *testing.T) {
+	b := newTestCacheBackend()
+	c := NewCache(b)
+
+	for i := 0; i < 2; i++ {
+		c.Get(context.Background(), "limited")
+	}
+
+	if gets, counts := b.calls(); gets != 2 || counts != 0 {
+		t.Errorf("Limited link cached: %d gets and %d counts", gets, counts)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	b := newTestCacheBackend()
+	c := NewCache(b, CacheSize(1))
+	ctx := context.Background()
+
+	c.Get(ctx, "abc")
+	c.Get(ctx, "missing")
+	c.Get(ctx, "abc")
+	if gets, _ := b.calls(); gets != 3 {
+		t.Error("Least recently used link not dropped:", gets)
+	}
+}
+
+func TestCacheConcurrentMisses(t *testing.T) {
+	b := newTestCacheBackend()
+	b.block = make(chan struct{})
+	c := NewCache(b)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get(context.Background(), "abc"); err != nil {
+				t.Error("Get failed:", err)
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(b.block)
+	wg.Wait()
+	c.Close()
+
+	if gets, counts := b.calls(); gets != 1 || counts != 9 {
+		t.Errorf("Expected 1 get and 9 counts got %d and %d", gets, counts)
+	}
+}
+
+func TestCachePeek(t *testing.T) {
+	b := newTestCacheBackend()
+	c := NewCache(b)
+	handler := New(c, WithPasswords()).RedirectHandler()
+
+	// Protected links are looked at through the cache
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/abc", nil)
+		res := httptest.NewRecorder()
+		handler.f(res, req, context.WithValue(context.Background(), "id", "abc"))
+		if res.Code != http.StatusMovedPermanently {
+			t.Fatal("Expected 301 got:", res.Code)
+		}
+	}
+
+	// Peek doesn't count
+	if link, err := c.Peek(context.Background(), "abc"); err != nil || link.URL != "https://example.com" {
+		t.Fatal("Wrong link:", link, err)
+	}
+
+	c.Close()
+	b.mu.Lock()
+	peeks := b.peeks
+	b.mu.Unlock()
+	if gets, counts := b.calls(); peeks != 1 || gets != 0 || counts != 3 {
+		t.Errorf("Expected 1 peek, no get and 3 counts got %d, %d and %d", peeks, gets, counts)
+	}
+}
+
+func TestCacheForget(t *testing.T) {
+	b := newTestCacheBackend()
+	c := NewCache(b)
+	shrt := New(c)
+
+	if _, err := c.Get(context.Background(), "abc"); err != nil {
+		t.Fatal("Get failed:", err)
+	}
+
+	// Optional interfaces are found on the cached backend
+	req, _ := http.NewRequest("DELETE", "http://example.com/abc", nil)
+	res := httptest.NewRecorder()
+	shrt.DeleteHandler().f(res, req, context.WithValue(context.Background(), "id", "abc"))
+	if res.Code != http.StatusNoContent {
+		t.Fatal("Expected 204 got:", res.Code)
+	}
+
+	if _, err := c.Get(context.Background(), "abc"); err != ErrNotFound {
+		t.Error("Deleted link served from cache:", err)
+	}
+}
+
+func TestNewCacheWithoutClickCounter(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic for backend without ClickCounter")
+		}
+	}()
+
+	NewCache(tb)
+}
@@ -0,0 +1,178 @@
+package shrtie
+
+import (
+	"golang.org/x/net/context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countKey is a link whose clicks are added up by BufferedCounter
+type countKey struct {
+	namespace, key string
+}
+
+// BufferedCounter counts clicks in the background, so redirects don't wait
+// for writes of the backend. Get looks links up without counting and queues
+// the click, queued clicks are added up per link and written in batches
+// with the ClickCounter of the backend. Links with a click limit are still
+// counted by the Get of the backend, which checks the limit atomically.
+// Clicks are dropped if the queue is full. Wrap it with a Cache, not the
+// other way round.
+type BufferedCounter struct {
+	backend  Backend
+	peeker   Peeker
+	writer   ClickCounter
+	clicks   chan countKey
+	interval time.Duration
+	dropped  int64
+
+	quit, done chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewBufferedCounter returns a BufferedCounter wrapping backend, pass it to
+// New instead of the backend. It queues up to size clicks and writes them at
+// least every interval. The backend has to implement Peeker and
+// ClickCounter, all bundled ones do.
+func NewBufferedCounter(backend Backend, size int, interval time.Duration) *BufferedCounter {
+	peeker, ok := Unwrap(backend).(Peeker)
+	if !ok {
+		log.Panicln("Backend doesn't support Peeker interface")
+	}
+
+	writer, ok := Unwrap(backend).(ClickCounter)
+	if !ok {
+		log.Panicln("Backend doesn't support ClickCounter interface")
+	}
+
+	if size <= 0 {
+		size = 1024
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	c := &BufferedCounter{
+		backend:  backend,
+		peeker:   peeker,
+		writer:   writer,
+		clicks:   make(chan countKey, size),
+		interval: interval,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go c.run()
+	return c
+}
+
+// Unwrap returns the wrapped backend
+func (c *BufferedCounter) Unwrap() Backend {
+	return c.backend
+}
+
+// Get returns the link and queues the click.
+func (c *BufferedCounter) Get(ctx context.Context, key string) (*Link, error) {
+	link, err := c.peeker.Peek(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if link.MaxClicks != 0 {
+		return c.backend.Get(ctx, key)
+	}
+
+	c.Count(ctx, key)
+	return link, nil
+}
+
+// Peek returns the link without counting a click.
+func (c *BufferedCounter) Peek(ctx context.Context, key string) (*Link, error) {
+	return c.peeker.Peek(ctx, key)
+}
+
+func (c *BufferedCounter) Save(ctx context.Context, link *Link) (string, error) {
+	return c.backend.Save(ctx, link)
+}
+
+// Count queues a click of key. It never fails, clicks of missing links are
+// skipped by the backend.
+func (c *BufferedCounter) Count(ctx context.Context, key string) error {
+	select {
+	case c.clicks <- countKey{NamespaceFromContext(ctx), key}:
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+	}
+
+	return nil
+}
+
+// Dropped returns the number of clicks dropped because the queue was full.
+func (c *BufferedCounter) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+// Close writes the queued clicks and stops the background writer. Clicks
+// counted afterwards are dropped.
+func (c *BufferedCounter) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.quit)
+	})
+
+	<-c.done
+	return nil
+}
+
+func (c *BufferedCounter) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	counts := make(map[countKey]int64)
+	for {
+		select {
+		case click := <-c.clicks:
+			if counts[click]++; len(counts) == clickBatch {
+				c.flush(counts)
+			}
+		case <-ticker.C:
+			c.flush(counts)
+		case <-c.quit:
+			// Drain the queue
+			for {
+				select {
+				case click := <-c.clicks:
+					if counts[click]++; len(counts) == clickBatch {
+						c.flush(counts)
+					}
+				default:
+					c.flush(counts)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes the counts and empties them
+func (c *BufferedCounter) flush(counts map[countKey]int64) {
+	if len(counts) == 0 {
+		return
+	}
+
+	batch := make([]ClickCount, 0, len(counts))
+	for k, n := range counts {
+		batch = append(batch, ClickCount{Namespace: k.namespace, Key: k.key, Clicks: n})
+		delete(counts, k)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clickTimeout)
+	defer cancel()
+
+	if err := c.writer.AddClicks(ctx, batch); err != nil {
+		log.Println("Failed to write click counts:", err)
+	}
+}
@@ -0,0 +1,124 @@
+package shrtie
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testCounterBackend records the click counts written to it
+type testCounterBackend struct {
+	*testCacheBackend
+	mu      sync.Mutex
+	batches [][]ClickCount
+	written chan struct{}
+}
+
+func newTestCounterBackend() *testCounterBackend {
+	return &testCounterBackend{testCacheBackend: newTestCacheBackend(), written: make(chan struct{}, 10)}
+}
+
+func (b *testCounterBackend) AddClicks(ctx context.Context, counts []ClickCount) error {
+	b.mu.Lock()
+	b.batches = append(b.batches, counts)
+	b.mu.Unlock()
+	b.written <- struct{}{}
+	return nil
+}
+
+func (b *testCounterBackend) clicks() map[ClickCount]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clicks := make(map[ClickCount]int)
+	for _, batch := range b.batches {
+		for _, c := range batch {
+			clicks[c]++
+		}
+	}
+	return clicks
+}
+
+func TestBufferedCounter(t *testing.T) {
+	b := newTestCounterBackend()
+	c := NewBufferedCounter(b, 10, time.Hour)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if link, err := c.Get(ctx, "abc"); err != nil || link.URL != "https://example.com" {
+			t.Fatal("Wrong link:", link, err)
+		}
+	}
+	c.Get(WithNamespace(ctx, "team"), "short")
+
+	if _, err := c.Get(ctx, "missing"); err != ErrNotFound {
+		t.Error("Expected ErrNotFound got:", err)
+	}
+
+	// Limited links are counted by the backend right away
+	c.Get(ctx, "limited")
+	if gets, _ := b.calls(); gets != 1 {
+		t.Error("Limited link not counted by the backend:", gets)
+	}
+
+	c.Close()
+
+	clicks := b.clicks()
+	if len(clicks) != 2 || clicks[ClickCount{Key: "abc", Clicks: 3}] != 1 || clicks[ClickCount{Namespace: "team", Key: "short", Clicks: 1}] != 1 {
+		t.Error("Wrong click counts:", clicks)
+	}
+}
+
+func TestBufferedCounterInterval(t *testing.T) {
+	b := newTestCounterBackend()
+	c := NewBufferedCounter(b, 10, 10*time.Millisecond)
+	defer c.Close()
+
+	c.Count(context.Background(), "abc")
+
+	select {
+	case <-b.written:
+	case <-time.After(time.Second):
+		t.Fatal("Clicks not written")
+	}
+
+	if clicks := b.clicks(); clicks[ClickCount{Key: "abc", Clicks: 1}] != 1 {
+		t.Error("Wrong click counts:", clicks)
+	}
+}
+
+func TestBufferedCounterDropped(t *testing.T) {
+	b := newTestCounterBackend()
+	c := NewBufferedCounter(b, 1, time.Hour)
+	c.Close()
+
+	// Nobody reads the queue anymore
+	for i := 0; i < 3; i++ {
+		c.Count(context.Background(), "abc")
+	}
+
+	if c.Dropped() != 2 {
+		t.Error("Expected 2 dropped clicks got:", c.Dropped())
+	}
+}
+
+func TestBufferedCounterCache(t *testing.T) {
+	b := newTestCounterBackend()
+	counter := NewBufferedCounter(b, 10, time.Hour)
+	c := NewCache(counter)
+
+	for i := 0; i < 3; i++ {
+		c.Get(context.Background(), "abc")
+	}
+	counter.Close()
+
+	// Cached clicks are queued instead of counted by the backend
+	if _, counts := b.calls(); counts != 0 {
+		t.Error("Clicks counted by the backend:", counts)
+	}
+
+	if clicks := b.clicks(); clicks[ClickCount{Key: "abc", Clicks: 3}] != 1 {
+		t.Error("Wrong click counts:", clicks)
+	}
+}
@@ -0,0 +1,52 @@
+package shrtie
+
+import (
+	"golang.org/x/net/context"
+	"log"
+)
+
+// Finder is implemented by backends which keep an index of the target URLs.
+// Find returns the key and the link of a live link to url without counting
+// a click, ErrNotFound if there is none.
+type Finder interface {
+	Find(ctx context.Context, url string) (string, *Link, error)
+}
+
+// WithDeduplication makes SaveHandler return the key of an existing link
+// if the same URL was shortened before, URLs are compared after
+// normalization by the URLPolicy. The existing link is only reused if it has
+// the same redirect status code and lives at least as long as the requested
+// one, so a reused link might outlive the requested TTL. The backend has to
+// implement Finder.
+func WithDeduplication() Option {
+	return func(s *Shrtie) {
+		if _, ok := s.inner.(Finder); !ok {
+			log.Panicln("Backend doesn't support Finder interface")
+		}
+
+		s.deduplicate = true
+	}
+}
+
+// reuse returns the key of an existing link compatible to link
+func (s Shrtie) reuse(ctx context.Context, link *Link) (string, bool) {
+	key, existing, err := s.inner.(Finder).Find(ctx, link.URL)
+	if err != nil {
+		// Errors only cost a new link
+		return "", false
+	}
+
+	// Limited and protected links are never shared
+	if existing.Redirect != link.Redirect || existing.Preview != link.Preview ||
+		existing.MaxClicks != 0 || link.MaxClicks != 0 ||
+		existing.Password != "" || link.Password != "" {
+		return "", false
+	}
+
+	// Zero means forever, which satisfies every TTL
+	if existing.TTL != 0 && (link.TTL == 0 || existing.TTL < link.TTL) {
+		return "", false
+	}
+
+	return key, true
+}
@@ -32,6 +32,10 @@ func main() {
 
 	server.GET("/info/:id", s.InfoHandler().Httprouter())
 
+	// Fix or remove existing links
+	server.PUT("/s/:id", s.UpdateHandler().Httprouter())
+	server.DELETE("/s/:id", s.DeleteHandler().Httprouter())
+
 	// Start server
 	log.Print(http.ListenAndServe(":9999", server))
 
@@ -2,8 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"golang.org/x/net/context"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	_ "github.com/mattn/go-sqlite3"
@@ -23,15 +25,54 @@ func main() {
 		log.Fatal(err)
 	}
 
-	s := shrtie.New(b)
+	// Record clicks in the background for the stats
+	clicks := shrtie.NewBufferedAnalytics(b.(shrtie.ClickWriter), 1024, time.Second)
+	defer clicks.Close()
+
+	// Remove expired links, they are gone for a day first
+	sweeper := shrtie.NewExpirySweeper(b, shrtie.SweepGrace(24*time.Hour))
+	defer sweeper.Close()
+
+	// The database is in memory, so a new admin key is needed on every start
+	keys := b.(shrtie.KeyStore)
+	token, _, err := shrtie.CreateAPIKey(context.Background(), keys, shrtie.ScopeAdmin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Print("Admin API key: ", token)
+
+	auth := shrtie.APIKeys{Store: keys}
+	// Count clicks in the background and serve hot links from memory
+	counter := shrtie.NewBufferedCounter(b, 1024, time.Second)
+	defer counter.Close()
+
+	s := shrtie.New(shrtie.NewCache(counter), shrtie.WithAnalytics(clicks), shrtie.WithIPAnonymization(), shrtie.WithAuthenticator(auth))
+
+	// Limit link creation, API keys get more than anonymous clients
+	limiter := shrtie.NewRateLimiter(shrtie.NewLocalLimits(), "save",
+		shrtie.PerIP(shrtie.Limit{Rate: 10, Period: time.Minute, Burst: 20}),
+		shrtie.PerAPIKey(shrtie.Limit{Rate: 100, Period: time.Minute}, auth))
+
 	server := httprouter.New()
 
 	// Get RedirectHandler and warp it
 	// into a julienschmidt/httprouter compatible handler function
 	server.GET("/s/:id", s.RedirectHandler().Httprouter())
-	server.POST("/s", s.SaveHandler().Httprouter())
+	server.POST("/s", limiter.Handler(s.SaveHandler()).Httprouter())
+	server.POST("/bulk", limiter.Handler(s.BulkSaveHandler("/s/")).Httprouter())
 
 	server.GET("/info/:id", s.InfoHandler().Httprouter())
+	server.GET("/links", s.ListHandler().Httprouter())
+	server.GET("/stats/:id", s.StatsHandler().Httprouter())
+	server.GET("/qr/:id", s.QRHandler("/s/").Httprouter())
+
+	// Fix or remove existing links
+	server.PUT("/s/:id", s.UpdateHandler().Httprouter())
+	server.DELETE("/s/:id", s.DeleteHandler().Httprouter())
+
+	// Create and revoke API keys
+	server.POST("/keys", s.KeyHandler().Httprouter())
+	server.DELETE("/keys/:id", s.RevokeKeyHandler().Httprouter())
 
 	// Start server
 	log.Print(http.ListenAndServe(":9999", server))
@@ -0,0 +1,170 @@
+package shrtie
+
+import (
+	"golang.org/x/net/context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of NewExpirySweeper
+const (
+	defaultSweepInterval = time.Minute
+	defaultSweepBatch    = 1000
+)
+
+// ExpiredLink is a link removed by a Sweeper, see ArchiveFunc.
+type ExpiredLink struct {
+	Namespace string
+	Key       string
+	Metadata
+}
+
+// ArchiveFunc is called with expired links before they are removed. If it
+// fails, the links are kept and handed to it again by the next sweep.
+type ArchiveFunc func(ctx context.Context, links []ExpiredLink) error
+
+// Sweeper is implemented by backends which don't remove expired links by
+// themselves, e.g. for ExpirySweeper. Sweep removes up to limit links of all
+// namespaces which expired before before, archive is called with them
+// first unless it's nil. It returns the number of removed links.
+type Sweeper interface {
+	Sweep(ctx context.Context, before time.Time, limit int, archive ArchiveFunc) (int, error)
+}
+
+// ExpirySweeper removes expired links of a backend in the background. Until
+// they are removed, expired links are answered with 410 Gone, afterwards
+// with 404 Not Found.
+type ExpirySweeper struct {
+	sweeper  Sweeper
+	interval time.Duration
+	batch    int
+	grace    time.Duration
+	archive  ArchiveFunc
+	swept    int64
+
+	quit, done chan struct{}
+	closeOnce  sync.Once
+}
+
+// SweepOption configures an ExpirySweeper
+type SweepOption func(*ExpirySweeper)
+
+// SweepInterval sets the time between sweeps. Defaults to a minute.
+func SweepInterval(d time.Duration) SweepOption {
+	if d <= 0 {
+		log.Panicln("Invalid sweep interval", d)
+	}
+
+	return func(s *ExpirySweeper) {
+		s.interval = d
+	}
+}
+
+// SweepBatch sets the number of links removed at once, a sweep removes
+// batches until all expired links are gone. Defaults to 1000.
+func SweepBatch(n int) SweepOption {
+	if n < 1 {
+		log.Panicln("Invalid sweep batch size", n)
+	}
+
+	return func(s *ExpirySweeper) {
+		s.batch = n
+	}
+}
+
+// SweepGrace keeps expired links for d, so they are answered with 410 Gone
+// instead of 404 Not Found for a while.
+func SweepGrace(d time.Duration) SweepOption {
+	if d < 0 {
+		log.Panicln("Invalid sweep grace period", d)
+	}
+
+	return func(s *ExpirySweeper) {
+		s.grace = d
+	}
+}
+
+// SweepArchive calls f with expired links before they are removed.
+func SweepArchive(f ArchiveFunc) SweepOption {
+	return func(s *ExpirySweeper) {
+		s.archive = f
+	}
+}
+
+// NewExpirySweeper returns an ExpirySweeper removing the expired links of
+// backend. The backend has to implement Sweeper, all bundled ones do. Redis
+// removes expired links by itself as well, archiving them needs its
+// WithSweepMargin.
+func NewExpirySweeper(backend Backend, opts ...SweepOption) *ExpirySweeper {
+	sweeper, ok := Unwrap(backend).(Sweeper)
+	if !ok {
+		log.Panicln("Backend doesn't support Sweeper interface")
+	}
+
+	s := &ExpirySweeper{
+		sweeper:  sweeper,
+		interval: defaultSweepInterval,
+		batch:    defaultSweepBatch,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	go s.run()
+	return s
+}
+
+// Sweep removes the links which expired before the grace period in batches
+// and returns their number. The background sweeps call it as well.
+func (s *ExpirySweeper) Sweep(ctx context.Context) (int, error) {
+	before := time.Now().Add(-s.grace)
+
+	var total int
+	for {
+		n, err := s.sweeper.Sweep(ctx, before, s.batch, s.archive)
+		total += n
+		atomic.AddInt64(&s.swept, int64(n))
+
+		if err != nil || n < s.batch {
+			return total, err
+		}
+	}
+}
+
+// Swept returns the number of links removed so far.
+func (s *ExpirySweeper) Swept() int64 {
+	return atomic.LoadInt64(&s.swept)
+}
+
+// Close stops the background sweeps, a running one is finished first.
+func (s *ExpirySweeper) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+	})
+
+	<-s.done
+	return nil
+}
+
+func (s *ExpirySweeper) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Sweep(context.Background()); err != nil {
+				log.Println("Failed to sweep expired links:", err)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package shrtie
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testSweeperBackend has expired links left and records the sweeps
+type testSweeperBackend struct {
+	testBackend
+	mu     sync.Mutex
+	left   int
+	before []time.Time
+	err    error
+}
+
+func (b *testSweeperBackend) Sweep(ctx context.Context, before time.Time, limit int, archive ArchiveFunc) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.before = append(b.before, before)
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n := limit
+	if b.left < n {
+		n = b.left
+	}
+
+	links := make([]ExpiredLink, n)
+	if err := archive(ctx, links); err != nil {
+		return 0, err
+	}
+	b.left -= n
+	return n, nil
+}
+
+func TestExpirySweeper(t *testing.T) {
+	b := &testSweeperBackend{left: 25}
+	var archived int
+	s := NewExpirySweeper(b, SweepBatch(10), SweepGrace(time.Hour), SweepArchive(func(_ context.Context, links []ExpiredLink) error {
+		archived += len(links)
+		return nil
+	}))
+	defer s.Close()
+
+	n, err := s.Sweep(context.Background())
+	if err != nil || n != 25 {
+		t.Fatal("Expected 25 removed links got:", n, err)
+	}
+
+	// Batches are swept until one isn't full
+	if len(b.before) != 3 || archived != 25 || s.Swept() != 25 {
+		t.Error("Wrong sweeps:", len(b.before), archived, s.Swept())
+	}
+
+	if grace := time.Since(b.before[0]); grace < time.Hour || grace > time.Hour+time.Minute {
+		t.Error("Grace period not applied:", grace)
+	}
+}
+
+func TestExpirySweeperError(t *testing.T) {
+	b := &testSweeperBackend{left: 25, err: errors.New("down")}
+	s := NewExpirySweeper(b, SweepBatch(10))
+	defer s.Close()
+
+	if n, err := s.Sweep(context.Background()); err != b.err || n != 0 || len(b.before) != 1 {
+		t.Error("Expected the backend error got:", n, err)
+	}
+}
+
+func TestExpirySweeperInterval(t *testing.T) {
+	b := &testSweeperBackend{left: 5}
+	s := NewExpirySweeper(b, SweepInterval(10*time.Millisecond), SweepArchive(func(context.Context, []ExpiredLink) error {
+		return nil
+	}))
+
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+
+	if s.Swept() != 5 {
+		t.Error("Expected 5 links swept in the background got:", s.Swept())
+	}
+}
+
+func TestNewExpirySweeperWithoutSweeper(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic for backend without Sweeper")
+		}
+	}()
+
+	NewExpirySweeper(tb)
+}
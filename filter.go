@@ -0,0 +1,270 @@
+package shrtie
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlockedError is returned for targets rejected by a DomainFilter, the
+// handlers answer it with 403 Forbidden.
+type BlockedError struct {
+	Host   string
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("Domain %s is %s", e.Host, e.Reason)
+}
+
+// rule matches hosts exactly, by subdomain (*.example.com) or by network
+type rule struct {
+	text     string
+	host     string
+	wildcard bool
+	network  *net.IPNet
+}
+
+func parseRule(text string) (rule, error) {
+	r := rule{text: text}
+	if strings.Contains(text, "/") {
+		_, network, err := net.ParseCIDR(text)
+		if err != nil {
+			return r, err
+		}
+		r.network = network
+		return r, nil
+	}
+
+	host := strings.ToLower(text)
+	if strings.HasPrefix(host, "*.") {
+		r.wildcard, host = true, host[2:]
+	}
+
+	host, err := canonicalHost(host)
+	if err != nil {
+		return r, err
+	}
+
+	r.host = host
+	return r, nil
+}
+
+// match reports whether host is covered by the rule. Networks only match IP
+// addresses, host names aren't resolved.
+func (r rule) match(host string) bool {
+	switch {
+	case r.network != nil:
+		ip := net.ParseIP(host)
+		return ip != nil && r.network.Contains(ip)
+	case r.wildcard:
+		return strings.HasSuffix(host, "."+r.host)
+	default:
+		return host == r.host
+	}
+}
+
+// DomainFilter decides which hosts links may point to. Blocked hosts are
+// always rejected, if there are allowed hosts every other host is rejected
+// as well. Rules are exact hosts, wildcards like *.example.com matching all
+// subdomains or CIDR ranges like 10.0.0.0/8 matching IP addresses.
+type DomainFilter struct {
+	mu           sync.RWMutex
+	allow, block []rule
+
+	// Rule file and its state when it was read
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// NewDomainFilter returns a filter with fixed rules.
+func NewDomainFilter(allow, block []string) (*DomainFilter, error) {
+	f := &DomainFilter{}
+	for _, text := range allow {
+		r, err := parseRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rule %q", text)
+		}
+		f.allow = append(f.allow, r)
+	}
+
+	for _, text := range block {
+		r, err := parseRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rule %q", text)
+		}
+		f.block = append(f.block, r)
+	}
+
+	return f, nil
+}
+
+// LoadDomainFilter reads the rules from a file with one rule per line,
+// prefixed with "allow" or "block". Empty lines and lines starting with #
+// are ignored:
+//
+//	# Internal services only
+//	allow *.corp.example.com
+//	block 10.0.0.0/8
+//
+// Use Reload or Watch to pick up changes of the file.
+func LoadDomainFilter(path string) (*DomainFilter, error) {
+	f := &DomainFilter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Reload reads the rule file again if it changed since it was read. The
+// current rules are kept if the file is invalid.
+func (f *DomainFilter) Reload() error {
+	if f.path == "" {
+		return nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	f.mu.RLock()
+	unchanged := stat.ModTime().Equal(f.modTime) && stat.Size() == f.size
+	f.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	allow, block, err := readRules(f.path, file)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.allow, f.block = allow, block
+	f.modTime, f.size = stat.ModTime(), stat.Size()
+	f.mu.Unlock()
+
+	return nil
+}
+
+// Watch reloads the rule file every interval until stop is called. Failed
+// reloads are logged.
+func (f *DomainFilter) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := f.Reload(); err != nil {
+					log.Println("Failed to reload domain filter:", err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Check returns a *BlockedError if the host of target isn't allowed.
+func (f *DomainFilter) Check(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return &BlockedError{Host: target, Reason: "invalid"}
+	}
+
+	// Targets saved before they were normalized might spell hosts
+	// differently, e.g. with a trailing dot
+	host, err := canonicalHost(u.Hostname())
+	if err != nil {
+		return &BlockedError{Host: u.Hostname(), Reason: "invalid"}
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, r := range f.block {
+		if r.match(host) {
+			return &BlockedError{Host: host, Reason: "blocked by rule " + r.text}
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return nil
+	}
+
+	for _, r := range f.allow {
+		if r.match(host) {
+			return nil
+		}
+	}
+
+	return &BlockedError{Host: host, Reason: "not allowed"}
+}
+
+func readRules(name string, r io.Reader) (allow, block []rule, err error) {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("%s:%d: Invalid rule %q", name, n, line)
+		}
+
+		r, err := parseRule(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: Invalid rule %q", name, n, line)
+		}
+
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, r)
+		case "block":
+			block = append(block, r)
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: Invalid rule %q", name, n, line)
+		}
+	}
+
+	return allow, block, scanner.Err()
+}
+
+// WithDomainFilter rejects new and updated links to hosts blocked by f with
+// 403 Forbidden. If recheck is set RedirectHandler checks the target again,
+// so existing links to hosts blocked later stop working.
+func WithDomainFilter(f *DomainFilter, recheck bool) Option {
+	if f == nil {
+		log.Panicln("Domain filter is nil")
+	}
+
+	return func(s *Shrtie) {
+		s.filter, s.recheck = f, recheck
+	}
+}
@@ -0,0 +1,167 @@
+package shrtie
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestDomainFilterCheck(t *testing.T) {
+	f, err := NewDomainFilter(
+		[]string{"here.com", "*.corp.com", "10.0.0.0/8", "Bücher.example"},
+		[]string{"evil.corp.com"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"https://here.com/":               true,
+		"https://sub.here.com/":           false,
+		"https://a.corp.com/":             true,
+		"https://a.b.corp.com/":           true,
+		"https://corp.com/":               false,
+		"https://evil.corp.com/":          false,
+		"http://10.1.2.3/":                true,
+		"http://11.1.2.3/":                false,
+		"https://xn--bcher-kva.example/":  true,
+		"https://there.com:8080/here.com": false,
+	}
+
+	for target, allowed := range tests {
+		err := f.Check(target)
+		if allowed && err != nil || !allowed && err == nil {
+			t.Errorf("Wrong result for %s: %v", target, err)
+		}
+	}
+
+	if err := f.Check("https://evil.corp.com/"); err == nil || !strings.Contains(err.Error(), "evil.corp.com") {
+		t.Error("Missing reason:", err)
+	}
+
+	if _, err = NewDomainFilter(nil, []string{"10.0.0.0/33"}); err == nil {
+		t.Error("Invalid rule was accepted")
+	}
+}
+
+func TestDomainFilterHostForms(t *testing.T) {
+	f, err := NewDomainFilter(nil, []string{"evil.com", "*.evil.com", "10.0.0.0/8", "bad.example."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []string{
+		"http://evil.com./x",
+		"http://EVIL.com./",
+		"http://a.evil.com./",
+		"http://bad.example/",
+		"http://0x0a.0.0.1/",
+		"http://0x0A000001/",
+		"http://012.0.0.1/",
+		"http://10.1/",
+		"http://167772161/",
+		"http://[::ffff:10.0.0.1]/",
+	}
+
+	for _, target := range tests {
+		// Stored targets are normalized, rechecked ones might not be
+		if err := f.Check(target); err == nil {
+			t.Errorf("Blocked host was allowed: %s", target)
+		}
+
+		normalized, err := (URLPolicy{}).Normalize(target)
+		if err != nil {
+			t.Errorf("Failed to normalize %s: %v", target, err)
+			continue
+		}
+
+		if err := f.Check(normalized); err == nil {
+			t.Errorf("Blocked host was allowed after normalize: %s (%s)", target, normalized)
+		}
+	}
+
+	// Hosts ending in a number have to be valid addresses
+	for _, target := range []string{"http://10.0.0.256/", "http://1.2.3.4.5/", "http://a.08/", "http://evil.com../"} {
+		if err := f.Check(target); err == nil {
+			t.Errorf("Invalid host was allowed: %s", target)
+		}
+	}
+}
+
+func TestDomainFilterReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shrtie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "domains")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	now := time.Now()
+	write("# Comment\n\nblock evil.com\n", now)
+
+	f, err := LoadDomainFilter(path)
+	if err != nil {
+		t.Fatal("Failed to load filter:", err)
+	}
+
+	if f.Check("https://evil.com/") == nil || f.Check("https://here.com/") != nil {
+		t.Error("Wrong rules after load")
+	}
+
+	write("block here.com\n", now.Add(time.Second))
+	if err = f.Reload(); err != nil {
+		t.Fatal("Failed to reload filter:", err)
+	}
+
+	if f.Check("https://evil.com/") != nil || f.Check("https://here.com/") == nil {
+		t.Error("Wrong rules after reload")
+	}
+
+	// Invalid files keep the current rules
+	write("deny here.com\n", now.Add(2*time.Second))
+	if err = f.Reload(); err == nil {
+		t.Error("Invalid rule file was accepted")
+	}
+
+	if f.Check("https://here.com/") == nil {
+		t.Error("Rules were dropped by invalid file")
+	}
+}
+
+func TestDomainFilterHandlers(t *testing.T) {
+	f, _ := NewDomainFilter(nil, []string{"here.com"})
+
+	req, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader(`{"url":"https://here.com"}`))
+	req.Header.Add("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	New(tb, WithDomainFilter(f, false)).SaveHandler().f(res, req, context.Background())
+
+	if res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), "here.com") {
+		t.Error("Wrong response for blocked save:", res.Code, res.Body.String())
+	}
+
+	ctx := context.WithValue(context.Background(), "id", "abc")
+	for recheck, code := range map[bool]int{false: http.StatusMovedPermanently, true: http.StatusForbidden} {
+		req, _ = http.NewRequest("GET", "http://example.com/abc", nil)
+		res = httptest.NewRecorder()
+		New(tb, WithDomainFilter(f, recheck)).RedirectHandler().f(res, req, ctx)
+
+		if res.Code != code {
+			t.Errorf("Wrong status for redirect with recheck %v: %d", recheck, res.Code)
+		}
+	}
+}
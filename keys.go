@@ -0,0 +1,150 @@
+package shrtie
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrKeySpace = errors.New("Key space exhausted")
+	ErrBadKey   = errors.New("Key wasn't generated by this generator")
+)
+
+// KeyGenerator turns the n-th value of a backend counter into a key.
+// Backends retry with the next counter value if a key is already taken,
+// so generators ignoring n like Random get a new chance on collisions.
+type KeyGenerator interface {
+	Key(n int64) (string, error)
+}
+
+// Sequential is the default KeyGenerator. The key is the URL safe base64
+// encoding of the varint of n, which is short but easy to enumerate.
+type Sequential struct{}
+
+func (Sequential) Key(n int64) (string, error) {
+	// Make int64 to byte array and cut it to min lenght
+	buf := make([]byte, binary.MaxVarintLen64)
+	size := binary.PutVarint(buf, n)
+
+	// Convert to base64, wich is URL save and without padding ('='*)
+	return base64.RawURLEncoding.EncodeToString(buf[:size]), nil
+}
+
+// DefaultAlphabet contains all characters which are URL safe without
+// escaping.
+const DefaultAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz_-"
+
+// Random generates cryptographically random keys. The zero value creates
+// keys of 8 characters drawn from DefaultAlphabet.
+type Random struct {
+	Length   int    // Length of the keys, defaults to 8
+	Alphabet string // Characters the keys consist of, at most 256
+}
+
+func (r Random) Key(_ int64) (string, error) {
+	length, alphabet := r.Length, r.Alphabet
+	if length <= 0 {
+		length = 8
+	}
+	if alphabet == "" {
+		alphabet = DefaultAlphabet
+	}
+	if len(alphabet) > 256 {
+		return "", errors.New("Alphabet exceeds 256 characters")
+	}
+
+	// Bytes above the last multiple of the alphabet size are skipped,
+	// otherwise the first characters would be more likely
+	limit := 256 - 256%len(alphabet)
+
+	key := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(key) < length {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+
+		for _, b := range buf {
+			if int(b) < limit && len(key) < length {
+				key = append(key, alphabet[int(b)%len(alphabet)])
+			}
+		}
+	}
+
+	return string(key), nil
+}
+
+// obfuscatedBits is the size of the domain Obfuscated permutes. It allows
+// 2^40 links while keeping keys at 7 characters.
+const (
+	obfuscatedBits = 40
+	halfBits       = obfuscatedBits / 2
+	halfMask       = 1<<halfBits - 1
+	feistelRounds  = 4
+)
+
+// Obfuscated generates compact keys which aren't guessable. Every counter
+// value is mapped to a unique key by a permutation keyed with a secret, so
+// no collisions occur. The mapping is reversible with Sequence.
+type Obfuscated struct {
+	secret []byte
+}
+
+// NewObfuscated returns an Obfuscated generator using secret. Changing the
+// secret changes all keys, so it has to stay the same for a backend.
+func NewObfuscated(secret []byte) *Obfuscated {
+	return &Obfuscated{
+		secret: secret,
+	}
+}
+
+func (o *Obfuscated) Key(n int64) (string, error) {
+	if n < 0 || n >= 1<<obfuscatedBits {
+		return "", ErrKeySpace
+	}
+
+	// Balanced feistel network, each round is a bijection
+	l, r := uint64(n)>>halfBits, uint64(n)&halfMask
+	for i := 0; i < feistelRounds; i++ {
+		l, r = r, l^o.round(i, r)
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, l<<halfBits|r)
+	return base64.RawURLEncoding.EncodeToString(buf[8-obfuscatedBits/8:]), nil
+}
+
+// Sequence returns the counter value the key was generated from.
+func (o *Obfuscated) Sequence(key string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil || len(raw) != obfuscatedBits/8 {
+		return 0, ErrBadKey
+	}
+
+	buf := make([]byte, 8)
+	copy(buf[8-len(raw):], raw)
+	v := binary.BigEndian.Uint64(buf)
+
+	// Run the rounds backwards
+	l, r := v>>halfBits, v&halfMask
+	for i := feistelRounds - 1; i >= 0; i-- {
+		l, r = r^o.round(i, l), l
+	}
+
+	return int64(l<<halfBits | r), nil
+}
+
+// round is the round function of the feistel network
+func (o *Obfuscated) round(i int, half uint64) uint64 {
+	buf := make([]byte, 9)
+	buf[0] = byte(i)
+	binary.BigEndian.PutUint64(buf[1:], half)
+
+	mac := hmac.New(sha256.New, o.secret)
+	mac.Write(buf)
+	return binary.BigEndian.Uint64(mac.Sum(nil)) & halfMask
+}
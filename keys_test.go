@@ -0,0 +1,100 @@
+package shrtie
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSequential(t *testing.T) {
+	tests := []struct {
+		n   int64
+		key string
+	}{
+		{n: 1, key: "Ag"},
+		{n: 2, key: "BA"},
+		{n: 64, key: "gAE"},
+	}
+
+	for _, test := range tests {
+		if key, err := (Sequential{}).Key(test.n); err != nil || key != test.key {
+			t.Errorf("Failed sequential test: Expected '%s' got '%s' (%v).\n", test.key, key, err)
+		}
+	}
+
+	// Varints of large values exceed 8 bytes
+	if _, err := (Sequential{}).Key(1<<62 + 1); err != nil {
+		t.Error("Failed sequential test:", err)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		key, err := Random{}.Key(1)
+		if err != nil {
+			t.Fatal("Failed random test:", err)
+		}
+
+		if len(key) != 8 || !validKey.MatchString(key) {
+			t.Error("Wrong default random key:", key)
+		}
+
+		if seen[key] {
+			t.Error("Random key generated twice:", key)
+		}
+		seen[key] = true
+	}
+
+	key, err := Random{Length: 20, Alphabet: "abc"}.Key(1)
+	if err != nil {
+		t.Fatal("Failed random test:", err)
+	}
+
+	if len(key) != 20 || strings.Trim(key, "abc") != "" {
+		t.Error("Wrong random key for custom alphabet:", key)
+	}
+
+	if _, err = (Random{Alphabet: strings.Repeat("a", 257)}).Key(1); err == nil {
+		t.Error("Alphabet exceeding 256 characters was accepted")
+	}
+}
+
+func TestObfuscated(t *testing.T) {
+	o := NewObfuscated([]byte("secret"))
+
+	seen := make(map[string]bool)
+	for _, n := range []int64{0, 1, 2, 3, 1000, 1<<40 - 1} {
+		key, err := o.Key(n)
+		if err != nil {
+			t.Fatal("Failed obfuscated test:", err)
+		}
+
+		if len(key) != 7 || !validKey.MatchString(key) {
+			t.Error("Wrong obfuscated key:", key)
+		}
+
+		if seen[key] {
+			t.Error("Obfuscated key generated twice:", key)
+		}
+		seen[key] = true
+
+		if back, err := o.Sequence(key); err != nil || back != n {
+			t.Errorf("Failed obfuscated test: Expected %d got %d (%v).\n", n, back, err)
+		}
+	}
+
+	// Another secret results in other keys
+	a, _ := o.Key(1)
+	b, _ := NewObfuscated([]byte("other")).Key(1)
+	if a == b {
+		t.Error("Obfuscated keys don't depend on the secret:", a)
+	}
+
+	if _, err := o.Key(1 << 40); err != ErrKeySpace {
+		t.Error("Expected ErrKeySpace got:", err)
+	}
+
+	if _, err := o.Sequence("abc"); err != ErrBadKey {
+		t.Error("Expected ErrBadKey got:", err)
+	}
+}
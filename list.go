@@ -0,0 +1,285 @@
+package shrtie
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"golang.org/x/net/context"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the links per page
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+var ErrCursor = errors.New("Invalid cursor") // 400 Bad Request
+
+// State filters links by whether they still work
+type State string
+
+const (
+	Active  State = "active"  // Neither expired nor exhausted
+	Expired State = "expired" // Expired or exhausted
+)
+
+// Sort is the order of listed links
+type Sort string
+
+const (
+	Unsorted    Sort = ""        // Any stable order of the backend, the cheapest one
+	SortCreated Sort = "created" // Newest first
+	SortClicks  Sort = "clicks"  // Most clicked first
+)
+
+// ListOptions filter, sort and paginate the links returned by a Lister
+type ListOptions struct {
+	Cursor string    // Cursor of the page, empty for the first one
+	Limit  int       // Links per page, zero means the default of 100
+	From   time.Time // Created at or after, zero means any time
+	To     time.Time // Created before, zero means any time
+	State  State     // Empty means any state
+	Host   string    // Substring of the target host, empty means any host
+	Sort   Sort
+}
+
+// ListEntry is a listed link
+type ListEntry struct {
+	Key string `json:"key"`
+	Metadata
+}
+
+// ListPage is a page of links. Cursor points to the next page, it's empty
+// on the last one.
+type ListPage struct {
+	Links  []ListEntry `json:"links"`
+	Cursor string      `json:"cursor,omitempty"`
+}
+
+// Lister is implemented by backends which can list their links. Expired
+// and exhausted links are listed until they are removed. Invalid cursors
+// are reported with ErrCursor.
+type Lister interface {
+	List(ctx context.Context, opts ListOptions) (*ListPage, error)
+}
+
+// PageLimit returns the number of links per page, limited to 1000.
+func (o ListOptions) PageLimit() int {
+	switch {
+	case o.Limit <= 0:
+		return defaultListLimit
+	case o.Limit > maxListLimit:
+		return maxListLimit
+	}
+
+	return o.Limit
+}
+
+// Match reports if the link passes the filters, the sort and the cursor
+// aren't taken into account.
+func (o ListOptions) Match(link *Metadata, now time.Time) bool {
+	if !o.From.IsZero() && link.Created.Before(o.From) {
+		return false
+	}
+
+	if !o.To.IsZero() && !link.Created.Before(o.To) {
+		return false
+	}
+
+	if o.State != "" && (o.State == Active) != IsActive(link, now) {
+		return false
+	}
+
+	if o.Host != "" {
+		u, err := url.Parse(link.URL)
+		if err != nil || !strings.Contains(strings.ToLower(u.Hostname()), strings.ToLower(o.Host)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsActive reports if the link is neither expired nor exhausted at now
+func IsActive(link *Metadata, now time.Time) bool {
+	if link.Expires != nil && !link.Expires.After(now) {
+		return false
+	}
+
+	return link.Remaining == nil || *link.Remaining > 0
+}
+
+// Cursor is the position after the last link of a page. Value is the sort
+// value of the link, backends may use it for their own positions as well.
+type Cursor struct {
+	Value int64
+	Key   string
+}
+
+// String encodes the cursor for ListPage
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.Value, 10) + ":" + c.Key))
+}
+
+// ParseCursor decodes a cursor of ListPage, an empty one results in the
+// zero Cursor.
+func ParseCursor(s string) (Cursor, error) {
+	if s == "" {
+		return Cursor{}, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrCursor
+	}
+
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return Cursor{}, ErrCursor
+	}
+
+	value, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Cursor{}, ErrCursor
+	}
+
+	return Cursor{Value: value, Key: parts[1]}, nil
+}
+
+// SortValue returns the value links are ordered by, descending. Unsorted
+// lists are ordered by key.
+func (s Sort) SortValue(link *Metadata) int64 {
+	switch s {
+	case SortCreated:
+		return link.Created.Unix()
+	case SortClicks:
+		return link.Clicked
+	}
+
+	return 0
+}
+
+// Paginate sorts the filtered links of a backend and returns the page after
+// the cursor of opts. Ties are ordered by key.
+func Paginate(links []ListEntry, opts ListOptions) (*ListPage, error) {
+	cursor, err := ParseCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	// Descending by value, ascending by key
+	sort.Slice(links, func(i, j int) bool {
+		vi, vj := opts.Sort.SortValue(&links[i].Metadata), opts.Sort.SortValue(&links[j].Metadata)
+		return vi > vj || vi == vj && links[i].Key < links[j].Key
+	})
+
+	// Skip the links up to the cursor
+	start := 0
+	if opts.Cursor != "" {
+		start = sort.Search(len(links), func(i int) bool {
+			v := opts.Sort.SortValue(&links[i].Metadata)
+			return v < cursor.Value || v == cursor.Value && links[i].Key > cursor.Key
+		})
+	}
+
+	page := &ListPage{Links: links[start:]}
+	if limit := opts.PageLimit(); len(page.Links) > limit {
+		page.Links = page.Links[:limit]
+		last := page.Links[limit-1]
+		page.Cursor = Cursor{Value: opts.Sort.SortValue(&last.Metadata), Key: last.Key}.String()
+	}
+
+	return page, nil
+}
+
+// ListHandler answers a page of links. The query parameters are cursor,
+// limit, from and to as RFC 3339 dates of the created range, state (active
+// or expired), host and sort (created or clicks). Like with InfoHandler the
+// targets of protected links are hidden.
+func (s Shrtie) ListHandler() Handler {
+	// Check if backend implements Lister interface
+	if backendLister, ok := s.inner.(Lister); ok {
+		return s.authorize(ScopeReadStats, Handler{
+			f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+				opts, err := parseListOptions(r)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				page, err := backendLister.List(ctx, opts)
+				if err != nil {
+					httpError(w, err)
+					return
+				}
+
+				for i := range page.Links {
+					if page.Links[i].Password != "" {
+						page.Links[i].Protected = true
+						page.Links[i].URL = ""
+					}
+				}
+
+				if page.Links == nil {
+					page.Links = []ListEntry{}
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(page)
+				return
+			},
+		})
+	}
+
+	// Exit programm if backend doesn't support Lister interface
+	log.Panicln("Backend doesn't support Lister interface")
+	return Handler{}
+}
+
+// parseListOptions reads the query parameters of ListHandler
+func parseListOptions(r *http.Request) (ListOptions, error) {
+	query := r.URL.Query()
+	opts := ListOptions{
+		Cursor: query.Get("cursor"),
+		State:  State(query.Get("state")),
+		Host:   query.Get("host"),
+		Sort:   Sort(query.Get("sort")),
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxListLimit {
+			return opts, errors.New("Bad Limit")
+		}
+		opts.Limit = n
+	}
+
+	var err error
+	if opts.From, err = parseTime(query.Get("from"), time.Time{}); err != nil {
+		return opts, errors.New("Bad Time")
+	}
+	if opts.To, err = parseTime(query.Get("to"), time.Time{}); err != nil {
+		return opts, errors.New("Bad Time")
+	}
+
+	switch opts.State {
+	case "", Active, Expired:
+	default:
+		return opts, errors.New("Bad State")
+	}
+
+	switch opts.Sort {
+	case Unsorted, SortCreated, SortClicks:
+	default:
+		return opts, errors.New("Bad Sort")
+	}
+
+	return opts, nil
+}
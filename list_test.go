@@ -0,0 +1,160 @@
+package shrtie
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func listEntries() []ListEntry {
+	created := time.Date(2017, time.March, 6, 0, 0, 0, 0, time.UTC)
+	return []ListEntry{
+		{Key: "a", Metadata: Metadata{Clicked: 5, Created: created}},
+		{Key: "b", Metadata: Metadata{Clicked: 1, Created: created.Add(time.Hour)}},
+		{Key: "c", Metadata: Metadata{Clicked: 5, Created: created.Add(2 * time.Hour)}},
+		{Key: "d", Metadata: Metadata{Clicked: 0, Created: created.Add(time.Hour)}},
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	tests := map[Sort][]string{
+		Unsorted:    {"a", "b", "c", "d"},
+		SortCreated: {"c", "b", "d", "a"},
+		SortClicks:  {"a", "c", "b", "d"},
+	}
+
+	for sort, expected := range tests {
+		var keys []string
+		opts := ListOptions{Sort: sort, Limit: 3}
+		for pages := 0; pages < 3; pages++ {
+			page, err := Paginate(listEntries(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, link := range page.Links {
+				keys = append(keys, link.Key)
+			}
+
+			if page.Cursor == "" {
+				break
+			}
+			opts.Cursor = page.Cursor
+		}
+
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Sort %q: expected %v got %v", sort, expected, keys)
+		}
+	}
+
+	if _, err := Paginate(listEntries(), ListOptions{Cursor: "!"}); err != ErrCursor {
+		t.Error("Expected ErrCursor got:", err)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	c := Cursor{Value: -42, Key: "a:b"}
+	if parsed, err := ParseCursor(c.String()); err != nil || parsed != c {
+		t.Error("Cursor changed:", parsed, err)
+	}
+
+	for _, s := range []string{"!", "YWJj", "eDph"} {
+		if _, err := ParseCursor(s); err != ErrCursor {
+			t.Errorf("%q: expected ErrCursor got %v", s, err)
+		}
+	}
+}
+
+func TestListOptionsMatch(t *testing.T) {
+	now := time.Date(2017, time.March, 6, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	zero := int64(0)
+
+	link := &Metadata{URL: "https://Sub.Example.com/path", Created: past}
+	expired := &Metadata{URL: "https://here.com", Created: past, Expires: &past}
+	exhausted := &Metadata{URL: "https://here.com", Created: past, Remaining: &zero}
+
+	tests := []struct {
+		opts  ListOptions
+		link  *Metadata
+		match bool
+	}{
+		{opts: ListOptions{}, link: link, match: true},
+		{opts: ListOptions{From: past}, link: link, match: true},
+		{opts: ListOptions{From: now}, link: link, match: false},
+		{opts: ListOptions{To: past}, link: link, match: false},
+		{opts: ListOptions{To: now}, link: link, match: true},
+		{opts: ListOptions{State: Active}, link: link, match: true},
+		{opts: ListOptions{State: Expired}, link: link, match: false},
+		{opts: ListOptions{State: Expired}, link: expired, match: true},
+		{opts: ListOptions{State: Expired}, link: exhausted, match: true},
+		{opts: ListOptions{State: Active}, link: exhausted, match: false},
+		{opts: ListOptions{Host: "example"}, link: link, match: true},
+		{opts: ListOptions{Host: "path"}, link: link, match: false},
+	}
+
+	for _, test := range tests {
+		if match := test.opts.Match(test.link, now); match != test.match {
+			t.Errorf("%+v on %s: expected %t", test.opts, test.link.URL, test.match)
+		}
+	}
+}
+
+func TestListHandler(t *testing.T) {
+	handler := New(tb).ListHandler()
+
+	req, _ := http.NewRequest("GET", "http://example.com/links?sort=clicks&limit=10", nil)
+	res := httptest.NewRecorder()
+	handler.f(res, req, context.Background())
+	if res.Code != http.StatusOK {
+		t.Fatal("Expected 200 got:", res.Code)
+	}
+
+	var page ListPage
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Links) != 2 || page.Links[0].Key != "abc" || page.Links[0].URL != "https://here.com" {
+		t.Fatal("Wrong links:", page.Links)
+	}
+
+	// Targets of protected links are hidden
+	if locked := page.Links[1]; !locked.Protected || locked.URL != "" {
+		t.Error("Protected link exposed:", locked)
+	}
+
+	tests := map[string]int{
+		"?limit=0":        http.StatusBadRequest,
+		"?limit=1001":     http.StatusBadRequest,
+		"?from=yesterday": http.StatusBadRequest,
+		"?state=broken":   http.StatusBadRequest,
+		"?sort=url":       http.StatusBadRequest,
+		"?cursor=!":       http.StatusBadRequest,
+		"?cursor=down":    http.StatusServiceUnavailable,
+	}
+
+	for query, code := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/links"+query, nil)
+		res := httptest.NewRecorder()
+		handler.f(res, req, context.Background())
+		if res.Code != code {
+			t.Errorf("%s: expected %d got %d", query, code, res.Code)
+		}
+	}
+}
+
+func TestListHandlerWithoutLister(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic for backend without Lister")
+		}
+	}()
+
+	New(Legacy(testLegacyBackend{})).ListHandler()
+}
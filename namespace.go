@@ -0,0 +1,99 @@
+package shrtie
+
+import (
+	"golang.org/x/net/context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// namespaceKey is the context key of the namespace of a request
+type namespaceKey struct{}
+
+// WithNamespace returns a copy of ctx for the namespace ns. Backends save
+// and look up links in the namespace of the context, the same key can be
+// used in every namespace. The empty namespace is the default one, links
+// saved without namespaces live there.
+func WithNamespace(ctx context.Context, ns string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, ns)
+}
+
+// NamespaceFromContext returns the namespace of ctx, "" for the default one.
+func NamespaceFromContext(ctx context.Context) string {
+	ns, _ := ctx.Value(namespaceKey{}).(string)
+	return ns
+}
+
+// ValidNamespace reports if ns can be used as namespace, namespaces are made
+// of the same characters as aliases.
+func ValidNamespace(ns string) bool {
+	return ns == "" || validKey.MatchString(ns)
+}
+
+// qualify returns key prefixed with the namespace of ctx, for state kept by
+// Shrtie itself such as the password throttle
+func qualify(ctx context.Context, key string) string {
+	if ns := NamespaceFromContext(ctx); ns != "" {
+		return ns + "/" + key
+	}
+
+	return key
+}
+
+// NamespaceFunc returns the namespace of a request, "" for the default one.
+// The context holds the path parameters like for handlers.
+type NamespaceFunc func(r *http.Request, ctx context.Context) string
+
+// PathNamespace takes the namespace from the path parameter "ns", e.g. of
+// routes like /s/:ns/:id. Routes without it use the default namespace.
+func PathNamespace(r *http.Request, ctx context.Context) string {
+	ns, _ := ctx.Value("ns").(string)
+	return ns
+}
+
+// HostNamespaces maps the host names of requests to namespaces, other hosts
+// use the default namespace.
+func HostNamespaces(hosts map[string]string) NamespaceFunc {
+	namespaces := make(map[string]string, len(hosts))
+	for host, ns := range hosts {
+		namespaces[strings.ToLower(host)] = ns
+	}
+
+	return func(r *http.Request, ctx context.Context) string {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		return namespaces[strings.ToLower(host)]
+	}
+}
+
+// WithNamespaces separates links into namespaces, each request works on the
+// namespace returned by f. Requests with invalid namespaces are answered
+// with 404 Not Found. With WithAuthenticator API keys of a namespace only
+// work in their own one, see CreateAPIKey.
+func WithNamespaces(f NamespaceFunc) Option {
+	return func(s *Shrtie) {
+		s.namespace = f
+	}
+}
+
+// namespaced wraps h so the context holds the namespace of the request
+func (s Shrtie) namespaced(h Handler) Handler {
+	if s.namespace == nil {
+		return h
+	}
+
+	return Handler{
+		f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+			ns := s.namespace(r, ctx)
+			if !ValidNamespace(ns) {
+				httpError(w, ErrNotFound)
+				return
+			}
+
+			h.f(w, r, WithNamespace(ctx, ns))
+		},
+	}
+}
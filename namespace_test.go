@@ -0,0 +1,157 @@
+package shrtie
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// testNamespaceBackend records the namespace links are looked up in
+type testNamespaceBackend struct {
+	testKeyBackend
+	namespaces *[]string
+}
+
+func (b testNamespaceBackend) Get(ctx context.Context, s string) (*Link, error) {
+	*b.namespaces = append(*b.namespaces, NamespaceFromContext(ctx))
+	return b.testKeyBackend.Get(ctx, s)
+}
+
+func (b testNamespaceBackend) InfoContext(ctx context.Context, s string) (*Metadata, error) {
+	*b.namespaces = append(*b.namespaces, NamespaceFromContext(ctx))
+	return b.testKeyBackend.InfoContext(ctx, s)
+}
+
+func namespaceRequest(handler Handler, host, ns, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "http://"+host+"/abc", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res := httptest.NewRecorder()
+	ctx := context.WithValue(context.Background(), "id", "abc")
+	handler.f(res, req, context.WithValue(ctx, "ns", ns))
+	return res
+}
+
+func TestPathNamespace(t *testing.T) {
+	var namespaces []string
+	b := testNamespaceBackend{testKeyBackend: newTestKeyBackend(), namespaces: &namespaces}
+	handler := New(b, WithNamespaces(PathNamespace)).RedirectHandler()
+
+	for _, ns := range []string{"team", ""} {
+		if res := namespaceRequest(handler, "example.com", ns, ""); res.Code != http.StatusMovedPermanently {
+			t.Errorf("%q: expected 301 got %d", ns, res.Code)
+		}
+	}
+
+	if res := namespaceRequest(handler, "example.com", "a b", ""); res.Code != http.StatusNotFound {
+		t.Error("Invalid namespace accepted:", res.Code)
+	}
+
+	if len(namespaces) != 2 || namespaces[0] != "team" || namespaces[1] != "" {
+		t.Error("Wrong namespaces:", namespaces)
+	}
+}
+
+func TestHostNamespaces(t *testing.T) {
+	f := HostNamespaces(map[string]string{"Team.Example.com": "team"})
+
+	for host, expected := range map[string]string{
+		"team.example.com":      "team",
+		"TEAM.example.com:8080": "team",
+		"example.com":           "",
+	} {
+		req, _ := http.NewRequest("GET", "http://"+host+"/abc", nil)
+		if ns := f(req, context.Background()); ns != expected {
+			t.Errorf("%s: expected %q got %q", host, expected, ns)
+		}
+	}
+}
+
+func TestAuthorizeNamespace(t *testing.T) {
+	var namespaces []string
+	b := testNamespaceBackend{testKeyBackend: newTestKeyBackend(), namespaces: &namespaces}
+	shrt := New(b, WithNamespaces(PathNamespace), WithAuthenticator(APIKeys{Store: b}))
+
+	token, _, _ := CreateAPIKey(WithNamespace(context.Background(), "team"), b, ScopeReadStats)
+	global, _, _ := CreateAPIKey(WithNamespace(context.Background(), AnyNamespace), b, ScopeReadStats)
+	def, _, _ := CreateAPIKey(context.Background(), b, ScopeReadStats)
+
+	tests := []struct {
+		token string
+		ns    string
+		code  int
+		used  string
+	}{
+		{token: token, ns: "", code: http.StatusOK, used: "team"},
+		{token: token, ns: "team", code: http.StatusOK, used: "team"},
+		{token: token, ns: "other", code: http.StatusForbidden},
+		{token: global, ns: "other", code: http.StatusOK, used: "other"},
+		{token: global, ns: "", code: http.StatusOK, used: ""},
+		{token: def, ns: "", code: http.StatusOK, used: ""},
+		{token: def, ns: "other", code: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		namespaces = nil
+		res := namespaceRequest(shrt.InfoHandler(), "example.com", test.ns, test.token)
+		if res.Code != test.code {
+			t.Errorf("%q: expected %d got %d", test.ns, test.code, res.Code)
+			continue
+		}
+
+		if test.code == http.StatusOK && (len(namespaces) != 1 || namespaces[0] != test.used) {
+			t.Errorf("%q: expected namespace %q got %v", test.ns, test.used, namespaces)
+		}
+	}
+}
+
+func TestKeyHandlerNamespace(t *testing.T) {
+	b := newTestKeyBackend()
+	shrt := New(b, WithAuthenticator(APIKeys{Store: b}))
+	admin, _, _ := CreateAPIKey(WithNamespace(context.Background(), "team"), b, ScopeAdmin)
+	_, other, _ := CreateAPIKey(WithNamespace(context.Background(), "other"), b, ScopeCreate)
+
+	if res := authRequest(shrt.KeyHandler(), "POST", admin, "", `{"scopes":["create"],"namespace":"other"}`); res.Code != http.StatusForbidden {
+		t.Error("Key of another namespace created:", res.Code)
+	}
+
+	res := authRequest(shrt.KeyHandler(), "POST", admin, "", `{"scopes":["create"]}`)
+	var created KeyResponse
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil || created.Namespace != "team" {
+		t.Error("Key not created in the namespace of the admin:", created, err)
+	}
+
+	if res := authRequest(shrt.RevokeKeyHandler(), "DELETE", admin, other.ID, ""); res.Code != http.StatusNotFound {
+		t.Error("Key of another namespace revoked:", res.Code)
+	}
+
+	if res := authRequest(shrt.RevokeKeyHandler(), "DELETE", admin, created.ID, ""); res.Code != http.StatusNoContent {
+		t.Error("Expected 204 got:", res.Code)
+	}
+
+	// Admins of the default namespace are limited to it as well
+	def, _, _ := CreateAPIKey(context.Background(), b, ScopeAdmin)
+	for _, ns := range []string{"other", AnyNamespace} {
+		if res := authRequest(shrt.KeyHandler(), "POST", def, "", `{"scopes":["create"],"namespace":"`+ns+`"}`); res.Code != http.StatusForbidden {
+			t.Errorf("%q: key of another namespace created: %d", ns, res.Code)
+		}
+	}
+
+	if res := authRequest(shrt.RevokeKeyHandler(), "DELETE", def, other.ID, ""); res.Code != http.StatusNotFound {
+		t.Error("Key of another namespace revoked:", res.Code)
+	}
+
+	global, _, _ := CreateAPIKey(WithNamespace(context.Background(), AnyNamespace), b, ScopeAdmin)
+	res = authRequest(shrt.KeyHandler(), "POST", global, "", `{"scopes":["create"],"namespace":"*"}`)
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil || created.Namespace != AnyNamespace {
+		t.Error("Key of every namespace not created:", created, err)
+	}
+
+	if res := authRequest(shrt.RevokeKeyHandler(), "DELETE", global, other.ID, ""); res.Code != http.StatusNoContent {
+		t.Error("Expected 204 got:", res.Code)
+	}
+}
@@ -0,0 +1,226 @@
+package shrtie
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+)
+
+var (
+	errWrongPassword = errors.New("Wrong password")
+	errThrottled     = errors.New("Too many attempts, try again later")
+	errNoPasswords   = errors.New("Passwords not supported")
+)
+
+// Unlocks of a key are refused after maxFailures wrong passwords until
+// failureWindow passed since the first one
+const (
+	maxFailures   = 5
+	failureWindow = 15 * time.Minute
+)
+
+// passwordHeader carries the password of protected links for InfoHandler
+const passwordHeader = "X-Shrtie-Password"
+
+// Unlock is the JSON body API clients post to unlock a protected link.
+type Unlock struct {
+	Password string `json:"password"`
+}
+
+// WithPasswords enables links protected by a password. Only a bcrypt hash
+// of the password is stored. RedirectHandler answers protected links with a
+// form posting the password back to the link, so it has to be routed for
+// POST as well. API clients post an Unlock as JSON and get the target URL.
+// Links are looked at before their click is counted, so the backend has to
+// implement Peeker.
+func WithPasswords() Option {
+	return func(s *Shrtie) {
+		if _, ok := s.inner.(Peeker); !ok {
+			log.Panicln("Backend doesn't support Peeker interface")
+		}
+
+		s.throttle = &throttle{
+			failures: make(map[string]*failures),
+		}
+	}
+}
+
+// peek looks at the link of key through the wrappers of the backend, so a
+// Cache serves it without a call of the backend
+func (s Shrtie) peek(ctx context.Context, key string) (*Link, error) {
+	if peeker, ok := s.backend.(Peeker); ok {
+		return peeker.Peek(ctx, key)
+	}
+
+	return s.inner.(Peeker).Peek(ctx, key)
+}
+
+// protect returns the hash of password stored by the backends
+func (s Shrtie) protect(password string) (string, error) {
+	if s.throttle == nil {
+		return "", errNoPasswords
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// passwordError returns the request error of errors of protect
+func passwordError(err error) error {
+	if err == errNoPasswords {
+		return &requestError{http.StatusNotImplemented, err.Error()}
+	}
+
+	// bcrypt only fails for passwords longer than 72 bytes
+	return &requestError{http.StatusBadRequest, "Bad Password"}
+}
+
+// checkPassword verifies password against the hash of the link with key.
+// Wrong passwords are throttled per key, qualified with its namespace.
+func (s Shrtie) checkPassword(key, hash, password string) error {
+	if s.throttle == nil {
+		return errWrongPassword
+	}
+
+	if !s.throttle.allow(key) {
+		return errThrottled
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		s.throttle.fail(key)
+		return errWrongPassword
+	}
+
+	s.throttle.reset(key)
+	return nil
+}
+
+// unlock handles requests to a protected link. It answers the request
+// itself and returns false, unless the right password was posted.
+func (s Shrtie) unlock(w http.ResponseWriter, r *http.Request, key string, link *Link) bool {
+	if r.Method != http.MethodPost {
+		unlockForm(w, http.StatusOK, "")
+		return false
+	}
+
+	api := r.Header.Get("Content-Type") == "application/json"
+
+	var password string
+	if api {
+		var request Unlock
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Bad Data", http.StatusBadRequest)
+			return false
+		}
+		password = request.Password
+	} else {
+		password = r.PostFormValue("password")
+	}
+
+	err := s.checkPassword(key, link.Password, password)
+	if err == nil {
+		return true
+	}
+
+	code := http.StatusForbidden
+	if err == errThrottled {
+		code = http.StatusTooManyRequests
+	}
+
+	if api {
+		http.Error(w, err.Error(), code)
+	} else {
+		unlockForm(w, code, err.Error())
+	}
+
+	return false
+}
+
+var unlockPage = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="robots" content="noindex">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Protected link</title>
+</head>
+<body>
+	<form method="post">
+		<p>This link is protected by a password.</p>
+		{{if .}}<p><strong>{{.}}</strong></p>{{end}}
+		<input type="password" name="password" autofocus required>
+		<button type="submit">Open</button>
+	</form>
+</body>
+</html>
+`))
+
+// unlockForm renders the unlock page with an optional message
+func unlockForm(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	unlockPage.Execute(w, message)
+}
+
+// throttle counts the wrong passwords per key
+type throttle struct {
+	mu       sync.Mutex
+	failures map[string]*failures
+}
+
+type failures struct {
+	count int
+	since time.Time
+}
+
+func (t *throttle) allow(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+	return !ok || f.count < maxFailures || time.Since(f.since) > failureWindow
+}
+
+func (t *throttle) fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+	if !ok || time.Since(f.since) > failureWindow {
+		t.sweep()
+		f = &failures{since: time.Now()}
+		t.failures[key] = f
+	}
+
+	f.count++
+}
+
+func (t *throttle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.failures, key)
+}
+
+// sweep drops outdated failures once there are many, the caller has to hold
+// the lock
+func (t *throttle) sweep() {
+	if len(t.failures) < 1024 {
+		return
+	}
+
+	for key, f := range t.failures {
+		if time.Since(f.since) > failureWindow {
+			delete(t.failures, key)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package shrtie
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+)
+
+// lockedHash protects the "locked" key of testBackend with "secret"
+var lockedHash = func() string {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	return string(hash)
+}()
+
+func unlockRequest(handler Handler, method, contentType, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://example.com/locked", strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res := httptest.NewRecorder()
+	handler.f(res, req, context.WithValue(context.Background(), "id", "locked"))
+	return res
+}
+
+func TestUnlockForm(t *testing.T) {
+	handler := New(tb, WithPasswords()).RedirectHandler()
+
+	res := unlockRequest(handler, "GET", "", "")
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `type="password"`) {
+		t.Fatal("Unlock form not shown:", res.Code)
+	}
+	if res.Header().Get("Cache-Control") != "no-store" {
+		t.Error("Unlock form is cached")
+	}
+
+	form := "application/x-www-form-urlencoded"
+	res = unlockRequest(handler, "POST", form, url.Values{"password": {"wrong"}}.Encode())
+	if res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), errWrongPassword.Error()) {
+		t.Error("Wrong password accepted:", res.Code)
+	}
+
+	res = unlockRequest(handler, "POST", form, url.Values{"password": {"secret"}}.Encode())
+	if res.Code != http.StatusSeeOther || res.Header().Get("Location") != "https://here.com" {
+		t.Error("Right password not accepted:", res.Code, res.Header().Get("Location"))
+	}
+	if res.Header().Get("Cache-Control") != "no-store" {
+		t.Error("Unlocked redirect is cached")
+	}
+}
+
+func TestUnlockJSON(t *testing.T) {
+	handler := New(tb, WithPasswords()).RedirectHandler()
+
+	res := unlockRequest(handler, "POST", "application/json", `{"password":"wrong"}`)
+	if res.Code != http.StatusForbidden {
+		t.Error("Wrong password accepted:", res.Code)
+	}
+
+	res = unlockRequest(handler, "POST", "application/json", `{"password"`)
+	if res.Code != http.StatusBadRequest {
+		t.Error("Bad body accepted:", res.Code)
+	}
+
+	res = unlockRequest(handler, "POST", "application/json", `{"password":"secret"}`)
+	if res.Code != http.StatusOK {
+		t.Fatal("Right password not accepted:", res.Code)
+	}
+
+	var ack Ack
+	if err := json.NewDecoder(res.Body).Decode(&ack); err != nil || ack.URL != "https://here.com" {
+		t.Error("Wrong target:", ack, err)
+	}
+}
+
+func TestUnlockThrottle(t *testing.T) {
+	handler := New(tb, WithPasswords()).RedirectHandler()
+
+	for i := 0; i < maxFailures; i++ {
+		unlockRequest(handler, "POST", "application/json", `{"password":"wrong"}`)
+	}
+
+	// Even the right password is refused once throttled
+	res := unlockRequest(handler, "POST", "application/json", `{"password":"secret"}`)
+	if res.Code != http.StatusTooManyRequests {
+		t.Error("Unlock not throttled:", res.Code)
+	}
+}
+
+func TestUnlockDisabled(t *testing.T) {
+	// Protected links stay locked without WithPasswords
+	res := unlockRequest(New(tb).RedirectHandler(), "POST", "application/json", `{"password":"secret"}`)
+	if res.Code != http.StatusForbidden {
+		t.Error("Link unlocked without passwords:", res.Code)
+	}
+}
+
+func TestInfoProtected(t *testing.T) {
+	handler := New(tb, WithPasswords()).InfoHandler()
+
+	tests := map[string]string{
+		"":       "",
+		"wrong":  "",
+		"secret": "https://here.com",
+	}
+
+	for password, expected := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/locked", nil)
+		if password != "" {
+			req.Header.Set(passwordHeader, password)
+		}
+		res := httptest.NewRecorder()
+		handler.f(res, req, context.WithValue(context.Background(), "id", "locked"))
+
+		var metadata Metadata
+		if err := json.NewDecoder(res.Body).Decode(&metadata); err != nil {
+			t.Fatal(err)
+		}
+
+		if !metadata.Protected || metadata.URL != expected {
+			t.Errorf("Password %q: got %q, expected %q", password, metadata.URL, expected)
+		}
+		if strings.Contains(res.Body.String(), lockedHash) {
+			t.Error("Password hash exposed")
+		}
+	}
+}
+
+func TestSavePassword(t *testing.T) {
+	body := `{"url":"http://here.com","password":"secret"}`
+
+	req, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	New(tb).SaveHandler().f(res, req, context.Background())
+	if res.Code != http.StatusNotImplemented {
+		t.Error("Password saved without passwords:", res.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "http://example.com/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	res = httptest.NewRecorder()
+	New(tb, WithPasswords()).SaveHandler().f(res, req, context.Background())
+	if res.Code != http.StatusOK {
+		t.Error("Password not saved:", res.Code)
+	}
+}
+
+func TestWithPasswordsWithoutPeeker(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic for backend without Peeker")
+		}
+	}()
+
+	New(Legacy(testLegacyBackend{}), WithPasswords())
+}
@@ -0,0 +1,143 @@
+package shrtie
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var errNoPreviews = errors.New("Previews not supported")
+
+// Preview is the data the preview page is rendered with
+type Preview struct {
+	Key      string
+	URL      string     // Target of the link
+	Created  time.Time  // Created time of the link
+	Clicked  int64      // Click count
+	Expires  *time.Time // Expiration date, nil means forever
+	Continue string     // URL the continue button leads to
+}
+
+// DefaultPreview is the preview page used if WithPreview isn't given one.
+var DefaultPreview = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="robots" content="noindex">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Link preview</title>
+</head>
+<body>
+	<p>This link leads to:</p>
+	<p><strong>{{.URL}}</strong></p>
+	<p>Created {{.Created.Format "2006-01-02 15:04 MST"}}, clicked {{.Clicked}} times{{with .Expires}}, expires {{.Format "2006-01-02 15:04 MST"}}{{end}}.</p>
+	<p><a href="{{.Continue}}" rel="noreferrer">Continue</a></p>
+</body>
+</html>
+`))
+
+// WithPreview enables previews of links. RedirectHandler answers keys with a
+// "+" suffix like /s/abc+ or requests with the preview query parameter with
+// page instead of redirecting. Links saved with preview always show it. Nil
+// uses DefaultPreview. The page shows the metadata of the link, so the
+// backend has to implement Infoer.
+func WithPreview(page *template.Template) Option {
+	return func(s *Shrtie) {
+		if _, ok := s.infoer(); !ok {
+			log.Panicln("Backend doesn't support Infoer interface")
+		}
+
+		if page == nil {
+			page = DefaultPreview
+		}
+		s.preview = page
+	}
+}
+
+// previewKey returns the key of a request without the preview suffix and
+// whether a preview was requested
+func previewKey(r *http.Request, key string) (string, bool) {
+	if strings.HasSuffix(key, "+") {
+		return strings.TrimSuffix(key, "+"), true
+	}
+
+	_, ok := r.URL.Query()["preview"]
+	return key, ok
+}
+
+// showPreview answers a requested preview without counting a click, the
+// continue button leads to the link itself. It returns false for protected
+// links and links which always show the preview, RedirectHandler previews
+// them once they are unlocked and counted.
+func (s Shrtie) showPreview(w http.ResponseWriter, r *http.Request, ctx context.Context, key string) bool {
+	backendInfo, _ := s.infoer()
+	metadata, err := backendInfo.InfoContext(ctx, key)
+	if err != nil {
+		httpError(w, err)
+		return true
+	}
+
+	if metadata.Password != "" || metadata.Preview {
+		return false
+	}
+
+	if metadata.Remaining != nil && *metadata.Remaining == 0 {
+		httpError(w, ErrExhausted)
+		return true
+	}
+
+	if s.recheck {
+		if err = s.filter.Check(metadata.URL); err != nil {
+			httpError(w, err)
+			return true
+		}
+	}
+
+	// The link without preview suffix and parameter
+	query := r.URL.Query()
+	query.Del("preview")
+	link := url.URL{Path: strings.TrimSuffix(r.URL.Path, "+"), RawQuery: query.Encode()}
+
+	s.renderPreview(w, Preview{
+		Key:      key,
+		URL:      metadata.URL,
+		Created:  metadata.Created,
+		Clicked:  metadata.Clicked,
+		Expires:  metadata.Expires,
+		Continue: link.String(),
+	})
+	return true
+}
+
+// previewLink answers a link which was already counted with the preview,
+// the continue button leads to the target.
+func (s Shrtie) previewLink(w http.ResponseWriter, ctx context.Context, key string, link *Link) {
+	page := Preview{
+		Key:      key,
+		URL:      link.URL,
+		Continue: link.URL,
+	}
+
+	// The preview is shown anyway if the metadata is gone meanwhile
+	backendInfo, _ := s.infoer()
+	if metadata, err := backendInfo.InfoContext(ctx, key); err == nil {
+		page.Created = metadata.Created
+		page.Clicked = metadata.Clicked
+		page.Expires = metadata.Expires
+	}
+
+	s.renderPreview(w, page)
+}
+
+func (s Shrtie) renderPreview(w http.ResponseWriter, page Preview) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := s.preview.Execute(w, page); err != nil {
+		log.Println("Preview failed:", err)
+	}
+}
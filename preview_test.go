@@ -0,0 +1,110 @@
+package shrtie
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func previewRequest(handler Handler, target, id string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", target, nil)
+	res := httptest.NewRecorder()
+	handler.f(res, req, context.WithValue(context.Background(), "id", id))
+	return res
+}
+
+func TestPreview(t *testing.T) {
+	handler := New(tb, WithPreview(nil)).RedirectHandler()
+
+	tests := []struct {
+		target, id, link string
+	}{
+		{target: "http://example.com/s/abc+", id: "abc+", link: `href="/s/abc"`},
+		{target: "http://example.com/s/abc?preview", id: "abc", link: `href="/s/abc"`},
+		{target: "http://example.com/s/abc?preview=1&lang=de", id: "abc", link: `href="/s/abc?lang=de"`},
+	}
+
+	for _, test := range tests {
+		res := previewRequest(handler, test.target, test.id)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected preview got %d", test.target, res.Code)
+		}
+
+		body := res.Body.String()
+		if !strings.Contains(body, "https://here.com") || !strings.Contains(body, "2000-01-01") || !strings.Contains(body, test.link) {
+			t.Errorf("%s: wrong preview:\n%s", test.target, body)
+		}
+
+		if res.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: preview is cached", test.target)
+		}
+	}
+
+	// Without preview the link redirects
+	if res := previewRequest(handler, "http://example.com/s/abc", "abc"); res.Code != http.StatusMovedPermanently {
+		t.Error("Expected redirect got:", res.Code)
+	}
+
+	if res := previewRequest(handler, "http://example.com/s/aaa+", "aaa+"); res.Code != http.StatusNotFound {
+		t.Error("Expected not found got:", res.Code)
+	}
+}
+
+func TestPreviewForced(t *testing.T) {
+	handler := New(tb, WithPreview(nil)).RedirectHandler()
+
+	res := previewRequest(handler, "http://example.com/s/preview", "preview")
+	if res.Code != http.StatusOK {
+		t.Fatal("Expected preview got:", res.Code)
+	}
+
+	// The click is counted, so the button leads to the target
+	body := res.Body.String()
+	if !strings.Contains(body, `href="https://here.com"`) || !strings.Contains(body, "clicked 7 times") {
+		t.Errorf("Wrong preview:\n%s", body)
+	}
+}
+
+func TestPreviewDisabled(t *testing.T) {
+	handler := New(tb).RedirectHandler()
+
+	if res := previewRequest(handler, "http://example.com/s/abc+", "abc+"); res.Code != http.StatusNotFound {
+		t.Error("Expected not found got:", res.Code)
+	}
+
+	if res := previewRequest(handler, "http://example.com/s/preview", "preview"); res.Code != http.StatusMovedPermanently {
+		t.Error("Expected redirect got:", res.Code)
+	}
+
+	req, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader(`{"url":"http://here.com","preview":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	New(tb).SaveHandler().f(res, req, context.Background())
+	if res.Code != http.StatusNotImplemented {
+		t.Error("Preview saved without previews:", res.Code)
+	}
+}
+
+func TestPreviewTemplate(t *testing.T) {
+	page := template.Must(template.New("custom").Parse(`{{.Key}} -> {{.URL}}`))
+	handler := New(tb, WithPreview(page)).RedirectHandler()
+
+	res := previewRequest(handler, "http://example.com/s/abc+", "abc+")
+	if res.Body.String() != "abc -> https://here.com" {
+		t.Error("Custom template not used:", res.Body.String())
+	}
+}
+
+func TestWithPreviewWithoutInfoer(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic for backend without Infoer")
+		}
+	}()
+
+	New(Legacy(testBackendWithoutInfoer{}), WithPreview(nil))
+}
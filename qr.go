@@ -0,0 +1,231 @@
+package shrtie
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Limits of the QR code query parameters. The smallest code has 21 modules,
+// longer URLs and margins need more pixels, see qrMinSize.
+const (
+	minQRSize     = 21
+	maxQRSize     = 2048
+	defaultQRSize = 256
+	maxQRMargin   = 16
+)
+
+// qrLevels maps the error correction levels of the level parameter
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,     // 7%
+	"M": qrcode.Medium,  // 15%
+	"Q": qrcode.High,    // 25%
+	"H": qrcode.Highest, // 30%
+}
+
+// qrOptions are the query parameters of QRHandler
+type qrOptions struct {
+	format string
+	size   int
+	level  qrcode.RecoveryLevel
+	margin int
+}
+
+// QRHandler answers the short URL of the link as QR code. The URL is built
+// like the one returned by SaveHandler, with base as path RedirectHandler is
+// routed at, e.g. "/s/". The query parameters are format (png or svg), size
+// in pixels, level of error correction (L, M, Q or H) and margin in modules.
+// Unknown and expired links are answered like by RedirectHandler without
+// counting a click, so the backend has to implement Peeker.
+func (s Shrtie) QRHandler(base string) Handler {
+	// Check if backend implements Peeker interface
+	if backendPeeker, ok := s.inner.(Peeker); ok {
+		return s.namespaced(Handler{
+			f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+				opts, err := parseQROptions(r)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				key := ctx.Value("id").(string)
+				link, err := backendPeeker.Peek(ctx, key)
+				if err != nil {
+					httpError(w, err)
+					return
+				}
+
+				code, err := qrcode.New(shortURL(r, ctx, base, key), opts.level)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				code.DisableBorder = true
+
+				if min := qrMinSize(code.Bitmap(), opts); opts.size < min {
+					http.Error(w, fmt.Sprintf("Bad Size, the code needs at least %d pixels", min), http.StatusBadRequest)
+					return
+				}
+
+				var body []byte
+				if opts.format == "svg" {
+					w.Header().Set("Content-Type", "image/svg+xml")
+					body = qrSVG(code.Bitmap(), opts)
+				} else {
+					w.Header().Set("Content-Type", "image/png")
+					if body, err = qrPNG(code.Bitmap(), opts); err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+				}
+
+				// The code only changes with the short URL, which lives as
+				// long as the link
+				maxAge := int64(365 * 24 * time.Hour / time.Second)
+				if link.TTL != 0 {
+					maxAge = Seconds(link.TTL)
+				}
+				sum := sha1.Sum(body)
+				w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(maxAge, 10))
+				w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+				return
+			},
+		})
+	}
+
+	// Exit programm if backend doesn't support Peeker interface
+	log.Panicln("Backend doesn't support Peeker interface")
+	return Handler{}
+}
+
+// shortURL returns the URL of key under base, the scheme and host are taken
+// from the request like in SaveHandler. The namespace path parameter is
+// added to base, so keys of /qr/:ns/:id are found under /s/:ns/:id.
+func shortURL(r *http.Request, ctx context.Context, base, key string) string {
+	if ns, _ := ctx.Value("ns").(string); ns != "" {
+		base = strings.TrimSuffix(base, "/") + "/" + ns + "/"
+	}
+
+	u := *r.URL
+	u.Path, u.RawPath, u.RawQuery = base, "", ""
+
+	req := *r
+	req.URL = &u
+	return concatURL(&req, key)
+}
+
+// parseQROptions reads the query parameters of QRHandler, missing ones
+// result in a 256 pixel PNG with level M and a margin of 4 modules.
+func parseQROptions(r *http.Request) (qrOptions, error) {
+	query := r.URL.Query()
+	opts := qrOptions{
+		format: "png",
+		size:   defaultQRSize,
+		level:  qrcode.Medium,
+		margin: 4,
+	}
+
+	if format := query.Get("format"); format != "" {
+		if format != "png" && format != "svg" {
+			return opts, errors.New("Bad Format")
+		}
+		opts.format = format
+	}
+
+	if size := query.Get("size"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < minQRSize || n > maxQRSize {
+			return opts, fmt.Errorf("Bad Size, has to be %d to %d", minQRSize, maxQRSize)
+		}
+		opts.size = n
+	}
+
+	if level := query.Get("level"); level != "" {
+		l, ok := qrLevels[level]
+		if !ok {
+			return opts, errors.New("Bad Level, has to be L, M, Q or H")
+		}
+		opts.level = l
+	}
+
+	if margin := query.Get("margin"); margin != "" {
+		n, err := strconv.Atoi(margin)
+		if err != nil || n < 0 || n > maxQRMargin {
+			return opts, fmt.Errorf("Bad Margin, has to be 0 to %d", maxQRMargin)
+		}
+		opts.margin = n
+	}
+
+	return opts, nil
+}
+
+// qrMinSize returns the size of the code with its margin in modules, every
+// module needs at least one pixel
+func qrMinSize(bitmap [][]bool, opts qrOptions) int {
+	return len(bitmap) + 2*opts.margin
+}
+
+// qrPNG renders the modules with whole pixels per module, the code is
+// centered if the size isn't a multiple of the modules.
+func qrPNG(bitmap [][]bool, opts qrOptions) ([]byte, error) {
+	modules := qrMinSize(bitmap, opts)
+	scale := opts.size / modules
+	if scale == 0 {
+		return nil, fmt.Errorf("Bad Size, the code needs at least %d pixels", modules)
+	}
+	offset := (opts.size-scale*modules)/2 + opts.margin*scale
+
+	// Index 0 is white, so the new image is blank
+	img := image.NewPaletted(image.Rect(0, 0, opts.size, opts.size), color.Palette{color.White, color.Black})
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetColorIndex(offset+x*scale+px, offset+y*scale+py, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// qrSVG renders the modules as one path, scaled to the size by the viewer
+func qrSVG(bitmap [][]bool, opts qrOptions) []byte {
+	modules := qrMinSize(bitmap, opts)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		opts.size, opts.size, modules, modules)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, modules, modules)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+opts.margin, y+opts.margin)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+
+	return buf.Bytes()
+}
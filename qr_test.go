@@ -0,0 +1,140 @@
+package shrtie
+
+import (
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"golang.org/x/net/context"
+)
+
+func qrRequest(handler Handler, target, id string, header http.Header) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res := httptest.NewRecorder()
+	handler.f(res, req, context.WithValue(context.Background(), "id", id))
+	return res
+}
+
+func TestQRHandler(t *testing.T) {
+	handler := New(tb).QRHandler("/s/")
+
+	res := qrRequest(handler, "http://example.com/qr/abc?size=300&level=H&margin=2", "abc", nil)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "image/png" {
+		t.Fatal("Expected PNG got:", res.Code, res.Header().Get("Content-Type"))
+	}
+
+	img, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatal("Invalid PNG:", err)
+	}
+	if b := img.Bounds(); b.Dx() != 300 || b.Dy() != 300 {
+		t.Error("Wrong size:", b)
+	}
+
+	if res.Header().Get("Cache-Control") != "public, max-age=31536000" {
+		t.Error("Wrong Cache-Control:", res.Header().Get("Cache-Control"))
+	}
+
+	// Links with TTL are cached until they expire
+	res = qrRequest(handler, "http://example.com/qr/ttl?format=svg", "ttl", nil)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatal("Expected SVG got:", res.Code, res.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(res.Body.String(), "<svg") || !strings.Contains(res.Body.String(), `width="256"`) {
+		t.Error("Wrong SVG:", res.Body.String())
+	}
+	if res.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Error("Wrong Cache-Control:", res.Header().Get("Cache-Control"))
+	}
+
+	// Unchanged codes aren't sent again
+	etag := res.Header().Get("ETag")
+	res = qrRequest(handler, "http://example.com/qr/ttl?format=svg", "ttl", http.Header{"If-None-Match": {etag}})
+	if etag == "" || res.Code != http.StatusNotModified {
+		t.Error("Expected not modified got:", res.Code)
+	}
+}
+
+func TestQRHandlerErrors(t *testing.T) {
+	handler := New(tb).QRHandler("/s/")
+
+	tests := []struct {
+		query, id string
+		code      int
+	}{
+		{id: "aaa", code: http.StatusNotFound},
+		{id: "gone", code: http.StatusGone},
+		{id: "down", code: http.StatusServiceUnavailable},
+		{query: "?format=gif", id: "abc", code: http.StatusBadRequest},
+		{query: "?size=big", id: "abc", code: http.StatusBadRequest},
+		{query: "?size=1", id: "abc", code: http.StatusBadRequest},
+		{query: "?level=X", id: "abc", code: http.StatusBadRequest},
+		{query: "?margin=-1", id: "abc", code: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		res := qrRequest(handler, "http://example.com/qr/"+test.id+test.query, test.id, nil)
+		if res.Code != test.code {
+			t.Errorf("%s%s: expected %d got %d", test.id, test.query, test.code, res.Code)
+		}
+	}
+}
+
+func TestQRHandlerMinSize(t *testing.T) {
+	handler := New(tb).QRHandler("/s/")
+
+	// The smallest code fits exactly without margin
+	res := qrRequest(handler, "http://e.co/qr/abc?size="+strconv.Itoa(minQRSize)+"&level=L&margin=0", "abc", nil)
+	if res.Code != http.StatusOK {
+		t.Error("Expected smallest size to work got:", res.Code, res.Body.String())
+	}
+
+	// Codes with the default margin need a pixel per module
+	code, err := qrcode.New("http://example.com/s/abc", qrcode.Medium)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code.DisableBorder = true
+	min := len(code.Bitmap()) + 8
+
+	res = qrRequest(handler, "http://example.com/qr/abc?size="+strconv.Itoa(min), "abc", nil)
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected size %d to work got: %d", min, res.Code)
+	}
+
+	res = qrRequest(handler, "http://example.com/qr/abc?size="+strconv.Itoa(min-1), "abc", nil)
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), strconv.Itoa(min)) {
+		t.Errorf("Expected size %d to be rejected got: %d %s", min-1, res.Code, res.Body.String())
+	}
+}
+
+func TestShortURL(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/qr/abc?size=100", nil)
+	req.Host = "example.com"
+
+	if url := shortURL(req, context.Background(), "/s/", "abc"); url != "http://example.com/s/abc" {
+		t.Error("Wrong short URL:", url)
+	}
+
+	ctx := context.WithValue(context.Background(), "ns", "team")
+	if url := shortURL(req, ctx, "/s/", "abc"); url != "http://example.com/s/team/abc" {
+		t.Error("Wrong short URL with namespace:", url)
+	}
+}
+
+func TestQRHandlerWithoutPeeker(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic for backend without Peeker")
+		}
+	}()
+
+	New(Legacy(testLegacyBackend{})).QRHandler("/s/")
+}
@@ -0,0 +1,255 @@
+package shrtie
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("Too Many Requests") // 429 Too Many Requests
+
+// Limit is a token bucket. Clients may send Burst requests at once, after
+// that the bucket refills with Rate requests per Period.
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int // Defaults to Rate
+}
+
+// Capacity returns the number of tokens of a full bucket
+func (l Limit) Capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+
+	return l.Rate
+}
+
+// Interval returns the time it takes to refill one token
+func (l Limit) Interval() time.Duration {
+	return l.Period / time.Duration(l.Rate)
+}
+
+// Take takes a token from a bucket which is full again at full, zero for a
+// new bucket. It returns the new full time and if there was a token, so
+// stores only have to keep the full time of each bucket.
+func (l Limit) Take(full, now time.Time) (time.Time, bool) {
+	if full.Before(now) {
+		full = now
+	}
+
+	// Each taken token pushes the full time one interval further
+	if full.Sub(now) > time.Duration(l.Capacity()-1)*l.Interval() {
+		return full, false
+	}
+
+	return full.Add(l.Interval()), true
+}
+
+// State returns the state of a bucket which is full again after wait
+func (l Limit) State(allowed bool, wait time.Duration) LimitState {
+	interval := l.Interval()
+	b := LimitState{
+		Allowed: allowed,
+		Reset:   wait,
+	}
+
+	if b.Remaining = l.Capacity() - int((wait+interval-1)/interval); b.Remaining < 0 {
+		b.Remaining = 0
+	}
+
+	if !allowed {
+		b.RetryAfter = wait - time.Duration(l.Capacity()-1)*interval
+	}
+
+	return b
+}
+
+// LimitState is the state of a token bucket after a request
+type LimitState struct {
+	Allowed    bool
+	Remaining  int           // Tokens left
+	Reset      time.Duration // Until the bucket is full again
+	RetryAfter time.Duration // Until the next token, only set if the request isn't allowed
+}
+
+// LimitStore keeps token buckets. Take takes a token from the bucket of key
+// if there is one, new buckets are full.
+type LimitStore interface {
+	Take(ctx context.Context, key string, limit Limit) (LimitState, error)
+}
+
+// LocalLimits keeps token buckets in memory, so each process has its own.
+// Use a shared store like the redis backend for several replicas.
+type LocalLimits struct {
+	mu   sync.Mutex
+	full map[string]time.Time
+}
+
+func NewLocalLimits() *LocalLimits {
+	return &LocalLimits{full: make(map[string]time.Time)}
+}
+
+func (l *LocalLimits) Take(_ context.Context, key string, limit Limit) (LimitState, error) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	old, ok := l.full[key]
+	full, allowed := limit.Take(old, now)
+	if !ok {
+		l.sweep(now)
+	}
+	l.full[key] = full
+
+	return limit.State(allowed, full.Sub(now)), nil
+}
+
+// sweep drops full buckets once there are many, they are the same as new
+// ones. The caller has to hold the lock.
+func (l *LocalLimits) sweep(now time.Time) {
+	if len(l.full) < 1024 {
+		return
+	}
+
+	for key, full := range l.full {
+		if !full.After(now) {
+			delete(l.full, key)
+		}
+	}
+}
+
+// RateLimiter limits requests per client IP and per API key, wrap handlers
+// with Handler.
+type RateLimiter struct {
+	store LimitStore
+	name  string
+	ip    Limit
+	key   Limit
+	auth  Authenticator
+}
+
+// LimitOption configures a RateLimiter
+type LimitOption func(*RateLimiter)
+
+// PerIP limits requests per client IP. IPv6 clients are limited per /64
+// network, since they usually get a whole one.
+func PerIP(limit Limit) LimitOption {
+	validLimit(limit)
+
+	return func(l *RateLimiter) {
+		l.ip = limit
+	}
+}
+
+// PerAPIKey limits requests with credentials accepted by auth per identity
+// instead of per IP, usually auth is the one of WithAuthenticator.
+func PerAPIKey(limit Limit, auth Authenticator) LimitOption {
+	validLimit(limit)
+
+	return func(l *RateLimiter) {
+		l.key = limit
+		l.auth = auth
+	}
+}
+
+func validLimit(limit Limit) {
+	if limit.Rate < 1 || limit.Period <= 0 || limit.Burst < 0 || limit.Interval() <= 0 {
+		log.Panicln("Invalid rate limit", limit)
+	}
+}
+
+// NewRateLimiter returns a RateLimiter keeping its buckets in store. The
+// buckets are named after name, so limiters with different limits can
+// share a store.
+func NewRateLimiter(store LimitStore, name string, opts ...LimitOption) *RateLimiter {
+	l := &RateLimiter{
+		store: store,
+		name:  name,
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	return l
+}
+
+// Handler wraps h, so requests are only passed on while their bucket has
+// tokens. Other requests are answered with 429 Too Many Requests and a
+// Retry-After header, every answer gets the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers. Requests pass if the
+// store fails.
+func (l *RateLimiter) Handler(h Handler) Handler {
+	return Handler{
+		f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+			key, limit := l.bucket(r, ctx)
+			if key == "" {
+				h.f(w, r, ctx)
+				return
+			}
+
+			state, err := l.store.Take(ctx, l.name+":"+key, limit)
+			if err != nil {
+				log.Println("Failed to take rate limit token:", err)
+				h.f(w, r, ctx)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Capacity()))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(state.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(state.Reset), 10))
+
+			if !state.Allowed {
+				w.Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(state.RetryAfter), 10))
+				httpError(w, ErrRateLimited)
+				return
+			}
+
+			h.f(w, r, ctx)
+		},
+	}
+}
+
+// bucket returns the bucket key and limit of the request, an empty key if
+// it isn't limited
+func (l *RateLimiter) bucket(r *http.Request, ctx context.Context) (string, Limit) {
+	if l.auth != nil && r.Header.Get("Authorization") != "" {
+		// Invalid credentials are limited per IP, handlers reject them
+		if identity, err := l.auth.Authenticate(ctx, r); err == nil {
+			return "key:" + identity.ID, l.key
+		}
+	}
+
+	if l.ip.Rate == 0 {
+		return "", Limit{}
+	}
+
+	return "ip:" + clientIP(r), l.ip
+}
+
+// clientIP returns the IP of the client, IPv6 addresses cut to their /64
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// ceilSeconds returns d in whole seconds, rounded up
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
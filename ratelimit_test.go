@@ -0,0 +1,132 @@
+package shrtie
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testFailingLimits fails every Take
+type testFailingLimits struct{}
+
+func (testFailingLimits) Take(ctx context.Context, key string, limit Limit) (LimitState, error) {
+	return LimitState{}, errors.New("down")
+}
+
+func limitRequest(handler Handler, remoteAddr, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "http://example.com/abc", nil)
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res := httptest.NewRecorder()
+	handler.f(res, req, context.WithValue(context.Background(), "id", "abc"))
+	return res
+}
+
+func TestLimitTake(t *testing.T) {
+	limit := Limit{Rate: 1, Period: time.Minute, Burst: 2}
+	now := time.Now()
+
+	var full time.Time
+	var allowed bool
+	for i := 1; i >= 0; i-- {
+		if full, allowed = limit.Take(full, now); !allowed {
+			t.Fatal("Token of a full bucket not taken")
+		}
+
+		if state := limit.State(true, full.Sub(now)); state.Remaining != i || state.Reset != time.Duration(2-i)*time.Minute {
+			t.Errorf("Wrong state: %+v", state)
+		}
+	}
+
+	if full, allowed = limit.Take(full, now); allowed {
+		t.Fatal("Token of an empty bucket taken")
+	}
+
+	if state := limit.State(false, full.Sub(now)); state.Remaining != 0 || state.RetryAfter != time.Minute {
+		t.Errorf("Wrong state: %+v", state)
+	}
+
+	// One token is back after the interval
+	if _, allowed = limit.Take(full, now.Add(time.Minute)); !allowed {
+		t.Error("Refilled token not taken")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	b := newTestKeyBackend()
+	token, _, _ := CreateAPIKey(context.Background(), b, ScopeCreate)
+
+	limiter := NewRateLimiter(NewLocalLimits(), "redirect",
+		PerIP(Limit{Rate: 2, Period: time.Minute}),
+		PerAPIKey(Limit{Rate: 10, Period: time.Minute}, APIKeys{Store: b}))
+	handler := limiter.Handler(New(tb).RedirectHandler())
+
+	for i := 1; i >= 0; i-- {
+		res := limitRequest(handler, "192.0.2.1:1234", "")
+		if res.Code != http.StatusMovedPermanently {
+			t.Fatal("Expected 301 got:", res.Code)
+		}
+
+		if res.Header().Get("RateLimit-Limit") != "2" || res.Header().Get("RateLimit-Remaining") != strconv.Itoa(i) {
+			t.Error("Wrong headers:", res.Header())
+		}
+	}
+
+	res := limitRequest(handler, "192.0.2.1:4321", "")
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") != "30" || res.Header().Get("RateLimit-Reset") != "60" {
+		t.Error("Expected 429 after 30s got:", res.Code, res.Header())
+	}
+
+	// Other clients and API keys have their own buckets
+	if res = limitRequest(handler, "192.0.2.2:1234", ""); res.Code != http.StatusMovedPermanently {
+		t.Error("Other IP limited:", res.Code)
+	}
+
+	if res = limitRequest(handler, "192.0.2.1:1234", token); res.Code != http.StatusMovedPermanently || res.Header().Get("RateLimit-Limit") != "10" {
+		t.Error("API key limited per IP:", res.Code, res.Header())
+	}
+
+	// Invalid credentials don't escape the IP limit
+	if res = limitRequest(handler, "192.0.2.1:1234", "abc.def"); res.Code != http.StatusTooManyRequests {
+		t.Error("Invalid API key not limited per IP:", res.Code)
+	}
+}
+
+func TestRateLimiterFailingStore(t *testing.T) {
+	handler := NewRateLimiter(testFailingLimits{}, "redirect", PerIP(Limit{Rate: 1, Period: time.Minute})).Handler(New(tb).RedirectHandler())
+
+	if res := limitRequest(handler, "192.0.2.1:1234", ""); res.Code != http.StatusMovedPermanently {
+		t.Error("Request failed with the store:", res.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for remoteAddr, expected := range map[string]string{
+		"192.0.2.1:1234":              "192.0.2.1",
+		"[2001:db8:1:2:3:4:5:6]:1234": "2001:db8:1:2::",
+		"[::ffff:192.0.2.1]:1234":     "::ffff:192.0.2.1",
+		"unix":                        "unix",
+	} {
+		req := &http.Request{RemoteAddr: remoteAddr}
+		if ip := clientIP(req); ip != expected {
+			t.Errorf("%s: expected %s got %s", remoteAddr, expected, ip)
+		}
+	}
+}
+
+func TestPerIPInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic for invalid limit")
+		}
+	}()
+
+	PerIP(Limit{Period: time.Minute})
+}
@@ -3,63 +3,124 @@ package shrtie
 import (
 	"encoding/json"
 	"golang.org/x/net/context"
+	"html/template"
 	"log"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/julienschmidt/httprouter"
 )
 
+// validKey matches keys which are safe to be chosen by the user
+var validKey = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+
 type Infoer interface {
 	Info(string) (*Metadata, error)
 }
 
+// GetSaver is the original backend interface, use Legacy to turn it into
+// a Backend.
 type GetSaver interface {
 	Get(string) (string, error)
 	Save(string, time.Duration) string
 }
 
 type Metadata struct {
-	URL     string    `json:"url"`           // The shortened URL
-	TTL     int64     `json:"ttl,omitempty"` // Time to life in seconds
-	Clicked int64     `json:"click_count"`   // Click count
-	Created time.Time `json:"created"`       // Created time the format is specified in RFC 3339
+	URL       string     `json:"url"`                  // The shortened URL
+	TTL       int64      `json:"ttl,omitempty"`        // Time to life in seconds
+	Expires   *time.Time `json:"expires,omitempty"`    // Expiration date the format is specified in RFC 3339
+	Redirect  int        `json:"redirect,omitempty"`   // Redirect status code of the link, 0 means the default of the server
+	Clicked   int64      `json:"click_count"`          // Click count
+	MaxClicks int64      `json:"max_clicks,omitempty"` // Click limit of the link, 0 means unlimited
+	Remaining *int64     `json:"remaining,omitempty"`  // Clicks left if the link has a limit
+	Protected bool       `json:"protected,omitempty"`  // The link is protected by a password, the URL is only shown with it
+	Preview   bool       `json:"preview,omitempty"`    // The link always shows the preview page
+	Password  string     `json:"-"`                    // Hash of the password, set by backends
+	Created   time.Time  `json:"created"`              // Created time the format is specified in RFC 3339
 }
 
 type Entry struct {
-	URL     string    `json:"url"`               // The URL to shorten
-	TTL     int64     `json:"ttl,omitempty"`     // Time in seconds to life. Overwrites Expires
-	Expires time.Time `json:"expires,omitempty"` // Sets the expiration date. Format is specified in RFC 3339
+	URL       string    `json:"url"`                  // The URL to shorten
+	TTL       Duration  `json:"ttl,omitempty"`        // Time to life in seconds or as string like "7d". Overwrites Expires
+	Expires   time.Time `json:"expires,omitempty"`    // Sets the expiration date. Format is specified in RFC 3339
+	Alias     string    `json:"alias,omitempty"`      // Optional key to use instead of a generated one
+	Redirect  int       `json:"redirect,omitempty"`   // Optional redirect status code, one of 301, 302, 303, 307 and 308
+	MaxClicks int64     `json:"max_clicks,omitempty"` // Optional number of clicks the link works for, 1 for one-time links
+	Password  string    `json:"password,omitempty"`   // Optional password to protect the link with, see WithPasswords
+	Preview   bool      `json:"preview,omitempty"`    // Optionally always show the preview page, see WithPreview
+}
+
+// UpdateEntry is the body of UpdateHandler, absent fields keep the current
+// value of the link.
+type UpdateEntry struct {
+	URL       string    `json:"url,omitempty"`        // New target URL
+	TTL       *Duration `json:"ttl,omitempty"`        // New time to life from now, 0 removes the expiry. Overwrites Expires
+	Expires   time.Time `json:"expires,omitempty"`    // New expiration date
+	Redirect  int       `json:"redirect,omitempty"`   // New redirect status code
+	MaxClicks *int64    `json:"max_clicks,omitempty"` // New click limit, 0 removes it
+	Password  *string   `json:"password,omitempty"`   // New password, "" removes the protection, see WithPasswords
+	Preview   *bool     `json:"preview,omitempty"`    // Always show the preview page, see WithPreview
 }
 
 type Ack struct {
-	URL string `json:"url"` // The shortened URL
+	URL    string `json:"url"`    // The shortened URL
+	Reused bool   `json:"reused"` // An existing link to the same URL was returned, see WithDeduplication
 }
 
 type Shrtie struct {
-	backend GetSaver
+	backend     Backend
+	inner       Backend // Innermost backend, for the optional interfaces
+	maxTTL      time.Duration
+	redirect    int
+	deduplicate bool
+	policy      URLPolicy
+	filter      *DomainFilter
+	recheck     bool
+	analytics   Analytics
+	anonymize   bool
+	throttle    *throttle          // Set if passwords are enabled
+	preview     *template.Template // Set if previews are enabled
+	concurrency int                // Entries of BulkSaveHandler processed at once
+	auth        Authenticator      // Set if handlers require credentials
+	namespace   NamespaceFunc      // Set if links are separated into namespaces
+}
+
+// Option configures a Shrtie
+type Option func(*Shrtie)
+
+// WithMaxTTL limits the time to life of new and updated links. Links
+// without TTL get the maximum, longer TTLs are rejected.
+func WithMaxTTL(max time.Duration) Option {
+	return func(s *Shrtie) {
+		s.maxTTL = max
+	}
 }
 
 type Handler struct {
-	// Function handels request. Context contains the request id under the key "id" as string.
+	// Function handels request. Context contains the request id under the key "id" as string,
+	// the namespace path parameter under "ns" if the router has one.
 	f func(http.ResponseWriter, *http.Request, context.Context)
 }
 
 func (h Handler) Httprouter() httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		background := context.Background()
-		ctx := context.WithValue(background, "id", p.ByName("id"))
+		ctx := context.WithValue(r.Context(), "id", p.ByName("id"))
+		ctx = context.WithValue(ctx, "ns", p.ByName("ns"))
 		h.f(w, r, ctx)
 	}
 }
 
 func (h Handler) Mux() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		background := context.Background()
-		ctx := context.WithValue(background, "id", mux.Vars(r)["id"])
+		vars := mux.Vars(r)
+		ctx := context.WithValue(r.Context(), "id", vars["id"])
+		ctx = context.WithValue(ctx, "ns", vars["ns"])
 		h.f(w, r, ctx)
 	}
 }
@@ -67,53 +128,166 @@ func (h Handler) Mux() http.HandlerFunc {
 func (h Handler) ServerMux() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := path.Base(r.URL.Path)
-		background := context.Background()
-		ctx := context.WithValue(background, "id", id)
+		ctx := context.WithValue(r.Context(), "id", id)
 		h.f(w, r, ctx)
 	}
 }
 
-func New(backend GetSaver) Shrtie {
-	return Shrtie{
-		backend: backend,
+// WithRedirectStatus sets the status code of redirects, links can override
+// it. Permanent redirects (301, 308) are cached by browsers, so changes and
+// expiry of links don't reach users who already clicked them. Use one of
+// the temporary ones (302, 303, 307) if that matters. Defaults to 301.
+func WithRedirectStatus(code int) Option {
+	if !validRedirect(code) {
+		log.Panicln("Invalid redirect status code", code)
+	}
+
+	return func(s *Shrtie) {
+		s.redirect = code
 	}
 }
 
+// New returns a Shrtie using the backend. Wrap implementations of the old
+// GetSaver interface with Legacy.
+func New(backend Backend, opts ...Option) Shrtie {
+	s := Shrtie{
+		backend:     backend,
+		inner:       Unwrap(backend),
+		redirect:    http.StatusMovedPermanently,
+		concurrency: defaultBulkConcurrency,
+	}
+
+	for _, opt := range opts {
+		opt(&s)
+	}
+
+	return s
+}
+
 func (s Shrtie) RedirectHandler() Handler {
-	return Handler{
+	return s.namespaced(Handler{
 		f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
 			// Get julienschmidt/httprouter path parameter
 			// the is represents the (base64?) identifier used by the backend
-			value, err := s.backend.Get(ctx.Value("id").(string))
+			key := ctx.Value("id").(string)
+
+			var preview bool
+			if s.preview != nil {
+				if key, preview = previewKey(r, key); preview && s.showPreview(w, r, ctx, key) {
+					return
+				}
+			}
+
+			// Protected links are unlocked before the click is counted
+			var unlocked bool
+			if s.throttle != nil {
+				link, err := s.peek(ctx, key)
+				if err != nil {
+					httpError(w, err)
+					return
+				}
+
+				if link.Password != "" {
+					if !s.unlock(w, r, qualify(ctx, key), link) {
+						return
+					}
+					unlocked = true
+				}
+			}
+
+			link, err := s.backend.Get(ctx, key)
 			if err != nil {
-				http.Error(w, "Wrong Path", http.StatusNotFound)
+				httpError(w, err)
+				return
+			}
+
+			// Protected links stay locked if passwords are disabled
+			if link.Password != "" && !unlocked && !s.unlock(w, r, qualify(ctx, key), link) {
+				return
+			}
+
+			if s.recheck {
+				if err = s.filter.Check(link.URL); err != nil {
+					httpError(w, err)
+					return
+				}
+			}
+
+			code := s.redirect
+			if link.Redirect != 0 {
+				code = link.Redirect
+			}
+
+			switch {
+			case link.MaxClicks != 0 || link.Password != "":
+				// Limited and protected links must not be served from caches
+				w.Header().Set("Cache-Control", "no-store")
+			case code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect:
+				// Let caches keep the redirect until the link expires
+				maxAge := int64(365 * 24 * time.Hour / time.Second)
+				if link.TTL != 0 {
+					maxAge = Seconds(link.TTL)
+				}
+				w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(maxAge, 10))
+			default:
+				// Every click has to reach the server
+				w.Header().Set("Cache-Control", "no-store")
+			}
+
+			if s.analytics != nil {
+				s.analytics.Record(s.click(r, ctx, key))
+			}
+
+			if unlocked {
+				// API clients get the target, forms are redirected with GET
+				if r.Header.Get("Content-Type") == "application/json" {
+					json.NewEncoder(w).Encode(Ack{URL: link.URL})
+					return
+				}
+				code = http.StatusSeeOther
+			}
+
+			if s.preview != nil && (preview || link.Preview) {
+				s.previewLink(w, ctx, key, link)
 				return
 			}
 
-			http.Redirect(w, r, value, http.StatusMovedPermanently)
+			http.Redirect(w, r, link.URL, code)
 			return
 		},
-	}
+	})
 }
 
 func (s Shrtie) InfoHandler() Handler {
 	// Check if backend implements Infoer interface
-	if backendInfo, ok := s.backend.(Infoer); ok {
-		return Handler{
+	if backendInfo, ok := s.infoer(); ok {
+		return s.authorize(ScopeReadStats, Handler{
 			f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
 				// Get julienschmidt/httprouter path parameter
 				// the is represents the (base64?) identifier used by the backend
 				// Metadata is the returned struct of meta-infos to be sent back
-				metadata, err := backendInfo.Info(ctx.Value("id").(string))
+				key := ctx.Value("id").(string)
+				metadata, err := backendInfo.InfoContext(ctx, key)
 
 				if err != nil {
-					http.Error(w, "Wrong Path", http.StatusNotFound)
+					httpError(w, err)
+					return
+				}
+
+				// The target of protected links is only shown with the password
+				if metadata.Password != "" {
+					metadata.Protected = true
+
+					password := r.Header.Get(passwordHeader)
+					if password == "" || s.checkPassword(qualify(ctx, key), metadata.Password, password) != nil {
+						metadata.URL = ""
+					}
 				}
 
 				json.NewEncoder(w).Encode(metadata)
 				return
 			},
-		}
+		})
 	}
 
 	// Exit programm if backend doesn't support Infoer interface
@@ -122,11 +296,10 @@ func (s Shrtie) InfoHandler() Handler {
 }
 
 func (s Shrtie) SaveHandler() Handler {
-	return Handler{
-		f: func(w http.ResponseWriter, r *http.Request, _ context.Context) {
+	return s.authorize(ScopeCreate, Handler{
+		f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
 			var request = Entry{}
 			var response = Ack{}
-			var ttl time.Duration
 
 			// Check header (can be omitted)
 			if r.Header.Get("Content-Type") != "application/json" {
@@ -141,22 +314,312 @@ func (s Shrtie) SaveHandler() Handler {
 				return
 			}
 
-			// Get TTL, if both (expiration date and ttl) are set ttl will overwrite date
-			ttl = time.Duration(request.Expires.Unix()-time.Now().Unix()) * time.Second
-			ttl = time.Duration(request.TTL) * time.Second
+			link, err := s.newLink(request)
+			if err != nil {
+				httpError(w, err)
+				return
+			}
 
-			if int64(ttl) < 0 {
-				// Set ttl to inf
-				ttl = time.Second * 0
+			key, reused, err := s.store(ctx, request, link)
+			if err != nil {
+				httpError(w, err)
+				return
 			}
 
-			key := s.backend.Save(request.URL, ttl)
+			response.Reused = reused
 			response.URL = concatURL(r, key)
 			w.Header().Add("Content-Type", "application-json")
 			json.NewEncoder(w).Encode(response)
 			return
 		},
+	})
+}
+
+// newLink validates a saved entry and returns the link to store
+func (s Shrtie) newLink(request Entry) (*Link, error) {
+	ttl, err := s.ttl(request)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, err.Error()}
 	}
+
+	if request.Redirect != 0 && !validRedirect(request.Redirect) {
+		return nil, &requestError{http.StatusBadRequest, "Bad Redirect"}
+	}
+
+	if request.MaxClicks < 0 {
+		return nil, &requestError{http.StatusBadRequest, "Bad MaxClicks"}
+	}
+
+	target, err := s.policy.Normalize(request.URL)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, err.Error()}
+	}
+
+	if s.filter != nil {
+		if err = s.filter.Check(target); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.Preview && s.preview == nil {
+		return nil, &requestError{http.StatusNotImplemented, errNoPreviews.Error()}
+	}
+
+	link := &Link{
+		URL:       target,
+		TTL:       ttl,
+		Redirect:  request.Redirect,
+		MaxClicks: request.MaxClicks,
+		Preview:   request.Preview,
+	}
+
+	if request.Password != "" {
+		if link.Password, err = s.protect(request.Password); err != nil {
+			return nil, passwordError(err)
+		}
+	}
+
+	return link, nil
+}
+
+// store saves the link under the alias of the request, reuses an existing
+// one or saves it under a new key. It reports if the link was reused.
+func (s Shrtie) store(ctx context.Context, request Entry, link *Link) (string, bool, error) {
+	if request.Alias != "" {
+		// Aliases are optional and only supported by some backends
+		aliaser, ok := s.inner.(Aliaser)
+		if !ok {
+			return "", false, &requestError{http.StatusNotImplemented, "Aliases not supported"}
+		}
+
+		if !validKey.MatchString(request.Alias) {
+			return "", false, &requestError{http.StatusBadRequest, "Bad Alias"}
+		}
+
+		if err := aliaser.SaveAlias(ctx, request.Alias, link); err != nil {
+			return "", false, err
+		}
+
+		s.forget(ctx, request.Alias)
+		return request.Alias, false, nil
+	}
+
+	if s.deduplicate {
+		if key, ok := s.reuse(ctx, link); ok {
+			return key, true, nil
+		}
+	}
+
+	key, err := s.backend.Save(ctx, link)
+	return key, false, err
+}
+
+func (s Shrtie) DeleteHandler() Handler {
+	// Check if backend implements Deleter interface
+	if backendDeleter, ok := s.inner.(Deleter); ok {
+		return s.authorize(ScopeDelete, Handler{
+			f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+				key := ctx.Value("id").(string)
+				if err := backendDeleter.Delete(ctx, key); err != nil {
+					httpError(w, err)
+					return
+				}
+				s.forget(ctx, key)
+
+				w.WriteHeader(http.StatusNoContent)
+				return
+			},
+		})
+	}
+
+	// Exit programm if backend doesn't support Deleter interface
+	log.Panicln("Backend doesn't support Deleter interface")
+	return Handler{}
+}
+
+func (s Shrtie) UpdateHandler() Handler {
+	// Check if backend implements Updater interface
+	if backendUpdater, ok := s.inner.(Updater); ok {
+		return s.authorize(ScopeUpdate, Handler{
+			f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+				var request = UpdateEntry{}
+
+				// Check header (can be omitted)
+				if r.Header.Get("Content-Type") != "application/json" {
+					http.Error(w, "Wrong application", http.StatusBadRequest)
+					return
+				}
+
+				// Read user Body JSON data
+				defer r.Body.Close()
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					http.Error(w, "Bad Data", http.StatusBadRequest)
+					return
+				}
+
+				// The expiry is only changed if it's given
+				var ttl *time.Duration
+				if request.TTL != nil || !request.Expires.IsZero() {
+					entry := Entry{Expires: request.Expires}
+					if request.TTL != nil {
+						entry.TTL = *request.TTL
+					}
+
+					d, err := s.ttl(entry)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					ttl = &d
+				}
+				var err error
+
+				if request.Redirect != 0 && !validRedirect(request.Redirect) {
+					http.Error(w, "Bad Redirect", http.StatusBadRequest)
+					return
+				}
+
+				if request.MaxClicks != nil && *request.MaxClicks < 0 {
+					http.Error(w, "Bad MaxClicks", http.StatusBadRequest)
+					return
+				}
+
+				// An empty URL keeps the current target
+				target := request.URL
+				if target != "" {
+					if target, err = s.policy.Normalize(target); err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+
+					if s.filter != nil {
+						if err = s.filter.Check(target); err != nil {
+							httpError(w, err)
+							return
+						}
+					}
+				}
+
+				if request.Preview != nil && *request.Preview && s.preview == nil {
+					httpError(w, &requestError{http.StatusNotImplemented, errNoPreviews.Error()})
+					return
+				}
+
+				update := &LinkUpdate{
+					URL:       target,
+					TTL:       ttl,
+					Redirect:  request.Redirect,
+					MaxClicks: request.MaxClicks,
+					Preview:   request.Preview,
+				}
+
+				// An empty password removes the protection
+				if request.Password != nil && *request.Password != "" {
+					hash, err := s.protect(*request.Password)
+					if err != nil {
+						httpError(w, passwordError(err))
+						return
+					}
+					update.Password = &hash
+				} else {
+					update.Password = request.Password
+				}
+
+				key := ctx.Value("id").(string)
+				if err := backendUpdater.Update(ctx, key, update); err != nil {
+					httpError(w, err)
+					return
+				}
+				s.forget(ctx, key)
+
+				w.WriteHeader(http.StatusNoContent)
+				return
+			},
+		})
+	}
+
+	// Exit programm if backend doesn't support Updater interface
+	log.Panicln("Backend doesn't support Updater interface")
+	return Handler{}
+}
+
+// infoer returns the InfoerContext of the backend, Infoer implementations
+// of wrapped GetSavers are adapted.
+func (s Shrtie) infoer() (InfoerContext, bool) {
+	var backend interface{} = s.inner
+	if l, ok := backend.(legacy); ok {
+		backend = l.GetSaver
+	}
+
+	switch b := backend.(type) {
+	case InfoerContext:
+		return b, true
+	case Infoer:
+		return infoer{b}, true
+	}
+
+	return nil, false
+}
+
+// validRedirect reports whether code is a supported redirect status code
+func validRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+// requestError is a rejected request, answered with its status code
+type requestError struct {
+	code    int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// httpError answers the request with the status code belonging to err
+func httpError(w http.ResponseWriter, err error) {
+	code, message := errorStatus(err)
+	http.Error(w, message, code)
+}
+
+// errorStatus returns the status code and message an error is answered with
+func errorStatus(err error) (int, string) {
+	switch e := err.(type) {
+	case *BlockedError:
+		return http.StatusForbidden, e.Error()
+	case *requestError:
+		return e.code, e.message
+	}
+
+	switch err {
+	case ErrTooLong:
+		return http.StatusRequestEntityTooLarge, err.Error()
+	case ErrUnavailable:
+		return http.StatusServiceUnavailable, err.Error()
+	case ErrConflict:
+		return http.StatusConflict, err.Error()
+	case ErrNotFound:
+		return http.StatusNotFound, err.Error()
+	case ErrExpired, ErrExhausted:
+		return http.StatusGone, err.Error()
+	case ErrCursor:
+		return http.StatusBadRequest, err.Error()
+	case ErrUnauthorized:
+		return http.StatusUnauthorized, err.Error()
+	case ErrForbidden:
+		return http.StatusForbidden, err.Error()
+	case ErrRateLimited:
+		return http.StatusTooManyRequests, err.Error()
+	}
+
+	// Don't leak internal errors
+	return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
 }
 
 func concatURL(r *http.Request, key string) string {
@@ -176,7 +639,9 @@ func concatURL(r *http.Request, key string) string {
 	// User is not supposed to do this
 	// absUrl.Fragment = ""
 	// absUrl.RawQuery = ""
-	absURL.Path = absURL.Path + "/"
+	if !strings.HasSuffix(absURL.Path, "/") {
+		absURL.Path = absURL.Path + "/"
+	}
 
 	// No further checks function is only called by programm
 	realativeURL, _ := url.Parse(key)
@@ -18,16 +18,126 @@ import (
 
 type testBackend struct{}
 
-func (testBackend) Save(s string, t time.Duration) string { return "abc" }
+func (testBackend) Save(ctx context.Context, l *Link) (string, error) {
+	switch l.URL {
+	case "http://too.long/":
+		return "", ErrTooLong
+	case "http://down.com/":
+		return "", ErrUnavailable
+	}
+	return "abc", nil
+}
+
+func (testBackend) Get(ctx context.Context, s string) (*Link, error) {
+	switch s {
+	case "abc":
+		return &Link{URL: "https://here.com"}, nil
+	case "temp":
+		return &Link{URL: "https://here.com", Redirect: http.StatusTemporaryRedirect}, nil
+	case "ttl":
+		return &Link{URL: "https://here.com", TTL: time.Minute}, nil
+	case "once":
+		return &Link{URL: "https://here.com", MaxClicks: 1}, nil
+	case "locked":
+		return &Link{URL: "https://here.com", Password: lockedHash}, nil
+	case "preview":
+		return &Link{URL: "https://here.com", Preview: true}, nil
+	case "gone":
+		return nil, ErrExpired
+	case "used":
+		return nil, ErrExhausted
+	case "down":
+		return nil, ErrUnavailable
+	}
+	return nil, ErrNotFound
+}
+
+func (b testBackend) Peek(ctx context.Context, s string) (*Link, error) {
+	return b.Get(ctx, s)
+}
+
+func (testBackend) List(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	if opts.Cursor == "down" {
+		return nil, ErrUnavailable
+	}
+
+	return Paginate([]ListEntry{
+		{Key: "abc", Metadata: meta},
+		{Key: "locked", Metadata: Metadata{URL: "https://here.com", Password: lockedHash}},
+	}, opts)
+}
+
+func (testBackend) SaveAlias(ctx context.Context, k string, l *Link) error {
+	if k == "abc" {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (testBackend) Delete(ctx context.Context, s string) error {
+	if s == "abc" {
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (testBackend) Update(ctx context.Context, k string, u *LinkUpdate) error {
+	if k == "abc" {
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (testBackend) Find(ctx context.Context, url string) (string, *Link, error) {
+	switch url {
+	case "https://here.com/":
+		return "abc", &Link{URL: url}, nil
+	case "https://ttl.com/":
+		return "ttl", &Link{URL: url, TTL: time.Minute}, nil
+	}
+	return "", nil, ErrNotFound
+}
+
+func (testBackend) Stats(ctx context.Context, k string, i Interval, from, to time.Time) (*Stats, error) {
+	// Like the bundled backends any key has stats
+	stats, err := NewStats(k, i, from, to)
+	if err != nil {
+		return nil, err
+	}
+	stats.Count(stats.From, 3)
+	return stats, nil
+}
+
+func (testBackend) InfoContext(ctx context.Context, s string) (*Metadata, error) {
+	switch s {
+	case "abc":
+		return &meta, nil
+	case "locked":
+		return &Metadata{URL: "https://here.com", Password: lockedHash}, nil
+	case "preview":
+		return &Metadata{URL: "https://here.com", Preview: true, Clicked: 7}, nil
+	}
+	return nil, ErrNotFound
+}
+
+// testLegacyBackend implements the old GetSaver and Infoer interfaces
+type testLegacyBackend struct{}
+
+func (testLegacyBackend) Save(s string, t time.Duration) string {
+	if s == "http://down.com/" {
+		return ""
+	}
+	return "abc"
+}
 
-func (testBackend) Get(s string) (string, error) {
+func (testLegacyBackend) Get(s string) (string, error) {
 	if s == "abc" {
 		return "https://here.com", nil
 	}
 	return "", errors.New("error")
 }
 
-func (testBackend) Info(s string) (*Metadata, error) {
+func (testLegacyBackend) Info(s string) (*Metadata, error) {
 	if s == "abc" {
 		return &meta, nil
 	}
@@ -123,6 +233,50 @@ func TestRedirecter(t *testing.T) {
 	}
 }
 
+func TestRedirectStatus(t *testing.T) {
+	tests := []struct {
+		shrt  Shrtie
+		id    string
+		code  int
+		cache string
+	}{
+		{shrt: New(tb), id: "abc", code: http.StatusMovedPermanently, cache: "public, max-age=31536000"},
+		{shrt: New(tb), id: "ttl", code: http.StatusMovedPermanently, cache: "public, max-age=60"},
+		{shrt: New(tb), id: "temp", code: http.StatusTemporaryRedirect, cache: "no-store"},
+		{shrt: New(tb), id: "once", code: http.StatusMovedPermanently, cache: "no-store"},
+		{shrt: New(tb, WithRedirectStatus(http.StatusFound)), id: "abc", code: http.StatusFound, cache: "no-store"},
+		{shrt: New(tb, WithRedirectStatus(http.StatusFound)), id: "temp", code: http.StatusTemporaryRedirect, cache: "no-store"},
+		{shrt: New(tb, WithRedirectStatus(http.StatusPermanentRedirect)), id: "ttl", code: http.StatusPermanentRedirect, cache: "public, max-age=60"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/"+test.id, nil)
+		if err != nil {
+			t.Error("Failed in redirect status test:", err)
+		}
+
+		res := httptest.NewRecorder()
+		ctx := context.WithValue(context.Background(), "id", test.id)
+		test.shrt.RedirectHandler().f(res, req, ctx)
+
+		if res.Code != test.code {
+			t.Errorf("Wrong Status Value for %s: %d", test.id, res.Code)
+		}
+
+		if cache := res.Header().Get("Cache-Control"); cache != test.cache {
+			t.Errorf("Wrong Cache-Control for %s: %s", test.id, cache)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Couldn't recover panic from invalid redirect status code")
+		}
+	}()
+
+	WithRedirectStatus(http.StatusOK)
+}
+
 func TestSave(t *testing.T) {
 	// Setup
 	shrt := New(tb)
@@ -165,6 +319,54 @@ func TestSave(t *testing.T) {
 	}
 }
 
+func TestSaveDeduplication(t *testing.T) {
+	handler := New(tb, WithDeduplication()).SaveHandler()
+
+	tests := []struct {
+		body   string
+		reused bool
+	}{
+		{`{"url":"HTTPS://Here.com"}`, true},
+		{`{"url":"https://here.com","redirect":302}`, false},
+		{`{"url":"https://ttl.com","ttl":30}`, true},
+		{`{"url":"https://ttl.com","ttl":3600}`, false},
+		{`{"url":"https://ttl.com"}`, false},
+		{`{"url":"https://here.com","max_clicks":1}`, false},
+		{`{"url":"https://there.com"}`, false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader(test.body))
+		req.Header.Add("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		handler.f(res, req, context.Background())
+
+		var ack Ack
+		if err := json.Unmarshal(res.Body.Bytes(), &ack); err != nil {
+			t.Fatal(err)
+		}
+
+		if ack.Reused != test.reused {
+			t.Errorf("Wrong reused flag for %s: %v", test.body, ack.Reused)
+		}
+	}
+}
+
+func TestSaveBadRequest(t *testing.T) {
+	handler := New(tb).SaveHandler()
+
+	for _, body := range []string{`{"url":""}`, `{"url":"/relative"}`, `{"url":"javascript:alert(1)"}`, `{"url":"https://here.com","max_clicks":-1}`} {
+		req, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		handler.f(res, req, context.Background())
+
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("Wrong status for %s: %d", body, res.Code)
+		}
+	}
+}
+
 func TestSaveWrongContentType(t *testing.T) {
 	// Setup
 	shrt := New(tb)
@@ -210,18 +412,87 @@ func TestSaveBadTTL(t *testing.T) {
 	shrt := New(tb)
 	redirectHandler := shrt.SaveHandler()
 
-	req, err := http.NewRequest("GET", "http://example.com/", strings.NewReader(`{"url":"http://here.com", "ttl":-111}`))
-	if err != nil {
-		t.Error("Failed in save test:", err)
+	for _, body := range []string{
+		`{"url":"http://here.com", "ttl":-111}`,
+		`{"url":"http://here.com", "ttl":"soon"}`,
+		`{"url":"http://here.com", "expires":"2000-01-01T00:00:00Z"}`,
+		`{"url":"http://here.com", "redirect":200}`,
+	} {
+		req, err := http.NewRequest("GET", "http://example.com/", strings.NewReader(body))
+		if err != nil {
+			t.Error("Failed in save test:", err)
+		}
+
+		req.Header.Add("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		background := context.Background()
+		redirectHandler.f(res, req, background)
+
+		if res.Code != http.StatusBadRequest {
+			t.Error("Wrong Status Value", res.Code)
+		}
 	}
+}
 
+func TestSaveAlias(t *testing.T) {
+	// Setup
+	shrt := New(tb)
+	saveHandler := shrt.SaveHandler()
+
+	tests := []struct {
+		body   string
+		code   int
+		result string
+	}{
+		{
+			body:   `{"url":"http://here.com", "alias":"q3-report"}`,
+			code:   http.StatusOK,
+			result: "http://example.com/q3-report",
+		}, {
+			body: `{"url":"http://here.com", "alias":"abc"}`,
+			code: http.StatusConflict,
+		}, {
+			body: `{"url":"http://here.com", "alias":"../info"}`,
+			code: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "http://example.com/", strings.NewReader(test.body))
+		if err != nil {
+			t.Error("Failed in save alias test:", err)
+		}
+
+		req.Header.Add("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		saveHandler.f(res, req, context.Background())
+
+		if res.Code != test.code {
+			t.Errorf("Wrong Status Value for %s: %d", test.body, res.Code)
+		}
+
+		if test.code != http.StatusOK {
+			continue
+		}
+
+		var resJSON = Ack{}
+		if err = json.Unmarshal(res.Body.Bytes(), &resJSON); err != nil {
+			t.Error(err)
+		}
+		if resJSON.URL != test.result {
+			t.Error("Wrong short link in save alias test: ", resJSON.URL)
+		}
+	}
+
+	// Backends without Aliaser support must not silently ignore the alias
+	shrtWithoutAliaser := New(Legacy(testBackendWithoutInfoer{}))
+	req, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader(`{"url":"http://here.com", "alias":"q3"}`))
 	req.Header.Add("Content-Type", "application/json")
 	res := httptest.NewRecorder()
-	background := context.Background()
-	redirectHandler.f(res, req, background)
+	shrtWithoutAliaser.SaveHandler().f(res, req, context.Background())
 
-	if res.Code != http.StatusOK {
-		//t.Error("Wrong Status Value", res.Code)
+	if res.Code != http.StatusNotImplemented {
+		t.Error("Wrong Status Value", res.Code)
 	}
 }
 
@@ -273,7 +544,7 @@ func TestInfo(t *testing.T) {
 		}
 	}()
 
-	shrtWithoutInfoer := New(testBackendWithoutInfoer{})
+	shrtWithoutInfoer := New(Legacy(testBackendWithoutInfoer{}))
 	infoHandler = shrtWithoutInfoer.InfoHandler()
 }
 
@@ -297,6 +568,244 @@ func TestInfoBadPath(t *testing.T) {
 	}
 }
 
+func TestDelete(t *testing.T) {
+	// Setup
+	shrt := New(tb)
+	deleteHandler := shrt.DeleteHandler()
+
+	tests := []struct {
+		id   string
+		code int
+	}{
+		{id: "abc", code: http.StatusNoContent},
+		{id: "aaa", code: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("DELETE", "http://example.com/"+test.id, nil)
+		if err != nil {
+			t.Error("Failed in delete test:", err)
+		}
+
+		res := httptest.NewRecorder()
+		ctx := context.WithValue(context.Background(), "id", test.id)
+		deleteHandler.f(res, req, ctx)
+
+		if res.Code != test.code {
+			t.Errorf("Wrong Status Value for %s: %d", test.id, res.Code)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Couldn't recover panic form wrong backend interface")
+		}
+	}()
+
+	New(Legacy(testBackendWithoutInfoer{})).DeleteHandler()
+}
+
+func TestUpdate(t *testing.T) {
+	// Setup
+	shrt := New(tb)
+	updateHandler := shrt.UpdateHandler()
+
+	tests := []struct {
+		id          string
+		body        string
+		contentType string
+		code        int
+	}{
+		{
+			id:          "abc",
+			body:        `{"url":"http://there.com", "ttl":100}`,
+			contentType: "application/json",
+			code:        http.StatusNoContent,
+		}, {
+			id:          "aaa",
+			body:        `{"url":"http://there.com"}`,
+			contentType: "application/json",
+			code:        http.StatusNotFound,
+		}, {
+			id:          "abc",
+			body:        `{"url":"http://there.com"}`,
+			contentType: "application/pdf",
+			code:        http.StatusBadRequest,
+		}, {
+			id:          "abc",
+			body:        `{"url:"http://there.com"}`,
+			contentType: "application/json",
+			code:        http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("PUT", "http://example.com/"+test.id, strings.NewReader(test.body))
+		if err != nil {
+			t.Error("Failed in update test:", err)
+		}
+
+		req.Header.Add("Content-Type", test.contentType)
+		res := httptest.NewRecorder()
+		ctx := context.WithValue(context.Background(), "id", test.id)
+		updateHandler.f(res, req, ctx)
+
+		if res.Code != test.code {
+			t.Errorf("Wrong Status Value for %s: %d", test.body, res.Code)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Couldn't recover panic form wrong backend interface")
+		}
+	}()
+
+	New(Legacy(testBackendWithoutInfoer{})).UpdateHandler()
+}
+
+// testUpdateBackend records the last update
+type testUpdateBackend struct {
+	testBackend
+	update **LinkUpdate
+}
+
+func (b testUpdateBackend) Update(ctx context.Context, k string, u *LinkUpdate) error {
+	*b.update = u
+	return nil
+}
+
+func TestUpdateKeepsExpiry(t *testing.T) {
+	var update *LinkUpdate
+	handler := New(testUpdateBackend{update: &update}).UpdateHandler()
+
+	hour := time.Hour
+	tests := map[string]*time.Duration{
+		`{"url":"http://there.com"}`: nil,
+		`{"ttl":0}`:                  new(time.Duration),
+		`{"ttl":"1h"}`:               &hour,
+	}
+
+	for body, expected := range tests {
+		req, _ := http.NewRequest("PUT", "http://example.com/abc", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		handler.f(res, req, context.WithValue(context.Background(), "id", "abc"))
+
+		if res.Code != http.StatusNoContent {
+			t.Fatalf("Update %s failed: %d", body, res.Code)
+		}
+
+		if expected == nil && update.TTL != nil || expected != nil && (update.TTL == nil || *update.TTL != *expected) {
+			t.Errorf("Wrong TTL for %s: %v", body, update.TTL)
+		}
+	}
+}
+
+func TestUpdateRemovesProtection(t *testing.T) {
+	var update *LinkUpdate
+	handler := New(testUpdateBackend{update: &update}).UpdateHandler()
+
+	put := func(body string) {
+		req, _ := http.NewRequest("PUT", "http://example.com/abc", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		handler.f(res, req, context.WithValue(context.Background(), "id", "abc"))
+
+		if res.Code != http.StatusNoContent {
+			t.Fatalf("Update %s failed: %d", body, res.Code)
+		}
+	}
+
+	// Missing fields are kept
+	put(`{"url":"http://there.com"}`)
+	if update.Password != nil || update.MaxClicks != nil || update.Preview != nil {
+		t.Error("Unexpected changes:", update)
+	}
+
+	// Empty values remove the password, the click limit and the preview
+	put(`{"password":"","max_clicks":0,"preview":false}`)
+	if update.Password == nil || *update.Password != "" {
+		t.Error("Password not removed:", update.Password)
+	}
+	if update.MaxClicks == nil || *update.MaxClicks != 0 {
+		t.Error("Click limit not removed:", update.MaxClicks)
+	}
+	if update.Preview == nil || *update.Preview {
+		t.Error("Preview not turned off:", update.Preview)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	// Setup
+	shrt := New(tb)
+
+	tests := []struct {
+		handler Handler
+		id      string
+		body    string
+		code    int
+	}{
+		{handler: shrt.RedirectHandler(), id: "gone", code: http.StatusGone},
+		{handler: shrt.RedirectHandler(), id: "used", code: http.StatusGone},
+		{handler: shrt.RedirectHandler(), id: "down", code: http.StatusServiceUnavailable},
+		{handler: shrt.RedirectHandler(), id: "aaa", code: http.StatusNotFound},
+		{handler: shrt.InfoHandler(), id: "aaa", code: http.StatusNotFound},
+		{handler: shrt.SaveHandler(), body: `{"url":"http://too.long"}`, code: http.StatusRequestEntityTooLarge},
+		{handler: shrt.SaveHandler(), body: `{"url":"http://down.com"}`, code: http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "http://example.com/", strings.NewReader(test.body))
+		if err != nil {
+			t.Error("Failed in error status test:", err)
+		}
+
+		req.Header.Add("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ctx := context.WithValue(context.Background(), "id", test.id)
+		test.handler.f(res, req, ctx)
+
+		if res.Code != test.code {
+			t.Errorf("Wrong Status Value for '%s%s': %d", test.id, test.body, res.Code)
+		}
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	// Setup
+	shrt := New(Legacy(testLegacyBackend{}))
+
+	tests := []struct {
+		handler Handler
+		id      string
+		body    string
+		code    int
+	}{
+		{handler: shrt.RedirectHandler(), id: "abc", code: http.StatusMovedPermanently},
+		{handler: shrt.RedirectHandler(), id: "aaa", code: http.StatusNotFound},
+		{handler: shrt.InfoHandler(), id: "abc", code: http.StatusOK},
+		{handler: shrt.SaveHandler(), body: `{"url":"http://here.com"}`, code: http.StatusOK},
+		{handler: shrt.SaveHandler(), body: `{"url":"http://down.com"}`, code: http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "http://example.com/", strings.NewReader(test.body))
+		if err != nil {
+			t.Error("Failed in legacy test:", err)
+		}
+
+		req.Header.Add("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ctx := context.WithValue(context.Background(), "id", test.id)
+		test.handler.f(res, req, ctx)
+
+		if res.Code != test.code {
+			t.Errorf("Wrong Status Value for '%s%s': %d", test.id, test.body, res.Code)
+		}
+	}
+}
+
 func TestMuxHandler(t *testing.T) {
 	shrt := New(tb)
 	router := mux.NewRouter()
@@ -0,0 +1,1322 @@
+// Package shrtietest provides a conformance test suite for shrtie backends.
+//
+// A backend package wires itself through the suite with a test like
+//
+//	func TestConformance(t *testing.T) {
+//		shrtietest.RunBackendTests(t, func(t *testing.T) shrtie.Backend {
+//			return New()
+//		})
+//	}
+//
+// Tests of optional interfaces such as Aliaser or Deleter only run if the
+// backend implements them.
+package shrtietest
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/realfake/shrtie"
+)
+
+// Factory returns a new and empty backend, it's called once per test with
+// the *testing.T of the test.
+type Factory func(*testing.T) shrtie.Backend
+
+// validKey matches keys which can be used in a path without escaping
+var validKey = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+// RunBackendTests runs the conformance suite against the backends returned
+// by factory.
+func RunBackendTests(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		f    func(*testing.T, shrtie.Backend)
+	}{
+		{"SaveGet", testSaveGet},
+		{"TooLong", testTooLong},
+		{"Expiry", testExpiry},
+		{"ClickCount", testClickCount},
+		{"InvalidKeys", testInvalidKeys},
+		{"Info", testInfo},
+		{"Concurrency", testConcurrency},
+		{"Redirect", testRedirect},
+		{"Alias", testAlias},
+		{"Delete", testDelete},
+		{"Update", testUpdate},
+		{"Find", testFind},
+		{"MaxClicks", testMaxClicks},
+		{"Clicks", testClicks},
+		{"Stats", testStats},
+		{"StatsDelete", testStatsDelete},
+		{"Peek", testPeek},
+		{"Preview", testPreview},
+		{"SaveAll", testSaveAll},
+		{"List", testList},
+		{"APIKeys", testAPIKeys},
+		{"Namespaces", testNamespaces},
+		{"RateLimit", testRateLimit},
+		{"Count", testCount},
+		{"AddClicks", testAddClicks},
+		{"Sweep", testSweep},
+	}
+
+	for _, test := range tests {
+		f := test.f
+		t.Run(test.name, func(t *testing.T) {
+			f(t, factory(t))
+		})
+	}
+}
+
+func testSaveGet(t *testing.T, b shrtie.Backend) {
+	ctx := context.Background()
+
+	keys := make(map[string]string)
+	for _, url := range []string{"https://here.com", "https://there.com/a?b=c#d", "https://here.com"} {
+		key, err := b.Save(ctx, &shrtie.Link{URL: url})
+		if err != nil {
+			t.Fatal("Save failed:", err)
+		}
+
+		if !validKey.MatchString(key) {
+			t.Errorf("Key %q isn't URL safe", key)
+		}
+
+		if _, ok := keys[key]; ok {
+			t.Errorf("Key %q handed out twice", key)
+		}
+		keys[key] = url
+	}
+
+	for key, url := range keys {
+		link, err := b.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get of %q failed: %v", key, err)
+		}
+
+		if link.URL != url {
+			t.Errorf("Get of %q returned %q expected %q", key, link.URL, url)
+		}
+
+		if link.TTL != 0 {
+			t.Errorf("Get of %q returned TTL %v for a link without TTL", key, link.TTL)
+		}
+	}
+}
+
+func testTooLong(t *testing.T, b shrtie.Backend) {
+	url := "https://here.com/" + strings.Repeat("a", 4096)
+	if _, err := b.Save(context.Background(), &shrtie.Link{URL: url}); err != shrtie.ErrTooLong {
+		t.Error("Expected ErrTooLong got:", err)
+	}
+}
+
+func testExpiry(t *testing.T, b shrtie.Backend) {
+	ctx := context.Background()
+
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com", TTL: time.Second})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	link, err := b.Get(ctx, key)
+	if err != nil {
+		t.Fatal("Get failed:", err)
+	}
+
+	if link.TTL <= 0 || link.TTL > time.Second {
+		t.Error("Wrong remaining TTL:", link.TTL)
+	}
+
+	// Backends are allowed to store expiry with a precision of seconds
+	time.Sleep(2100 * time.Millisecond)
+
+	if _, err = b.Get(ctx, key); err != shrtie.ErrExpired && err != shrtie.ErrNotFound {
+		t.Error("Expected ErrExpired or ErrNotFound got:", err)
+	}
+}
+
+func testClickCount(t *testing.T, b shrtie.Backend) {
+	infoer, ok := b.(shrtie.InfoerContext)
+	if !ok {
+		t.Skip("Backend doesn't implement InfoerContext")
+	}
+
+	ctx := context.Background()
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err = b.Get(ctx, key); err != nil {
+			t.Fatal("Get failed:", err)
+		}
+	}
+
+	// Unknown keys must not be counted or created
+	b.Get(ctx, key+"x")
+
+	meta, err := infoer.InfoContext(ctx, key)
+	if err != nil {
+		t.Fatal("Info failed:", err)
+	}
+
+	if meta.Clicked != 3 {
+		t.Error("Wrong click count:", meta.Clicked)
+	}
+
+	if _, err = infoer.InfoContext(ctx, key+"x"); err != shrtie.ErrNotFound {
+		t.Error("Counting an unknown key created it:", err)
+	}
+}
+
+func testInvalidKeys(t *testing.T, b shrtie.Backend) {
+	ctx := context.Background()
+
+	// Make sure the backend isn't empty
+	if _, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com"}); err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	for _, key := range []string{"", "unknown", "meta:count", "../x", "a b", "%00", "A/", "Ag=="} {
+		if _, err := b.Get(ctx, key); err != shrtie.ErrNotFound {
+			t.Errorf("Get of %q: expected ErrNotFound got %v", key, err)
+		}
+	}
+}
+
+func testInfo(t *testing.T, b shrtie.Backend) {
+	infoer, ok := b.(shrtie.InfoerContext)
+	if !ok {
+		t.Skip("Backend doesn't implement InfoerContext")
+	}
+
+	ctx := context.Background()
+	before := time.Now().Add(-time.Second)
+
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com", TTL: time.Hour})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	meta, err := infoer.InfoContext(ctx, key)
+	if err != nil {
+		t.Fatal("Info failed:", err)
+	}
+
+	if meta.URL != "https://here.com" {
+		t.Error("Wrong URL:", meta.URL)
+	}
+
+	if meta.TTL <= 3590 || meta.TTL > 3600 {
+		t.Error("Wrong TTL:", meta.TTL)
+	}
+
+	if meta.Expires == nil || meta.Expires.Sub(time.Now()) > time.Hour || meta.Expires.Sub(time.Now()) < time.Hour-10*time.Second {
+		t.Error("Wrong expiration date:", meta.Expires)
+	}
+
+	if meta.Clicked != 0 {
+		t.Error("Wrong click count:", meta.Clicked)
+	}
+
+	if meta.Created.Before(before) || meta.Created.After(time.Now()) {
+		t.Error("Wrong created time:", meta.Created)
+	}
+
+	if _, err = infoer.InfoContext(ctx, "unknown"); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound got:", err)
+	}
+}
+
+func testConcurrency(t *testing.T, b shrtie.Backend) {
+	const n = 50
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	keys := make(map[string]bool)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+			if err != nil {
+				t.Error("Save failed:", err)
+				return
+			}
+
+			if _, err = b.Get(ctx, key); err != nil {
+				t.Error("Get failed:", err)
+			}
+
+			mu.Lock()
+			keys[key] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(keys) != n {
+		t.Errorf("Expected %d distinct keys got %d", n, len(keys))
+	}
+}
+
+func testRedirect(t *testing.T, b shrtie.Backend) {
+	ctx := context.Background()
+
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com", Redirect: 307})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	link, err := b.Get(ctx, key)
+	if err != nil {
+		t.Fatal("Get failed:", err)
+	}
+
+	if link.Redirect != 307 {
+		t.Error("Wrong redirect status code:", link.Redirect)
+	}
+
+	if infoer, ok := b.(shrtie.InfoerContext); ok {
+		if meta, err := infoer.InfoContext(ctx, key); err != nil || meta.Redirect != 307 {
+			t.Error("Wrong redirect status code in Info:", meta, err)
+		}
+	}
+
+	if updater, ok := b.(shrtie.Updater); ok {
+		if err = updater.Update(ctx, key, &shrtie.LinkUpdate{Redirect: 302}); err != nil {
+			t.Fatal("Update failed:", err)
+		}
+
+		if link, err = b.Get(ctx, key); err != nil || link.Redirect != 302 {
+			t.Error("Redirect status code wasn't updated:", link, err)
+		}
+	}
+}
+
+func testAlias(t *testing.T, b shrtie.Backend) {
+	aliaser, ok := b.(shrtie.Aliaser)
+	if !ok {
+		t.Skip("Backend doesn't implement Aliaser")
+	}
+
+	ctx := context.Background()
+
+	// Generated keys can't be taken by aliases and the other way round
+	first, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	if err = aliaser.SaveAlias(ctx, "q3-report", &shrtie.Link{URL: "https://there.com"}); err != nil {
+		t.Fatal("SaveAlias failed:", err)
+	}
+
+	if err = aliaser.SaveAlias(ctx, "q3-report", &shrtie.Link{URL: "https://here.com"}); err != shrtie.ErrConflict {
+		t.Error("Expected ErrConflict got:", err)
+	}
+
+	if err = aliaser.SaveAlias(ctx, first, &shrtie.Link{URL: "https://there.com"}); err != shrtie.ErrConflict {
+		t.Error("Expected ErrConflict for generated key got:", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err = b.Save(ctx, &shrtie.Link{URL: "https://here.com"}); err != nil {
+			t.Fatal("Save failed:", err)
+		}
+	}
+
+	link, err := b.Get(ctx, "q3-report")
+	if err != nil {
+		t.Fatal("Get failed:", err)
+	}
+
+	if link.URL != "https://there.com" {
+		t.Error("Alias was overwritten:", link.URL)
+	}
+}
+
+func testDelete(t *testing.T, b shrtie.Backend) {
+	deleter, ok := b.(shrtie.Deleter)
+	if !ok {
+		t.Skip("Backend doesn't implement Deleter")
+	}
+
+	ctx := context.Background()
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	if err = deleter.Delete(ctx, key); err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+
+	if _, err = b.Get(ctx, key); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound after delete got:", err)
+	}
+
+	if err = deleter.Delete(ctx, key); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound for second delete got:", err)
+	}
+}
+
+func testUpdate(t *testing.T, b shrtie.Backend) {
+	updater, ok := b.(shrtie.Updater)
+	if !ok {
+		t.Skip("Backend doesn't implement Updater")
+	}
+
+	ctx := context.Background()
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+	b.Get(ctx, key)
+
+	hour, forever := time.Hour, time.Duration(0)
+	if err = updater.Update(ctx, key, &shrtie.LinkUpdate{URL: "https://there.com", TTL: &hour}); err != nil {
+		t.Fatal("Update failed:", err)
+	}
+
+	link, err := b.Get(ctx, key)
+	if err != nil {
+		t.Fatal("Get failed:", err)
+	}
+
+	if link.URL != "https://there.com" || link.TTL <= 0 {
+		t.Error("Link wasn't updated:", link)
+	}
+
+	// An empty URL keeps the target, a missing TTL the expiry
+	if err = updater.Update(ctx, key, &shrtie.LinkUpdate{Redirect: 302}); err != nil {
+		t.Fatal("Update failed:", err)
+	}
+
+	if link, _ = b.Get(ctx, key); link == nil || link.URL != "https://there.com" || link.TTL <= 0 {
+		t.Error("Link wasn't kept:", link)
+	}
+
+	// A zero TTL removes the expiry
+	if err = updater.Update(ctx, key, &shrtie.LinkUpdate{TTL: &forever}); err != nil {
+		t.Fatal("Update failed:", err)
+	}
+
+	if link, _ = b.Get(ctx, key); link == nil || link.URL != "https://there.com" || link.TTL != 0 {
+		t.Error("Expiry wasn't removed:", link)
+	}
+
+	if infoer, ok := b.(shrtie.InfoerContext); ok {
+		if meta, err := infoer.InfoContext(ctx, key); err != nil || meta.Clicked != 4 {
+			t.Error("Click count wasn't preserved:", meta, err)
+		}
+	}
+
+	if err = updater.Update(ctx, "unknown", &shrtie.LinkUpdate{URL: "https://there.com"}); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound got:", err)
+	}
+
+	// Expiring links still expire after changing the target
+	key, err = b.Save(ctx, &shrtie.Link{URL: "https://here.com", TTL: time.Second})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	if err = updater.Update(ctx, key, &shrtie.LinkUpdate{URL: "https://there.com"}); err != nil {
+		t.Fatal("Update failed:", err)
+	}
+
+	if link, err = b.Get(ctx, key); err != nil || link.URL != "https://there.com" || link.TTL <= 0 {
+		t.Error("Expiry lost by update:", link, err)
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+	if _, err = b.Get(ctx, key); err != shrtie.ErrExpired && err != shrtie.ErrNotFound {
+		t.Error("Expected ErrExpired or ErrNotFound got:", err)
+	}
+}
+
+func testFind(t *testing.T, b shrtie.Backend) {
+	finder, ok := b.(shrtie.Finder)
+	if !ok {
+		t.Skip("Backend doesn't implement Finder")
+	}
+
+	ctx := context.Background()
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com", Redirect: 302})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	found, link, err := finder.Find(ctx, "https://here.com")
+	if err != nil {
+		t.Fatal("Find failed:", err)
+	}
+
+	if found != key || link.URL != "https://here.com" || link.Redirect != 302 {
+		t.Error("Wrong link found:", found, link)
+	}
+
+	// Find doesn't count clicks
+	if infoer, ok := b.(shrtie.InfoerContext); ok {
+		if meta, err := infoer.InfoContext(ctx, key); err != nil || meta.Clicked != 0 {
+			t.Error("Find counted a click:", meta, err)
+		}
+	}
+
+	if _, _, err = finder.Find(ctx, "https://unknown.com"); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound got:", err)
+	}
+
+	if updater, ok := b.(shrtie.Updater); ok {
+		if err = updater.Update(ctx, key, &shrtie.LinkUpdate{URL: "https://there.com"}); err != nil {
+			t.Fatal("Update failed:", err)
+		}
+
+		if _, _, err = finder.Find(ctx, "https://here.com"); err != shrtie.ErrNotFound {
+			t.Error("Expected ErrNotFound for the old URL got:", err)
+		}
+
+		if found, _, err = finder.Find(ctx, "https://there.com"); err != nil || found != key {
+			t.Error("Updated URL not found:", found, err)
+		}
+	}
+
+	if deleter, ok := b.(shrtie.Deleter); ok {
+		if err = deleter.Delete(ctx, key); err != nil {
+			t.Fatal("Delete failed:", err)
+		}
+
+		if _, _, err = finder.Find(ctx, "https://there.com"); err != shrtie.ErrNotFound {
+			t.Error("Expected ErrNotFound after delete got:", err)
+		}
+	}
+}
+
+func testClicks(t *testing.T, b shrtie.Backend) {
+	writer, ok := b.(shrtie.ClickWriter)
+	if !ok {
+		t.Skip("Backend doesn't implement ClickWriter")
+	}
+
+	ctx := context.Background()
+	clicks := []shrtie.Click{
+		{Time: time.Now(), Key: "abc", Referrer: "https://there.com/", UserAgent: "test", Language: "en", IP: "127.0.0.0"},
+		{Time: time.Now(), Key: "abc"},
+	}
+
+	if err := writer.WriteClicks(ctx, clicks); err != nil {
+		t.Error("WriteClicks failed:", err)
+	}
+
+	if err := writer.WriteClicks(ctx, nil); err != nil {
+		t.Error("WriteClicks failed without clicks:", err)
+	}
+}
+
+func testStats(t *testing.T, b shrtie.Backend) {
+	statser, ok := b.(shrtie.Statser)
+	if !ok {
+		t.Skip("Backend doesn't implement Statser")
+	}
+
+	writer, ok := b.(shrtie.ClickWriter)
+	if !ok {
+		t.Skip("Backend doesn't implement ClickWriter")
+	}
+
+	ctx := context.Background()
+	day := time.Date(2017, 3, 6, 0, 0, 0, 0, time.UTC)
+	clicks := []shrtie.Click{
+		{Time: day.Add(time.Hour), Key: "abc", Referrer: "https://there.com/x", UserAgent: "Mozilla/5.0 Firefox/52.0", Language: "de-CH,de;q=0.8"},
+		{Time: day.Add(time.Hour + time.Minute), Key: "abc"},
+		{Time: day.Add(26 * time.Hour), Key: "abc", Referrer: "https://there.com/y"},
+		{Time: day.Add(time.Hour), Key: "other"},
+	}
+
+	if err := writer.WriteClicks(ctx, clicks); err != nil {
+		t.Fatal("WriteClicks failed:", err)
+	}
+
+	stats, err := statser.Stats(ctx, "abc", shrtie.Daily, day, day.Add(72*time.Hour))
+	if err != nil {
+		t.Fatal("Stats failed:", err)
+	}
+
+	if len(stats.Buckets) != 3 || stats.Buckets[0].Clicks != 2 || stats.Buckets[1].Clicks != 1 || stats.Buckets[2].Clicks != 0 {
+		t.Error("Wrong daily buckets:", stats.Buckets)
+	}
+
+	if stats.Referrers["there.com"] != 2 || stats.Referrers["direct"] != 1 {
+		t.Error("Wrong referrers:", stats.Referrers)
+	}
+
+	if stats.Browsers["Firefox"] != 1 || stats.Countries["CH"] != 1 {
+		t.Error("Wrong breakdowns:", stats.Browsers, stats.Countries)
+	}
+
+	stats, err = statser.Stats(ctx, "abc", shrtie.Hourly, day, day.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal("Stats failed:", err)
+	}
+
+	if len(stats.Buckets) != 3 || stats.Buckets[1].Clicks != 2 {
+		t.Error("Wrong hourly buckets:", stats.Buckets)
+	}
+
+	// 2017-03-06 is a monday
+	stats, err = statser.Stats(ctx, "abc", shrtie.Weekly, day, day.Add(7*24*time.Hour))
+	if err != nil {
+		t.Fatal("Stats failed:", err)
+	}
+
+	if len(stats.Buckets) != 1 || stats.Buckets[0].Clicks != 3 {
+		t.Error("Wrong weekly buckets:", stats.Buckets)
+	}
+}
+
+func testStatsDelete(t *testing.T, b shrtie.Backend) {
+	statser, ok := b.(shrtie.Statser)
+	if !ok {
+		t.Skip("Backend doesn't implement Statser")
+	}
+
+	writer, ok := b.(shrtie.ClickWriter)
+	if !ok {
+		t.Skip("Backend doesn't implement ClickWriter")
+	}
+
+	aliaser, ok := b.(shrtie.Aliaser)
+	if !ok {
+		t.Skip("Backend doesn't implement Aliaser")
+	}
+
+	deleter, ok := b.(shrtie.Deleter)
+	if !ok {
+		t.Skip("Backend doesn't implement Deleter")
+	}
+
+	ctx := context.Background()
+	if err := aliaser.SaveAlias(ctx, "reused", &shrtie.Link{URL: "https://here.com"}); err != nil {
+		t.Fatal("SaveAlias failed:", err)
+	}
+
+	now := time.Now()
+	if err := writer.WriteClicks(ctx, []shrtie.Click{{Time: now, Key: "reused", Referrer: "https://there.com/"}}); err != nil {
+		t.Fatal("WriteClicks failed:", err)
+	}
+
+	if err := deleter.Delete(ctx, "reused"); err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+
+	// A link saved with the same key starts without clicks
+	if err := aliaser.SaveAlias(ctx, "reused", &shrtie.Link{URL: "https://there.com"}); err != nil {
+		t.Fatal("SaveAlias failed:", err)
+	}
+
+	stats, err := statser.Stats(ctx, "reused", shrtie.Daily, now.Add(-24*time.Hour), now.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal("Stats failed:", err)
+	}
+
+	for _, bucket := range stats.Buckets {
+		if bucket.Clicks != 0 {
+			t.Error("Clicks of the deleted link kept:", stats.Buckets)
+		}
+	}
+
+	if len(stats.Referrers) != 0 {
+		t.Error("Referrers of the deleted link kept:", stats.Referrers)
+	}
+}
+
+func testMaxClicks(t *testing.T, b shrtie.Backend) {
+	ctx := context.Background()
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com", MaxClicks: 3})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	// Concurrent clicks must never exceed the limit
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.Get(ctx, key)
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var ok int
+	for err := range results {
+		switch err {
+		case nil:
+			ok++
+		case shrtie.ErrExhausted:
+		default:
+			t.Error("Unexpected error:", err)
+		}
+	}
+
+	if ok != 3 {
+		t.Error("Wrong number of successful clicks:", ok)
+	}
+
+	if infoer, ok := b.(shrtie.InfoerContext); ok {
+		meta, err := infoer.InfoContext(ctx, key)
+		if err != nil {
+			t.Fatal("Info failed:", err)
+		}
+
+		if meta.MaxClicks != 3 || meta.Remaining == nil || *meta.Remaining != 0 || meta.Clicked != 3 {
+			t.Error("Wrong click limit in metadata:", meta)
+		}
+	}
+
+	// One-time links
+	key, err = b.Save(ctx, &shrtie.Link{URL: "https://here.com", MaxClicks: 1})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	if link, err := b.Get(ctx, key); err != nil || link.MaxClicks != 1 {
+		t.Error("First click failed:", link, err)
+	}
+
+	if _, err = b.Get(ctx, key); err != shrtie.ErrExhausted {
+		t.Error("Expected ErrExhausted got:", err)
+	}
+
+	// Updating the limit to zero removes it
+	if updater, ok := b.(shrtie.Updater); ok {
+		if err = updater.Update(ctx, key, &shrtie.LinkUpdate{MaxClicks: new(int64)}); err != nil {
+			t.Fatal("Update failed:", err)
+		}
+
+		if link, err := b.Get(ctx, key); err != nil || link.MaxClicks != 0 {
+			t.Error("Click limit not removed:", link, err)
+		}
+	}
+
+	// Unlimited links have no remaining clicks
+	if infoer, ok := b.(shrtie.InfoerContext); ok {
+		key, _ = b.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+		if meta, err := infoer.InfoContext(ctx, key); err != nil || meta.Remaining != nil {
+			t.Error("Unexpected remaining clicks:", meta, err)
+		}
+	}
+}
+
+func testPeek(t *testing.T, b shrtie.Backend) {
+	peeker, ok := b.(shrtie.Peeker)
+	if !ok {
+		t.Skip("Backend doesn't implement Peeker")
+	}
+
+	ctx := context.Background()
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com", MaxClicks: 1, Password: "hash"})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	// Peeking doesn't use up the only click
+	for i := 0; i < 3; i++ {
+		link, err := peeker.Peek(ctx, key)
+		if err != nil {
+			t.Fatal("Peek failed:", err)
+		}
+
+		if link.URL != "https://here.com" || link.MaxClicks != 1 || link.Password != "hash" {
+			t.Error("Wrong link:", link)
+		}
+	}
+
+	if link, err := b.Get(ctx, key); err != nil || link.Password != "hash" {
+		t.Error("Get failed:", link, err)
+	}
+
+	if _, err = peeker.Peek(ctx, key); err != shrtie.ErrExhausted {
+		t.Error("Expected ErrExhausted got:", err)
+	}
+
+	if _, err = peeker.Peek(ctx, "unknown"); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound got:", err)
+	}
+
+	// The password hash is kept by info and changed by update
+	key, _ = b.Save(ctx, &shrtie.Link{URL: "https://here.com", Password: "hash"})
+	if infoer, ok := b.(shrtie.InfoerContext); ok {
+		if meta, err := infoer.InfoContext(ctx, key); err != nil || meta.Password != "hash" {
+			t.Error("Wrong password in metadata:", meta, err)
+		}
+	}
+
+	if updater, ok := b.(shrtie.Updater); ok {
+		other := "other"
+		if err = updater.Update(ctx, key, &shrtie.LinkUpdate{Password: &other}); err != nil {
+			t.Fatal("Update failed:", err)
+		}
+
+		if link, err := peeker.Peek(ctx, key); err != nil || link.Password != "other" || link.URL != "https://here.com" {
+			t.Error("Password not updated:", link, err)
+		}
+
+		// An empty password removes the protection
+		if err = updater.Update(ctx, key, &shrtie.LinkUpdate{Password: new(string)}); err != nil {
+			t.Fatal("Update failed:", err)
+		}
+
+		if link, err := peeker.Peek(ctx, key); err != nil || link.Password != "" || link.URL != "https://here.com" {
+			t.Error("Password not removed:", link, err)
+		}
+	}
+}
+
+func testPreview(t *testing.T, b shrtie.Backend) {
+	ctx := context.Background()
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com", Preview: true})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	if link, err := b.Get(ctx, key); err != nil || !link.Preview {
+		t.Error("Preview lost:", link, err)
+	}
+
+	if infoer, ok := b.(shrtie.InfoerContext); ok {
+		if meta, err := infoer.InfoContext(ctx, key); err != nil || !meta.Preview {
+			t.Error("Preview missing in metadata:", meta, err)
+		}
+	}
+
+	if finder, ok := b.(shrtie.Finder); ok {
+		if _, link, err := finder.Find(ctx, "https://here.com"); err != nil || !link.Preview {
+			t.Error("Preview missing in found link:", link, err)
+		}
+	}
+
+	// Updating another field keeps the preview
+	if updater, ok := b.(shrtie.Updater); ok {
+		if err = updater.Update(ctx, key, &shrtie.LinkUpdate{Redirect: 302}); err != nil {
+			t.Fatal("Update failed:", err)
+		}
+
+		if link, err := b.Get(ctx, key); err != nil || !link.Preview {
+			t.Error("Preview lost by update:", link, err)
+		}
+
+		key, _ = b.Save(ctx, &shrtie.Link{URL: "https://there.com"})
+		preview := true
+		if err = updater.Update(ctx, key, &shrtie.LinkUpdate{Preview: &preview}); err != nil {
+			t.Fatal("Update failed:", err)
+		}
+
+		if link, err := b.Get(ctx, key); err != nil || !link.Preview {
+			t.Error("Preview not updated:", link, err)
+		}
+
+		preview = false
+		if err = updater.Update(ctx, key, &shrtie.LinkUpdate{Preview: &preview}); err != nil {
+			t.Fatal("Update failed:", err)
+		}
+
+		if link, err := b.Get(ctx, key); err != nil || link.Preview {
+			t.Error("Preview not turned off:", link, err)
+		}
+	}
+}
+
+func testSaveAll(t *testing.T, b shrtie.Backend) {
+	bulk, ok := b.(shrtie.BulkSaver)
+	if !ok {
+		t.Skip("Backend doesn't implement BulkSaver")
+	}
+
+	ctx := context.Background()
+	links := []*shrtie.Link{
+		{URL: "https://here.com"},
+		{URL: "https://here.com/" + strings.Repeat("a", 4096)},
+		{URL: "https://there.com", Redirect: 302, MaxClicks: 5},
+	}
+
+	keys, errs := bulk.SaveAll(ctx, links)
+	if len(keys) != len(links) || len(errs) != len(links) {
+		t.Fatal("Wrong number of results:", keys, errs)
+	}
+
+	if errs[1] != shrtie.ErrTooLong || keys[1] != "" {
+		t.Error("Expected ErrTooLong got:", keys[1], errs[1])
+	}
+
+	for _, i := range []int{0, 2} {
+		if errs[i] != nil {
+			t.Fatal("SaveAll failed:", errs[i])
+		}
+
+		link, err := b.Get(ctx, keys[i])
+		if err != nil || link.URL != links[i].URL || link.Redirect != links[i].Redirect || link.MaxClicks != links[i].MaxClicks {
+			t.Error("Wrong link saved:", link, err)
+		}
+	}
+
+	if keys[0] == keys[2] {
+		t.Error("Duplicate key:", keys[0])
+	}
+
+	// Empty batches are fine
+	if keys, errs = bulk.SaveAll(ctx, nil); len(keys) != 0 || len(errs) != 0 {
+		t.Error("Unexpected results:", keys, errs)
+	}
+}
+
+func testList(t *testing.T, b shrtie.Backend) {
+	lister, ok := b.(shrtie.Lister)
+	if !ok {
+		t.Skip("Backend doesn't implement Lister")
+	}
+
+	ctx := context.Background()
+	save := func(link *shrtie.Link, clicks int) string {
+		key, err := b.Save(ctx, link)
+		if err != nil {
+			t.Fatal("Save failed:", err)
+		}
+
+		for i := 0; i < clicks; i++ {
+			if _, err = b.Get(ctx, key); err != nil {
+				t.Fatal("Get failed:", err)
+			}
+		}
+		return key
+	}
+
+	save(&shrtie.Link{URL: "https://here.com"}, 0)
+	popular := save(&shrtie.Link{URL: "https://here.com"}, 2)
+	used := save(&shrtie.Link{URL: "https://here.com", MaxClicks: 1}, 1)
+	there := save(&shrtie.Link{URL: "https://sub.there.com/path"}, 1)
+
+	// Paging through all links returns every link once
+	seen := make(map[string]bool)
+	opts := shrtie.ListOptions{Limit: 1}
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("Cursor doesn't end")
+		}
+
+		page, err := lister.List(ctx, opts)
+		if err != nil {
+			t.Fatal("List failed:", err)
+		}
+
+		for _, link := range page.Links {
+			if seen[link.Key] {
+				t.Error("Link listed twice:", link.Key)
+			}
+			seen[link.Key] = true
+		}
+
+		if page.Cursor == "" {
+			break
+		}
+		opts.Cursor = page.Cursor
+	}
+
+	if len(seen) != 4 {
+		t.Error("Wrong number of links listed:", len(seen))
+	}
+
+	// Sorted by clicks across pages
+	var clicks []int64
+	opts = shrtie.ListOptions{Sort: shrtie.SortClicks, Limit: 3}
+	for {
+		page, err := lister.List(ctx, opts)
+		if err != nil {
+			t.Fatal("List failed:", err)
+		}
+
+		for _, link := range page.Links {
+			clicks = append(clicks, link.Clicked)
+		}
+
+		if page.Cursor == "" {
+			break
+		}
+		opts.Cursor = page.Cursor
+	}
+
+	if !reflect.DeepEqual(clicks, []int64{2, 1, 1, 0}) {
+		t.Error("Wrong order:", clicks)
+	}
+
+	filters := []struct {
+		opts shrtie.ListOptions
+		keys []string
+	}{
+		{opts: shrtie.ListOptions{State: shrtie.Expired}, keys: []string{used}},
+		{opts: shrtie.ListOptions{State: shrtie.Active, Host: "THERE"}, keys: []string{there}},
+		{opts: shrtie.ListOptions{Sort: shrtie.SortClicks, Limit: 1}, keys: []string{popular}},
+		{opts: shrtie.ListOptions{To: time.Now().Add(-time.Hour)}},
+		{opts: shrtie.ListOptions{From: time.Now().Add(time.Hour)}},
+	}
+
+	for _, f := range filters {
+		page, err := lister.List(ctx, f.opts)
+		if err != nil {
+			t.Fatal("List failed:", err)
+		}
+
+		var keys []string
+		for _, link := range page.Links {
+			keys = append(keys, link.Key)
+		}
+
+		if !reflect.DeepEqual(keys, f.keys) {
+			t.Errorf("%+v: expected %v got %v", f.opts, f.keys, keys)
+		}
+	}
+
+	if _, err := lister.List(ctx, shrtie.ListOptions{Cursor: "!"}); err != shrtie.ErrCursor {
+		t.Error("Expected ErrCursor got:", err)
+	}
+}
+
+func testAPIKeys(t *testing.T, b shrtie.Backend) {
+	store, ok := b.(shrtie.KeyStore)
+	if !ok {
+		t.Skip("Backend doesn't implement KeyStore")
+	}
+
+	ctx := context.Background()
+	_, key, err := shrtie.CreateAPIKey(shrtie.WithNamespace(ctx, "team"), store, shrtie.ScopeCreate, shrtie.ScopeReadStats)
+	if err != nil {
+		t.Fatal("CreateAPIKey failed:", err)
+	}
+
+	stored, err := store.APIKey(ctx, key.ID)
+	if err != nil {
+		t.Fatal("APIKey failed:", err)
+	}
+
+	if !reflect.DeepEqual(stored, key) {
+		t.Errorf("Expected %+v got %+v", key, stored)
+	}
+
+	if err := store.SaveAPIKey(ctx, key); err != shrtie.ErrConflict {
+		t.Error("Expected ErrConflict for a taken ID got:", err)
+	}
+
+	// API keys aren't links
+	if lister, ok := b.(shrtie.Lister); ok {
+		if page, err := lister.List(ctx, shrtie.ListOptions{}); err != nil || len(page.Links) != 0 {
+			t.Error("API key listed as link:", page, err)
+		}
+	}
+
+	if err := store.RevokeAPIKey(ctx, key.ID); err != nil {
+		t.Fatal("RevokeAPIKey failed:", err)
+	}
+
+	if _, err := store.APIKey(ctx, key.ID); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound for a revoked key got:", err)
+	}
+
+	if err := store.RevokeAPIKey(ctx, key.ID); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound for a revoked key got:", err)
+	}
+}
+
+func testNamespaces(t *testing.T, b shrtie.Backend) {
+	ctx := context.Background()
+	team := shrtie.WithNamespace(ctx, "team")
+
+	key, err := b.Save(team, &shrtie.Link{URL: "https://here.com"})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	if link, err := b.Get(team, key); err != nil || link.URL != "https://here.com" {
+		t.Fatal("Wrong link in its namespace:", link, err)
+	}
+
+	for _, other := range []context.Context{ctx, shrtie.WithNamespace(ctx, "other")} {
+		if _, err := b.Get(other, key); err != shrtie.ErrNotFound {
+			t.Errorf("Link of namespace %q found in %q: %v", "team", shrtie.NamespaceFromContext(other), err)
+		}
+	}
+
+	// Keys must not reach into other namespaces
+	if _, err := b.Get(ctx, "team/"+key); err != shrtie.ErrNotFound {
+		t.Error("Link of a namespace found by path:", err)
+	}
+
+	if finder, ok := b.(shrtie.Finder); ok {
+		if _, _, err := finder.Find(ctx, "https://here.com"); err != shrtie.ErrNotFound {
+			t.Error("Link of a namespace found in the default one:", err)
+		}
+
+		if found, _, err := finder.Find(team, "https://here.com"); err != nil || found != key {
+			t.Error("Link not found in its namespace:", found, err)
+		}
+	}
+
+	// Aliases are free in every namespace
+	teamKeys, defaultKeys := []string{key}, []string(nil)
+	if aliaser, ok := b.(shrtie.Aliaser); ok {
+		teamKeys, defaultKeys = append(teamKeys, "q3-report"), []string{"q3-report"}
+
+		if err := aliaser.SaveAlias(team, "q3-report", &shrtie.Link{URL: "https://there.com"}); err != nil {
+			t.Fatal("SaveAlias failed:", err)
+		}
+
+		if err := aliaser.SaveAlias(ctx, "q3-report", &shrtie.Link{URL: "https://here.com"}); err != nil {
+			t.Fatal("Alias of another namespace taken:", err)
+		}
+
+		if link, err := b.Get(team, "q3-report"); err != nil || link.URL != "https://there.com" {
+			t.Error("Wrong alias in its namespace:", link, err)
+		}
+
+		if link, err := b.Get(ctx, "q3-report"); err != nil || link.URL != "https://here.com" {
+			t.Error("Wrong alias in the default namespace:", link, err)
+		}
+	}
+
+	if lister, ok := b.(shrtie.Lister); ok {
+		for _, ns := range []struct {
+			ctx  context.Context
+			keys []string
+		}{{team, teamKeys}, {ctx, defaultKeys}} {
+			page, err := lister.List(ns.ctx, shrtie.ListOptions{})
+			if err != nil {
+				t.Fatal("List failed:", err)
+			}
+
+			var keys []string
+			for _, link := range page.Links {
+				keys = append(keys, link.Key)
+			}
+
+			sort.Strings(keys)
+			sort.Strings(ns.keys)
+			if !reflect.DeepEqual(keys, ns.keys) {
+				t.Errorf("Namespace %q: expected %v got %v", shrtie.NamespaceFromContext(ns.ctx), ns.keys, keys)
+			}
+		}
+	}
+
+	if deleter, ok := b.(shrtie.Deleter); ok {
+		if err := deleter.Delete(ctx, key); err != shrtie.ErrNotFound {
+			t.Error("Link of a namespace deleted from the default one:", err)
+		}
+
+		if err := deleter.Delete(team, key); err != nil {
+			t.Error("Delete failed:", err)
+		}
+	}
+}
+
+func testRateLimit(t *testing.T, b shrtie.Backend) {
+	store, ok := b.(shrtie.LimitStore)
+	if !ok {
+		t.Skip("Backend doesn't implement LimitStore")
+	}
+
+	ctx := context.Background()
+	limit := shrtie.Limit{Rate: 1, Period: time.Hour, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		bucket, err := store.Take(ctx, "test:ip:127.0.0.1", limit)
+		if err != nil {
+			t.Fatal("Take failed:", err)
+		}
+
+		if !bucket.Allowed || bucket.Remaining != i {
+			t.Errorf("Expected %d remaining got %+v", i, bucket)
+		}
+	}
+
+	bucket, err := store.Take(ctx, "test:ip:127.0.0.1", limit)
+	if err != nil {
+		t.Fatal("Take failed:", err)
+	}
+
+	if bucket.Allowed || bucket.RetryAfter <= 59*time.Minute || bucket.Reset <= 2*time.Hour {
+		t.Errorf("Empty bucket allowed: %+v", bucket)
+	}
+
+	// Buckets are separate
+	if bucket, err = store.Take(ctx, "test:ip:127.0.0.2", limit); err != nil || !bucket.Allowed {
+		t.Error("Other bucket not allowed:", bucket, err)
+	}
+}
+
+func testCount(t *testing.T, b shrtie.Backend) {
+	counter, ok := b.(shrtie.Counter)
+	if !ok {
+		t.Skip("Backend doesn't implement Counter")
+	}
+
+	ctx := context.Background()
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = counter.Count(ctx, key); err != nil {
+			t.Fatal("Count failed:", err)
+		}
+	}
+
+	if err = counter.Count(ctx, key+"x"); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound got:", err)
+	}
+
+	infoer, ok := b.(shrtie.InfoerContext)
+	if !ok {
+		return
+	}
+
+	if meta, err := infoer.InfoContext(ctx, key); err != nil || meta.Clicked != 2 {
+		t.Error("Wrong click count:", meta, err)
+	}
+
+	if _, err = infoer.InfoContext(ctx, key+"x"); err != shrtie.ErrNotFound {
+		t.Error("Counting an unknown key created it:", err)
+	}
+}
+
+func testAddClicks(t *testing.T, b shrtie.Backend) {
+	counter, ok := b.(shrtie.ClickCounter)
+	if !ok {
+		t.Skip("Backend doesn't implement ClickCounter")
+	}
+
+	ctx := context.Background()
+	team := shrtie.WithNamespace(ctx, "team")
+	key, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com"})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	other, err := b.Save(team, &shrtie.Link{URL: "https://there.com"})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	err = counter.AddClicks(ctx, []shrtie.ClickCount{
+		{Key: key, Clicks: 3},
+		{Namespace: "team", Key: other, Clicks: 2},
+		{Namespace: "team", Key: key + "x", Clicks: 1},
+	})
+	if err != nil {
+		t.Fatal("AddClicks failed:", err)
+	}
+
+	infoer, ok := b.(shrtie.InfoerContext)
+	if !ok {
+		return
+	}
+
+	if meta, err := infoer.InfoContext(ctx, key); err != nil || meta.Clicked != 3 {
+		t.Error("Wrong click count:", meta, err)
+	}
+
+	if meta, err := infoer.InfoContext(team, other); err != nil || meta.Clicked != 2 {
+		t.Error("Wrong click count in namespace:", meta, err)
+	}
+
+	if _, err = infoer.InfoContext(team, key+"x"); err != shrtie.ErrNotFound {
+		t.Error("Counting an unknown key created it:", err)
+	}
+}
+
+func testSweep(t *testing.T, b shrtie.Backend) {
+	sweeper, ok := b.(shrtie.Sweeper)
+	if !ok {
+		t.Skip("Backend doesn't implement Sweeper")
+	}
+
+	ctx := context.Background()
+	team := shrtie.WithNamespace(ctx, "team")
+	expiring, err := b.Save(ctx, &shrtie.Link{URL: "https://here.com", TTL: time.Minute})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	other, err := b.Save(team, &shrtie.Link{URL: "https://there.com", TTL: time.Minute})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	forever, err := b.Save(ctx, &shrtie.Link{URL: "https://forever.com"})
+	if err != nil {
+		t.Fatal("Save failed:", err)
+	}
+
+	// Links expiring within the hour count as expired
+	before := time.Now().Add(time.Hour)
+
+	// Links are kept if archiving fails
+	failed := errors.New("archive failed")
+	n, err := sweeper.Sweep(ctx, before, 10, func(context.Context, []shrtie.ExpiredLink) error {
+		return failed
+	})
+	if err != failed || n != 0 {
+		t.Error("Expected the archive error got:", n, err)
+	}
+
+	if _, err = b.Get(ctx, expiring); err != nil {
+		t.Error("Link removed although archiving failed:", err)
+	}
+
+	var archived []shrtie.ExpiredLink
+	archive := func(_ context.Context, links []shrtie.ExpiredLink) error {
+		archived = append(archived, links...)
+		return nil
+	}
+
+	if n, err = sweeper.Sweep(ctx, before, 1, archive); err != nil || n != 1 {
+		t.Fatal("Expected 1 removed link got:", n, err)
+	}
+
+	if n, err = sweeper.Sweep(ctx, before, 10, archive); err != nil || n != 1 {
+		t.Fatal("Expected 1 removed link got:", n, err)
+	}
+
+	sort.Slice(archived, func(i, j int) bool { return archived[i].Namespace < archived[j].Namespace })
+	if len(archived) != 2 || archived[0].Key != expiring || archived[0].URL != "https://here.com" || archived[0].Clicked != 1 ||
+		archived[1].Namespace != "team" || archived[1].Key != other || archived[1].Expires == nil {
+		t.Errorf("Wrong archived links: %+v", archived)
+	}
+
+	if _, err = b.Get(ctx, expiring); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound got:", err)
+	}
+
+	if _, err = b.Get(team, other); err != shrtie.ErrNotFound {
+		t.Error("Expected ErrNotFound got:", err)
+	}
+
+	if _, err = b.Get(ctx, forever); err != nil {
+		t.Error("Link without TTL removed:", err)
+	}
+}
@@ -0,0 +1,262 @@
+package shrtie
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxBuckets limits the time range of a stats request
+const maxBuckets = 1000
+
+var ErrStatsRange = errors.New("Invalid time range")
+
+// Interval is the size of the buckets of Stats
+type Interval string
+
+const (
+	Hourly Interval = "hour"
+	Daily  Interval = "day"
+	Weekly Interval = "week"
+)
+
+// Duration returns the length of a bucket, zero for unknown intervals.
+func (i Interval) Duration() time.Duration {
+	switch i {
+	case Hourly:
+		return time.Hour
+	case Daily:
+		return 24 * time.Hour
+	case Weekly:
+		return 7 * 24 * time.Hour
+	}
+
+	return 0
+}
+
+// Truncate returns the start of the bucket containing t. Buckets are
+// aligned in UTC, weeks start on monday.
+func (i Interval) Truncate(t time.Time) time.Time {
+	// The zero time is a monday, so weeks are aligned as well
+	return t.UTC().Truncate(i.Duration())
+}
+
+// Bucket is the number of clicks in the interval starting at Time
+type Bucket struct {
+	Time   time.Time `json:"time"`
+	Clicks int64     `json:"clicks"`
+}
+
+// Stats are the clicks of a link in a time range
+type Stats struct {
+	Key       string           `json:"key"`
+	Interval  Interval         `json:"interval"`
+	From      time.Time        `json:"from"`
+	To        time.Time        `json:"to"`
+	Buckets   []Bucket         `json:"buckets"`
+	Referrers map[string]int64 `json:"referrers"` // Clicks by referrer host, see ReferrerHost
+	Browsers  map[string]int64 `json:"browsers"`  // Clicks by browser family, see BrowserFamily
+	Countries map[string]int64 `json:"countries"` // Clicks by country, see Country
+}
+
+// Statser is implemented by backends which aggregate the clicks written
+// with ClickWriter.
+type Statser interface {
+	Stats(ctx context.Context, key string, interval Interval, from, to time.Time) (*Stats, error)
+}
+
+// NewStats returns stats without clicks for the range from (inclusive) to
+// to (exclusive). From is truncated to the interval. Backends use it to
+// build the result of Stats.
+func NewStats(key string, interval Interval, from, to time.Time) (*Stats, error) {
+	d := interval.Duration()
+	if d == 0 {
+		return nil, fmt.Errorf("Invalid interval %q", interval)
+	}
+
+	from = interval.Truncate(from)
+	to = to.UTC()
+	if !to.After(from) || to.Sub(from)/d >= maxBuckets {
+		return nil, ErrStatsRange
+	}
+
+	s := &Stats{
+		Key:       key,
+		Interval:  interval,
+		From:      from,
+		To:        to,
+		Referrers: make(map[string]int64),
+		Browsers:  make(map[string]int64),
+		Countries: make(map[string]int64),
+	}
+
+	for t := from; t.Before(to); t = t.Add(d) {
+		s.Buckets = append(s.Buckets, Bucket{Time: t})
+	}
+
+	return s, nil
+}
+
+// Count adds n clicks at t to its bucket, clicks outside of the range are
+// ignored.
+func (s *Stats) Count(t time.Time, n int64) {
+	if t.Before(s.From) || !t.Before(s.To) {
+		return
+	}
+
+	s.Buckets[t.Sub(s.From)/s.Interval.Duration()].Clicks += n
+}
+
+// Breakdown adds n clicks with the given headers to the breakdowns.
+func (s *Stats) Breakdown(referrer, userAgent, language string, n int64) {
+	s.Referrers[ReferrerHost(referrer)] += n
+	s.Browsers[BrowserFamily(userAgent)] += n
+	s.Countries[Country(language)] += n
+}
+
+// ReferrerHost returns the host of the referrer, "direct" if there is none.
+func ReferrerHost(referrer string) string {
+	if referrer == "" {
+		return "direct"
+	}
+
+	u, err := url.Parse(referrer)
+	if err != nil || u.Hostname() == "" {
+		return "unknown"
+	}
+
+	return strings.ToLower(u.Hostname())
+}
+
+// browsers maps user agent tokens to browser families, the first match
+// wins as most browsers claim to be others as well
+var browsers = []struct {
+	token, family string
+}{
+	{"bot", "Bot"},
+	{"spider", "Bot"},
+	{"crawl", "Bot"},
+	{"edg/", "Edge"},
+	{"edge/", "Edge"},
+	{"opr/", "Opera"},
+	{"opera", "Opera"},
+	{"firefox/", "Firefox"},
+	{"fxios/", "Firefox"},
+	{"chrome/", "Chrome"},
+	{"crios/", "Chrome"},
+	{"safari/", "Safari"},
+	{"trident/", "Internet Explorer"},
+	{"msie", "Internet Explorer"},
+	{"curl/", "curl"},
+}
+
+// BrowserFamily returns the browser family of a user agent, "unknown" if it
+// isn't recognized.
+func BrowserFamily(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			return b.family
+		}
+	}
+
+	return "unknown"
+}
+
+// Country returns the region of the preferred language in an
+// Accept-Language header like "de-CH,de;q=0.9", "unknown" if it has none.
+func Country(language string) string {
+	tag := strings.TrimSpace(strings.SplitN(strings.SplitN(language, ",", 2)[0], ";", 2)[0])
+
+	// The region is the first two letter subtag after the language
+	parts := strings.Split(tag, "-")
+	for _, part := range parts[1:] {
+		if len(part) == 2 {
+			return strings.ToUpper(part)
+		}
+	}
+
+	return "unknown"
+}
+
+// StatsHandler answers click statistics of the link, the query parameters
+// are interval (hour, day or week), from and to as RFC 3339 dates. The range
+// defaults to the last 30 intervals until now. Unknown links are answered
+// with 404 Not Found if the backend implements Peeker, expired and exhausted
+// ones keep their statistics.
+func (s Shrtie) StatsHandler() Handler {
+	// Check if backend implements Statser interface
+	if backendStats, ok := s.inner.(Statser); ok {
+		return s.authorize(ScopeReadStats, Handler{
+			f: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+				query := r.URL.Query()
+
+				interval := Daily
+				if i := query.Get("interval"); i != "" {
+					interval = Interval(i)
+				}
+
+				if interval.Duration() == 0 {
+					http.Error(w, "Bad Interval", http.StatusBadRequest)
+					return
+				}
+
+				to, err := parseTime(query.Get("to"), time.Now())
+				if err != nil {
+					http.Error(w, "Bad Time", http.StatusBadRequest)
+					return
+				}
+
+				from, err := parseTime(query.Get("from"), to.Add(-30*interval.Duration()))
+				if err != nil {
+					http.Error(w, "Bad Time", http.StatusBadRequest)
+					return
+				}
+
+				// Check the range before it reaches the backend
+				if _, err = NewStats("", interval, from, to); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				// Backends count clicks of any key, so they can't tell
+				// unknown links apart
+				key := ctx.Value("id").(string)
+				if peeker, ok := s.inner.(Peeker); ok {
+					if _, err = peeker.Peek(ctx, key); err != nil && err != ErrExpired && err != ErrExhausted {
+						httpError(w, err)
+						return
+					}
+				}
+
+				stats, err := backendStats.Stats(ctx, key, interval, from, to)
+				if err != nil {
+					httpError(w, err)
+					return
+				}
+
+				json.NewEncoder(w).Encode(stats)
+				return
+			},
+		})
+	}
+
+	// Exit programm if backend doesn't support Statser interface
+	log.Panicln("Backend doesn't support Statser interface")
+	return Handler{}
+}
+
+// parseTime parses a RFC 3339 date, empty strings result in def
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
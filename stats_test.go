@@ -0,0 +1,143 @@
+package shrtie
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestIntervalTruncate(t *testing.T) {
+	// A wednesday afternoon
+	tm := time.Date(2017, 3, 8, 15, 30, 0, 0, time.UTC)
+
+	tests := map[Interval]time.Time{
+		Hourly: time.Date(2017, 3, 8, 15, 0, 0, 0, time.UTC),
+		Daily:  time.Date(2017, 3, 8, 0, 0, 0, 0, time.UTC),
+		Weekly: time.Date(2017, 3, 6, 0, 0, 0, 0, time.UTC),
+	}
+
+	for interval, expected := range tests {
+		if got := interval.Truncate(tm); !got.Equal(expected) {
+			t.Errorf("Wrong start of %s: %v", interval, got)
+		}
+	}
+}
+
+func TestNewStats(t *testing.T) {
+	from := time.Date(2017, 3, 8, 15, 30, 0, 0, time.UTC)
+	stats, err := NewStats("abc", Hourly, from, from.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The range starts at the beginning of the first bucket
+	if len(stats.Buckets) != 4 || !stats.From.Equal(from.Truncate(time.Hour)) {
+		t.Error("Wrong buckets:", stats.Buckets)
+	}
+
+	stats.Count(from, 2)
+	stats.Count(from.Add(3*time.Hour-time.Minute), 1)
+	stats.Count(from.Add(3*time.Hour), 1)
+	stats.Count(from.Add(-time.Hour), 1)
+	if stats.Buckets[0].Clicks != 2 || stats.Buckets[3].Clicks != 1 {
+		t.Error("Wrong counts:", stats.Buckets)
+	}
+
+	for _, to := range []time.Time{from.Add(-time.Hour), from.Add(maxBuckets * time.Hour)} {
+		if _, err = NewStats("abc", Hourly, from, to); err != ErrStatsRange {
+			t.Error("Expected ErrStatsRange got:", err)
+		}
+	}
+
+	if _, err = NewStats("abc", "month", from, from.Add(time.Hour)); err == nil {
+		t.Error("Invalid interval was accepted")
+	}
+}
+
+func TestBreakdowns(t *testing.T) {
+	referrers := map[string]string{
+		"":                       "direct",
+		"https://There.com/page": "there.com",
+		"android-app://com.x/":   "com.x",
+		"not a url":              "unknown",
+	}
+	for in, expected := range referrers {
+		if got := ReferrerHost(in); got != expected {
+			t.Errorf("ReferrerHost(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+
+	browsers := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/58.0 Safari/537.36":          "Chrome",
+		"Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/58.0 Safari/537.36 Edg/80.0": "Edge",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:52.0) Gecko/20100101 Firefox/52.0":                                    "Firefox",
+		"Mozilla/5.0 (iPhone) AppleWebKit/603.1 (KHTML, like Gecko) Version/10.0 Mobile/14E304 Safari/602.1":      "Safari",
+		"Googlebot/2.1 (+http://www.google.com/bot.html)":                                                         "Bot",
+		"": "unknown",
+	}
+	for in, expected := range browsers {
+		if got := BrowserFamily(in); got != expected {
+			t.Errorf("BrowserFamily(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+
+	countries := map[string]string{
+		"de-CH,de;q=0.9,en;q=0.8": "CH",
+		"en-us":                   "US",
+		"zh-Hans-CN":              "CN",
+		"de":                      "unknown",
+		"":                        "unknown",
+	}
+	for in, expected := range countries {
+		if got := Country(in); got != expected {
+			t.Errorf("Country(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	handler := New(tb).StatsHandler()
+
+	tests := []struct {
+		id, query string
+		code      int
+	}{
+		{"abc", "", http.StatusOK},
+		{"abc", "?interval=hour&from=2017-03-08T00:00:00Z&to=2017-03-09T00:00:00Z", http.StatusOK},
+		{"unknown", "", http.StatusNotFound},
+		{"gone", "", http.StatusOK},
+		{"used", "", http.StatusOK},
+		{"down", "", http.StatusServiceUnavailable},
+		{"abc", "?interval=month", http.StatusBadRequest},
+		{"abc", "?from=yesterday", http.StatusBadRequest},
+		{"abc", "?from=2017-03-09T00:00:00Z&to=2017-03-08T00:00:00Z", http.StatusBadRequest},
+		{"abc", "?interval=hour&from=2000-01-01T00:00:00Z", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/"+test.id+test.query, nil)
+		res := httptest.NewRecorder()
+		handler.f(res, req, context.WithValue(context.Background(), "id", test.id))
+
+		if res.Code != test.code {
+			t.Errorf("Wrong status for %s%s: %d", test.id, test.query, res.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/abc?interval=hour&from=2017-03-08T00:00:00Z&to=2017-03-09T00:00:00Z", nil)
+	res := httptest.NewRecorder()
+	handler.f(res, req, context.WithValue(context.Background(), "id", "abc"))
+
+	var stats Stats
+	if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Interval != Hourly || len(stats.Buckets) != 24 || stats.Buckets[0].Clicks != 3 {
+		t.Error("Wrong stats:", stats)
+	}
+}
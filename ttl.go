@@ -0,0 +1,137 @@
+package shrtie
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNegativeTTL = errors.New("TTL must not be negative")
+	ErrPastExpiry  = errors.New("Expiration date is in the past")
+)
+
+// Duration is a time to life in JSON. It's either a number of seconds or a
+// string like "36h", "7d" or "1w2d12h". Besides the units of
+// time.ParseDuration days (d) and weeks (w) are supported.
+type Duration time.Duration
+
+// maxDuration is the longest Duration, longer ones would overflow
+const maxDuration = time.Duration(math.MaxInt64)
+
+// durationUnits splits leading weeks and days from the rest of a duration
+var durationUnits = regexp.MustCompile(`^(?:(\d+)w)?(?:(\d+)d)?(.*)$`)
+
+// ParseDuration parses a duration as accepted in JSON.
+func ParseDuration(s string) (Duration, error) {
+	// Plain numbers are seconds
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return durationSeconds(seconds)
+	} else if err.(*strconv.NumError).Err == strconv.ErrRange {
+		return 0, fmt.Errorf("Duration %q is too long", s)
+	}
+
+	m := durationUnits.FindStringSubmatch(s)
+	if m == nil || s == "" {
+		return 0, fmt.Errorf("Invalid duration %q", s)
+	}
+
+	// Weeks and days are checked before they are multiplied, so they
+	// can't overflow
+	const maxDays = int64(maxDuration / (24 * time.Hour))
+	weeks, err := strconv.ParseInt("0"+m[1], 10, 64)
+	if err != nil || weeks > maxDays/7 {
+		return 0, fmt.Errorf("Duration %q is too long", s)
+	}
+	days, err := strconv.ParseInt("0"+m[2], 10, 64)
+	if err != nil || days > maxDays-weeks*7 {
+		return 0, fmt.Errorf("Duration %q is too long", s)
+	}
+	d := time.Duration(weeks*7+days) * 24 * time.Hour
+
+	if m[3] != "" {
+		rest, err := time.ParseDuration(m[3])
+		if err != nil {
+			return 0, fmt.Errorf("Invalid duration %q", s)
+		}
+
+		if rest > maxDuration-d {
+			return 0, fmt.Errorf("Duration %q is too long", s)
+		}
+		d += rest
+	}
+
+	return Duration(d), nil
+}
+
+// durationSeconds returns the Duration of seconds, unless it overflows
+func durationSeconds(seconds int64) (Duration, error) {
+	const max = int64(maxDuration / time.Second)
+	if seconds > max || seconds < -max {
+		return 0, fmt.Errorf("Duration of %d seconds is too long", seconds)
+	}
+
+	return Duration(time.Duration(seconds) * time.Second), nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var seconds int64
+	if err := json.Unmarshal(b, &seconds); err == nil {
+		parsed, err := durationSeconds(seconds)
+		if err != nil {
+			return err
+		}
+
+		*d = parsed
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Invalid duration %s", b)
+	}
+
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = parsed
+	return nil
+}
+
+// MarshalJSON encodes the duration as seconds.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int64(time.Duration(d) / time.Second))
+}
+
+// ttl resolves the time to life requested by the entry. TTL takes
+// precedence over Expires, if neither is set the link lives forever or as
+// long as the maximum TTL allows.
+func (s Shrtie) ttl(request Entry) (time.Duration, error) {
+	ttl := time.Duration(request.TTL)
+	switch {
+	case ttl < 0:
+		return 0, ErrNegativeTTL
+	case ttl == 0 && !request.Expires.IsZero():
+		if ttl = request.Expires.Sub(time.Now()); ttl <= 0 {
+			return 0, ErrPastExpiry
+		}
+	}
+
+	if s.maxTTL != 0 {
+		if ttl == 0 {
+			return s.maxTTL, nil
+		}
+
+		if ttl > s.maxTTL {
+			return 0, fmt.Errorf("TTL exceeds the maximum of %v", s.maxTTL)
+		}
+	}
+
+	return ttl, nil
+}
@@ -0,0 +1,92 @@
+package shrtie
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in  string
+		out time.Duration
+	}{
+		{in: "3600", out: time.Hour},
+		{in: "36h", out: 36 * time.Hour},
+		{in: "7d", out: 7 * 24 * time.Hour},
+		{in: "1w2d12h", out: 9*24*time.Hour + 12*time.Hour},
+		{in: "1d30m", out: 24*time.Hour + 30*time.Minute},
+	}
+
+	for _, test := range tests {
+		if d, err := ParseDuration(test.in); err != nil || time.Duration(d) != test.out {
+			t.Errorf("Failed duration test: Expected '%v' got '%v' (%v).\n", test.out, time.Duration(d), err)
+		}
+	}
+
+	// Durations overflowing time.Duration are rejected instead of wrapping
+	for _, in := range []string{"", "d", "7x", "1d2w", "abc", "999999999w", "106752d", "15250w2d", "106751d24h", "9223372037", "-9223372037", "99999999999999999999"} {
+		if _, err := ParseDuration(in); err == nil {
+			t.Errorf("Invalid duration %q was accepted", in)
+		}
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	var entry Entry
+	if err := json.Unmarshal([]byte(`{"ttl":60}`), &entry); err != nil || entry.TTL != Duration(time.Minute) {
+		t.Error("Failed to decode seconds:", entry.TTL, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"ttl":"7d"}`), &entry); err != nil || entry.TTL != Duration(7*24*time.Hour) {
+		t.Error("Failed to decode duration string:", entry.TTL, err)
+	}
+
+	for _, in := range []string{`true`, `9223372037`, `"999999999w"`} {
+		if err := json.Unmarshal([]byte(`{"ttl":`+in+`}`), &entry); err == nil {
+			t.Errorf("Invalid duration %s was accepted", in)
+		}
+	}
+
+	if b, _ := json.Marshal(Duration(time.Hour)); string(b) != "3600" {
+		t.Error("Failed to encode duration:", string(b))
+	}
+}
+
+func TestTTL(t *testing.T) {
+	shrt := New(tb)
+	limited := New(tb, WithMaxTTL(24*time.Hour))
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		shrt  Shrtie
+		entry Entry
+		min   time.Duration
+		max   time.Duration
+		err   bool
+	}{
+		{shrt: shrt, entry: Entry{}},
+		{shrt: shrt, entry: Entry{TTL: Duration(time.Minute)}, min: time.Minute, max: time.Minute},
+		{shrt: shrt, entry: Entry{Expires: future}, min: time.Hour - time.Minute, max: time.Hour},
+		{shrt: shrt, entry: Entry{TTL: Duration(time.Minute), Expires: future}, min: time.Minute, max: time.Minute},
+		{shrt: shrt, entry: Entry{Expires: time.Now().Add(-time.Hour)}, err: true},
+		{shrt: shrt, entry: Entry{TTL: Duration(-time.Minute)}, err: true},
+		{shrt: limited, entry: Entry{}, min: 24 * time.Hour, max: 24 * time.Hour},
+		{shrt: limited, entry: Entry{TTL: Duration(48 * time.Hour)}, err: true},
+		{shrt: limited, entry: Entry{Expires: time.Now().Add(48 * time.Hour)}, err: true},
+	}
+
+	for i, test := range tests {
+		ttl, err := test.shrt.ttl(test.entry)
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: invalid TTL was accepted", i)
+			}
+			continue
+		}
+
+		if err != nil || ttl < test.min || ttl > test.max {
+			t.Errorf("Test %d: Expected TTL between %v and %v got %v (%v)", i, test.min, test.max, ttl, err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package shrtie
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+var (
+	ErrEmptyURL    = errors.New("URL is empty")
+	ErrRelativeURL = errors.New("URL must be absolute")
+	ErrScheme      = errors.New("URL scheme is not allowed")
+	ErrHost        = errors.New("URL host is invalid")
+)
+
+// TrackingParams are common query parameters of analytics tools, to be used
+// as URLPolicy.StripParams.
+var TrackingParams = []string{"utm_*", "fbclid", "gclid", "mc_cid", "mc_eid"}
+
+// defaultPorts are stripped from hosts
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// URLPolicy validates and normalizes the targets of links before they reach
+// the backend. The zero value allows http and https URLs.
+type URLPolicy struct {
+	Schemes     []string // Allowed schemes, defaults to http and https
+	StripParams []string // Query parameters to remove, a trailing * matches prefixes
+}
+
+// WithURLPolicy replaces the default policy for targets of new and updated
+// links.
+func WithURLPolicy(p URLPolicy) Option {
+	return func(s *Shrtie) {
+		s.policy = p
+	}
+}
+
+// Normalize returns the canonical form of raw or an error describing why it
+// isn't accepted. Scheme and host are lowercased, international domain
+// names are converted to punycode, trailing dots and default ports are
+// removed and IP addresses are written in their standard form.
+func (p URLPolicy) Normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", ErrEmptyURL
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("Invalid URL %q", raw)
+	}
+
+	if !u.IsAbs() {
+		return "", ErrRelativeURL
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !p.allowed(u.Scheme) {
+		return "", ErrScheme
+	}
+
+	// Opaque URLs like "http:here.com" have no host
+	if u.Opaque != "" || u.Hostname() == "" {
+		return "", ErrHost
+	}
+
+	host, err := canonicalHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+
+	port := u.Port()
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+
+	switch {
+	case port != "":
+		u.Host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		u.Host = "[" + host + "]"
+	default:
+		u.Host = host
+	}
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	if len(p.StripParams) != 0 && u.RawQuery != "" {
+		query := u.Query()
+		for param := range query {
+			if p.strip(param) {
+				query.Del(param)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String(), nil
+}
+
+// canonicalHost returns the standard form of host, so different spellings of
+// the same host can't get past a DomainFilter. Names are lowercased and
+// converted to punycode without trailing dot, IP addresses are written like
+// net.IP.String. IPv4 addresses in the forms accepted by browsers like
+// "0x0a.0.0.1" or "10.1" are converted, hosts ending in a number which
+// aren't a valid address are rejected with ErrHost.
+func canonicalHost(host string) (string, error) {
+	if strings.Contains(host, ":") {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "", ErrHost
+		}
+		return ip.String(), nil
+	}
+
+	// A single trailing dot marks a fully qualified name
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || strings.HasSuffix(host, ".") {
+		return "", ErrHost
+	}
+
+	labels := strings.Split(host, ".")
+	if numeric(labels[len(labels)-1]) {
+		ip, ok := parseIPv4(labels)
+		if !ok {
+			return "", ErrHost
+		}
+		return ip.String(), nil
+	}
+
+	host, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", ErrHost
+	}
+
+	return host, nil
+}
+
+// numeric reports whether label is a decimal or hexadecimal number, hosts
+// ending in one are IPv4 addresses
+func numeric(label string) bool {
+	if strings.HasPrefix(label, "0x") {
+		label = label[2:]
+		return strings.Trim(label, "0123456789abcdef") == ""
+	}
+
+	return label != "" && strings.Trim(label, "0123456789") == ""
+}
+
+// parseIPv4 parses an IPv4 address of one to four numbers, each decimal,
+// hexadecimal with 0x or octal with a leading 0. The last number fills the
+// remaining bytes, so "10.1" is 10.0.0.1.
+func parseIPv4(labels []string) (net.IP, bool) {
+	if len(labels) > 4 {
+		return nil, false
+	}
+
+	var ip uint64
+	for i, label := range labels {
+		base := 10
+		switch {
+		case strings.HasPrefix(label, "0x"):
+			base, label = 16, label[2:]
+			if label == "" {
+				label = "0"
+			}
+		case len(label) > 1 && label[0] == '0':
+			base, label = 8, label[1:]
+		}
+
+		n, err := strconv.ParseUint(label, base, 32)
+		if err != nil {
+			return nil, false
+		}
+
+		// All but the last number are single bytes
+		bits := uint(8)
+		if i == len(labels)-1 {
+			bits = uint(8 * (5 - len(labels)))
+		}
+		if n >= 1<<bits {
+			return nil, false
+		}
+		ip = ip<<bits | n
+	}
+
+	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)), true
+}
+
+func (p URLPolicy) allowed(scheme string) bool {
+	schemes := p.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+
+	for _, s := range schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p URLPolicy) strip(param string) bool {
+	for _, s := range p.StripParams {
+		if strings.HasSuffix(s, "*") && strings.HasPrefix(param, s[:len(s)-1]) || param == s {
+			return true
+		}
+	}
+	return false
+}
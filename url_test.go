@@ -0,0 +1,71 @@
+package shrtie
+
+import "testing"
+
+func TestURLPolicyNormalize(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{in: "HTTPS://Here.COM", out: "https://here.com/"},
+		{in: " https://here.com/Path ", out: "https://here.com/Path"},
+		{in: "http://here.com:80/", out: "http://here.com/"},
+		{in: "https://here.com:443/", out: "https://here.com/"},
+		{in: "https://here.com:8080/", out: "https://here.com:8080/"},
+		{in: "https://bücher.example/", out: "https://xn--bcher-kva.example/"},
+		{in: "http://[::1]:80/", out: "http://[::1]/"},
+		{in: "https://Here.com./", out: "https://here.com/"},
+		{in: "http://0x0a.0.0.1/", out: "http://10.0.0.1/"},
+		{in: "http://012.0.0.1/", out: "http://10.0.0.1/"},
+		{in: "http://10.1/", out: "http://10.0.0.1/"},
+		{in: "http://167772161/", out: "http://10.0.0.1/"},
+		{in: "http://[::FFFF:10.0.0.1]/", out: "http://10.0.0.1/"},
+		{in: "https://here.com/?utm_source=a&q=A", out: "https://here.com/?utm_source=a&q=A"},
+	}
+
+	for _, test := range tests {
+		if out, err := (URLPolicy{}).Normalize(test.in); err != nil || out != test.out {
+			t.Errorf("Failed normalize test: Expected '%v' got '%v' (%v).\n", test.out, out, err)
+		}
+	}
+}
+
+func TestURLPolicyReject(t *testing.T) {
+	tests := map[string]error{
+		"":                    ErrEmptyURL,
+		"/relative":           ErrRelativeURL,
+		"javascript:alert(1)": ErrScheme,
+		"ftp://here.com/":     ErrScheme,
+		"http:here.com":       ErrHost,
+		"http:///path":        ErrHost,
+		"http://10.0.0.256/":  ErrHost,
+		"http://a.0x1/":       ErrHost,
+		"http://here.com../":  ErrHost,
+	}
+
+	for in, expected := range tests {
+		if _, err := (URLPolicy{}).Normalize(in); err != expected {
+			t.Errorf("Expected %v for %q got: %v", expected, in, err)
+		}
+	}
+
+	if _, err := (URLPolicy{}).Normalize("http://here.com/%zz"); err == nil {
+		t.Error("Invalid URL was accepted")
+	}
+}
+
+func TestURLPolicyOptions(t *testing.T) {
+	p := URLPolicy{
+		Schemes:     []string{"ftp"},
+		StripParams: TrackingParams,
+	}
+
+	out, err := p.Normalize("FTP://here.com/file?utm_source=a&utm_medium=b&q=A&fbclid=x")
+	if err != nil || out != "ftp://here.com/file?q=A" {
+		t.Error("Wrong normalized URL:", out, err)
+	}
+
+	if _, err = p.Normalize("https://here.com/"); err != ErrScheme {
+		t.Error("Expected ErrScheme got:", err)
+	}
+}